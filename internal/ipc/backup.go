@@ -0,0 +1,58 @@
+package ipc
+
+import (
+	"fmt"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/monitor"
+)
+
+type BackupArgs struct {
+	Name        string
+	Incremental bool
+}
+
+func (h *Handler) BackupVM(args BackupArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: BackupVM(%q, %t)", args.Name, args.Incremental)
+
+	if err := h.monitor.Backup(args.Name, args.Incremental); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (h *Handler) ListBackups(args []string, res *[]*monitor.Backup) error {
+	if len(args) != 1 {
+		return fmt.Errorf("ListBackups: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: ListBackups(%q)", args[0])
+
+	backups, err := h.monitor.Backups(args[0])
+	if err != nil {
+		return logutils.LogErrorR(err)
+	}
+
+	*res = backups
+	return nil
+}
+
+func (c *ClientHandler) BackupVM(name string, incremental bool) (int, error) {
+	var response int
+	if err := c.Client.Call(ServiceName+".BackupVM", BackupArgs{Name: name, Incremental: incremental}, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
+
+func (c *ClientHandler) ListBackups(name string) ([]*monitor.Backup, error) {
+	var response []*monitor.Backup
+	if err := c.Client.Call(ServiceName+".ListBackups", []string{name}, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
@@ -0,0 +1,31 @@
+package ipc
+
+import (
+	"fmt"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+)
+
+func (h *Handler) GetVMCommandLine(args []string, res *[]string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("GetVMCommandLine: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: GetVMCommandLine(%q)", args[0])
+
+	cmdline, err := h.monitor.CommandLine(args[0])
+	if err != nil {
+		return logutils.LogErrorR(err)
+	}
+
+	*res = cmdline
+	return nil
+}
+
+func (c *ClientHandler) GetVMCommandLine(name string) ([]string, error) {
+	var response []string
+	if err := c.Client.Call(ServiceName+".GetVMCommandLine", []string{name}, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
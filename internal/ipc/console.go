@@ -0,0 +1,219 @@
+package ipc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+)
+
+var (
+	// ConsoleReadTimeout is how long a ReadConsole call waits for output
+	// before returning empty handed.
+	ConsoleReadTimeout = time.Second
+
+	// ConsoleIdleTimeout closes sessions of clients that went away without
+	// calling CloseConsole.
+	ConsoleIdleTimeout = 30 * time.Second
+
+	consoleBufferSize = 4096
+)
+
+// a serial console socket accepts a single client at a time, so only one
+// session per virtual machine can be open.
+type consoleSession struct {
+	name  string
+	conn  net.Conn
+	timer *time.Timer
+}
+
+type ConsoleWriteArgs struct {
+	ID   string
+	Data []byte
+}
+
+type ConsoleReadResponse struct {
+	Data   []byte
+	Closed bool
+}
+
+func newConsoleID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (h *Handler) getConsole(id string) (*consoleSession, error) {
+	h.consolesMutex.Lock()
+	defer h.consolesMutex.Unlock()
+
+	session, ok := h.consoles[id]
+	if !ok {
+		return nil, fmt.Errorf("ipc: console session not found")
+	}
+
+	session.timer.Reset(ConsoleIdleTimeout)
+	return session, nil
+}
+
+func (h *Handler) closeConsole(id string) error {
+	h.consolesMutex.Lock()
+	session, ok := h.consoles[id]
+	delete(h.consoles, id)
+	h.consolesMutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("ipc: console session not found")
+	}
+
+	logutils.Notice.Printf("ipc: %s: console detached", session.name)
+
+	session.timer.Stop()
+	return session.conn.Close()
+}
+
+func (h *Handler) OpenConsole(args []string, res *string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("OpenConsole: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: OpenConsole(%q)", args[0])
+
+	socket, err := h.monitor.ConsoleSocket(args[0])
+	if err != nil {
+		return logutils.LogErrorR(err)
+	}
+
+	id, err := newConsoleID()
+	if err != nil {
+		return logutils.LogErrorR(err)
+	}
+
+	h.consolesMutex.Lock()
+	defer h.consolesMutex.Unlock()
+
+	for _, session := range h.consoles {
+		if session.name == args[0] {
+			return logutils.LogErrorR(fmt.Errorf("ipc: %s: console already attached", args[0]))
+		}
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return logutils.LogErrorR(err)
+	}
+
+	h.consoles[id] = &consoleSession{
+		name: args[0],
+		conn: conn,
+		timer: time.AfterFunc(ConsoleIdleTimeout, func() {
+			logutils.Warning.Printf("ipc: %s: console session timed out", args[0])
+			h.closeConsole(id)
+		}),
+	}
+
+	*res = id
+	return nil
+}
+
+func (h *Handler) ReadConsole(args []string, res *ConsoleReadResponse) error {
+	if len(args) != 1 {
+		return fmt.Errorf("ReadConsole: requires 1 argument")
+	}
+
+	session, err := h.getConsole(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := session.conn.SetReadDeadline(time.Now().Add(ConsoleReadTimeout)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, consoleBufferSize)
+	n, err := session.conn.Read(buf)
+	res.Data = buf[:n]
+	if err != nil {
+		if os.IsTimeout(err) {
+			return nil
+		}
+		if err != io.EOF {
+			logutils.LogError(err)
+		}
+		res.Closed = true
+		logutils.LogError(h.closeConsole(args[0]))
+	}
+
+	return nil
+}
+
+func (h *Handler) WriteConsole(args ConsoleWriteArgs, res *int) error {
+	*res = 0
+
+	session, err := h.getConsole(args.ID)
+	if err != nil {
+		*res = 1
+		return err
+	}
+
+	if _, err := session.conn.Write(args.Data); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (h *Handler) CloseConsole(args []string, res *int) error {
+	*res = 0
+
+	if len(args) != 1 {
+		return fmt.Errorf("CloseConsole: requires 1 argument")
+	}
+
+	if err := h.closeConsole(args[0]); err != nil {
+		*res = 1
+		return err
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) OpenConsole(name string) (string, error) {
+	var response string
+	if err := c.Client.Call(ServiceName+".OpenConsole", []string{name}, &response); err != nil {
+		return "", err
+	}
+	return response, nil
+}
+
+func (c *ClientHandler) ReadConsole(id string) (*ConsoleReadResponse, error) {
+	var response ConsoleReadResponse
+	if err := c.Client.Call(ServiceName+".ReadConsole", []string{id}, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (c *ClientHandler) WriteConsole(id string, data []byte) (int, error) {
+	var response int
+	if err := c.Client.Call(ServiceName+".WriteConsole", ConsoleWriteArgs{ID: id, Data: data}, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
+
+func (c *ClientHandler) CloseConsole(id string) (int, error) {
+	var response int
+	if err := c.Client.Call(ServiceName+".CloseConsole", []string{id}, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
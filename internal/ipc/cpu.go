@@ -0,0 +1,32 @@
+package ipc
+
+import (
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+)
+
+type VCPUsArgs struct {
+	Name  string
+	Count int
+}
+
+func (h *Handler) SetVCPUs(args VCPUsArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: SetVCPUs(%q, %d)", args.Name, args.Count)
+
+	if err := h.monitor.SetVCPUs(args.Name, args.Count); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) SetVCPUs(name string, count int) (int, error) {
+	var response int
+	args := VCPUsArgs{Name: name, Count: count}
+	if err := c.Client.Call(ServiceName+".SetVCPUs", args, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
@@ -0,0 +1,32 @@
+package ipc
+
+import (
+	"fmt"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+)
+
+func (h *Handler) DefineVM(args []string, res *int) error {
+	*res = 0
+
+	if len(args) != 2 {
+		return fmt.Errorf("DefineVM: requires 2 arguments")
+	}
+
+	logutils.Notice.Printf("ipc: DefineVM(%q)", args[0])
+
+	if err := h.monitor.Define(args[0], []byte(args[1])); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) DefineVM(name string, config []byte) (int, error) {
+	var response int
+	if err := c.Client.Call(ServiceName+".DefineVM", []string{name, string(config)}, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
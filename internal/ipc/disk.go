@@ -0,0 +1,62 @@
+package ipc
+
+import (
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+)
+
+type AttachDiskArgs struct {
+	Name    string
+	Drive   qemu.Drive
+	Persist bool
+}
+
+type DetachDiskArgs struct {
+	Name    string
+	Drive   string
+	Persist bool
+}
+
+func (h *Handler) AttachDisk(args AttachDiskArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: AttachDisk(%q, %q)", args.Name, args.Drive.File)
+
+	if err := h.monitor.AttachDisk(args.Name, &args.Drive, args.Persist); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (h *Handler) DetachDisk(args DetachDiskArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: DetachDisk(%q, %q)", args.Name, args.Drive)
+
+	if err := h.monitor.DetachDisk(args.Name, args.Drive, args.Persist); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) AttachDisk(name string, drive *qemu.Drive, persist bool) (int, error) {
+	var response int
+	args := AttachDiskArgs{Name: name, Drive: *drive, Persist: persist}
+	if err := c.Client.Call(ServiceName+".AttachDisk", args, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
+
+func (c *ClientHandler) DetachDisk(name string, drive string, persist bool) (int, error) {
+	var response int
+	args := DetachDiskArgs{Name: name, Drive: drive, Persist: persist}
+	if err := c.Client.Call(ServiceName+".DetachDisk", args, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
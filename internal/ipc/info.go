@@ -0,0 +1,32 @@
+package ipc
+
+import (
+	"fmt"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/monitor"
+)
+
+func (h *Handler) GetVMInfo(args []string, res *monitor.Info) error {
+	if len(args) != 1 {
+		return fmt.Errorf("GetVMInfo: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: GetVMInfo(%q)", args[0])
+
+	info, err := h.monitor.Info(args[0])
+	if err != nil {
+		return logutils.LogErrorR(err)
+	}
+
+	*res = *info
+	return nil
+}
+
+func (c *ClientHandler) GetVMInfo(name string) (*monitor.Info, error) {
+	var response monitor.Info
+	if err := c.Client.Call(ServiceName+".GetVMInfo", []string{name}, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
@@ -2,6 +2,7 @@ package ipc
 
 import (
 	"net/rpc"
+	"sync"
 
 	"github.com/rafaelmartins/simplevirt/internal/monitor"
 )
@@ -16,22 +17,30 @@ var (
 type Handler struct {
 	configDir  string
 	runtimeDir string
+	stateDir   string
 	monitor    *monitor.Monitor
+
+	consoles      map[string]*consoleSession
+	consolesMutex *sync.Mutex
 }
 
 type ClientHandler struct {
 	Client *rpc.Client
 }
 
-func RegisterHandlers(configDir string, runtimeDir string) (*monitor.Monitor, error) {
-	mon, err := monitor.NewMonitor(configDir, runtimeDir)
+func RegisterHandlers(configDir string, runtimeDir string, stateDir string, cgroupParent string, saveOnCleanup bool) (*monitor.Monitor, error) {
+	mon, err := monitor.NewMonitor(configDir, runtimeDir, stateDir, cgroupParent, saveOnCleanup)
 	if err != nil {
 		return nil, err
 	}
 	hdr := Handler{
 		configDir:  configDir,
 		runtimeDir: runtimeDir,
+		stateDir:   stateDir,
 		monitor:    mon,
+
+		consoles:      make(map[string]*consoleSession),
+		consolesMutex: &sync.Mutex{},
 	}
 	rpc.RegisterName(ServiceName, &hdr)
 	return mon, nil
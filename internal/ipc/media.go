@@ -0,0 +1,57 @@
+package ipc
+
+import (
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+)
+
+type MediaArgs struct {
+	Name    string
+	Drive   string
+	File    string
+	Force   bool
+	Persist bool
+}
+
+func (h *Handler) ChangeMedia(args MediaArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: ChangeMedia(%q, %q, %q)", args.Name, args.Drive, args.File)
+
+	if err := h.monitor.ChangeMedia(args.Name, args.Drive, args.File, args.Persist); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (h *Handler) EjectMedia(args MediaArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: EjectMedia(%q, %q)", args.Name, args.Drive)
+
+	if err := h.monitor.EjectMedia(args.Name, args.Drive, args.Force, args.Persist); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) ChangeMedia(name string, drive string, file string, persist bool) (int, error) {
+	var response int
+	args := MediaArgs{Name: name, Drive: drive, File: file, Persist: persist}
+	if err := c.Client.Call(ServiceName+".ChangeMedia", args, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
+
+func (c *ClientHandler) EjectMedia(name string, drive string, force bool, persist bool) (int, error) {
+	var response int
+	args := MediaArgs{Name: name, Drive: drive, Force: force, Persist: persist}
+	if err := c.Client.Call(ServiceName+".EjectMedia", args, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
@@ -0,0 +1,32 @@
+package ipc
+
+import (
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+)
+
+type MemoryArgs struct {
+	Name string
+	Size string
+}
+
+func (h *Handler) SetMemory(args MemoryArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: SetMemory(%q, %q)", args.Name, args.Size)
+
+	if err := h.monitor.SetMemory(args.Name, args.Size); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) SetMemory(name string, size string) (int, error) {
+	var response int
+	args := MemoryArgs{Name: name, Size: size}
+	if err := c.Client.Call(ServiceName+".SetMemory", args, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
@@ -0,0 +1,176 @@
+package ipc
+
+import (
+	"fmt"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/monitor"
+)
+
+type PrepareMigrationArgs struct {
+	Name    string
+	Config  []byte
+	Address string
+}
+
+type MigrateArgs struct {
+	Name string
+	URI  string
+}
+
+type FinishMigrationArgs struct {
+	Name   string
+	Paused bool
+}
+
+func (h *Handler) GetRunningConfig(args []string, res *[]byte) error {
+	if len(args) != 1 {
+		return fmt.Errorf("GetRunningConfig: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: GetRunningConfig(%q)", args[0])
+
+	config, err := h.monitor.RunningConfig(args[0])
+	if err != nil {
+		return logutils.LogErrorR(err)
+	}
+
+	*res = config
+	return nil
+}
+
+func (h *Handler) PrepareMigration(args PrepareMigrationArgs, res *int) error {
+	logutils.Notice.Printf("ipc: PrepareMigration(%q, %q)", args.Name, args.Address)
+
+	port, err := h.monitor.PrepareMigration(args.Name, args.Config, args.Address)
+	if err != nil {
+		return logutils.LogErrorR(err)
+	}
+
+	*res = port
+	return nil
+}
+
+func (h *Handler) MigrateVM(args MigrateArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: MigrateVM(%q, %q)", args.Name, args.URI)
+
+	mErr := make(chan error)
+
+	if err := h.monitor.Migrate(args.Name, args.URI, mErr); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	if err := <-mErr; err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (h *Handler) GetMigrationStatus(args []string, res *monitor.MigrationStatus) error {
+	if len(args) != 1 {
+		return fmt.Errorf("GetMigrationStatus: requires 1 argument")
+	}
+
+	status, err := h.monitor.MigrationStatus(args[0])
+	if err != nil {
+		return err
+	}
+
+	*res = *status
+	return nil
+}
+
+func (h *Handler) FinishMigration(args FinishMigrationArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: FinishMigration(%q)", args.Name)
+
+	if err := h.monitor.FinishMigration(args.Name, args.Paused); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (h *Handler) AbortMigration(args []string, res *int) error {
+	*res = 0
+
+	if len(args) != 1 {
+		return fmt.Errorf("AbortMigration: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: AbortMigration(%q)", args[0])
+
+	mErr := make(chan error)
+
+	if err := h.monitor.AbortMigration(args[0], mErr); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	if err := <-mErr; err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) GetRunningConfig(name string) ([]byte, error) {
+	var response []byte
+	if err := c.Client.Call(ServiceName+".GetRunningConfig", []string{name}, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// PrepareMigration returns the tcp port the target virtual machine listens
+// on, at address.
+func (c *ClientHandler) PrepareMigration(name string, config []byte, address string) (int, error) {
+	var response int
+	args := PrepareMigrationArgs{Name: name, Config: config, Address: address}
+	if err := c.Client.Call(ServiceName+".PrepareMigration", args, &response); err != nil {
+		return -1, err
+	}
+	return response, nil
+}
+
+func (c *ClientHandler) MigrateVM(name string, uri string) (int, error) {
+	var response int
+	args := MigrateArgs{Name: name, URI: uri}
+	if err := c.Client.Call(ServiceName+".MigrateVM", args, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
+
+func (c *ClientHandler) GetMigrationStatus(name string) (*monitor.MigrationStatus, error) {
+	var response monitor.MigrationStatus
+	if err := c.Client.Call(ServiceName+".GetMigrationStatus", []string{name}, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (c *ClientHandler) FinishMigration(name string, paused bool) (int, error) {
+	var response int
+	args := FinishMigrationArgs{Name: name, Paused: paused}
+	if err := c.Client.Call(ServiceName+".FinishMigration", args, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
+
+func (c *ClientHandler) AbortMigration(name string) (int, error) {
+	var response int
+	if err := c.Client.Call(ServiceName+".AbortMigration", []string{name}, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
@@ -0,0 +1,96 @@
+package ipc
+
+import (
+	"fmt"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+)
+
+func (h *Handler) SaveVM(args []string, res *int) error {
+	*res = 0
+
+	if len(args) != 1 {
+		return fmt.Errorf("SaveVM: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: SaveVM(%q)", args[0])
+
+	mErr := make(chan error)
+
+	if err := h.monitor.Save(args[0], mErr); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	if err := <-mErr; err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) SaveVM(name string) (int, error) {
+	var response int
+	if err := c.Client.Call(ServiceName+".SaveVM", []string{name}, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
+
+func (h *Handler) RestoreVM(args []string, res *int) error {
+	*res = 0
+
+	if len(args) != 1 {
+		return fmt.Errorf("RestoreVM: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: RestoreVM(%q)", args[0])
+
+	mErr := make(chan error)
+
+	if err := h.monitor.Restore(args[0], mErr); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	if err := <-mErr; err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) RestoreVM(name string) (int, error) {
+	var response int
+	if err := c.Client.Call(ServiceName+".RestoreVM", []string{name}, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
+
+func (h *Handler) DiscardSavedVM(args []string, res *int) error {
+	*res = 0
+
+	if len(args) != 1 {
+		return fmt.Errorf("DiscardSavedVM: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: DiscardSavedVM(%q)", args[0])
+
+	if err := h.monitor.DiscardSaved(args[0]); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) DiscardSavedVM(name string) (int, error) {
+	var response int
+	if err := c.Client.Call(ServiceName+".DiscardSavedVM", []string{name}, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
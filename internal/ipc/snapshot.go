@@ -0,0 +1,100 @@
+package ipc
+
+import (
+	"fmt"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/monitor"
+)
+
+type SnapshotArgs struct {
+	Name     string
+	Snapshot string
+}
+
+func (h *Handler) CreateSnapshot(args SnapshotArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: CreateSnapshot(%q, %q)", args.Name, args.Snapshot)
+
+	if err := h.monitor.CreateSnapshot(args.Name, args.Snapshot); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (h *Handler) ListSnapshots(args []string, res *[]*monitor.Snapshot) error {
+	if len(args) != 1 {
+		return fmt.Errorf("ListSnapshots: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: ListSnapshots(%q)", args[0])
+
+	snapshots, err := h.monitor.Snapshots(args[0])
+	if err != nil {
+		return logutils.LogErrorR(err)
+	}
+
+	*res = snapshots
+	return nil
+}
+
+func (h *Handler) DeleteSnapshot(args SnapshotArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: DeleteSnapshot(%q, %q)", args.Name, args.Snapshot)
+
+	if err := h.monitor.DeleteSnapshot(args.Name, args.Snapshot); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (h *Handler) RevertSnapshot(args SnapshotArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: RevertSnapshot(%q, %q)", args.Name, args.Snapshot)
+
+	if err := h.monitor.RevertSnapshot(args.Name, args.Snapshot); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) CreateSnapshot(name string, snapshot string) (int, error) {
+	var response int
+	if err := c.Client.Call(ServiceName+".CreateSnapshot", SnapshotArgs{Name: name, Snapshot: snapshot}, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
+
+func (c *ClientHandler) ListSnapshots(name string) ([]*monitor.Snapshot, error) {
+	var response []*monitor.Snapshot
+	if err := c.Client.Call(ServiceName+".ListSnapshots", []string{name}, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *ClientHandler) DeleteSnapshot(name string, snapshot string) (int, error) {
+	var response int
+	if err := c.Client.Call(ServiceName+".DeleteSnapshot", SnapshotArgs{Name: name, Snapshot: snapshot}, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
+
+func (c *ClientHandler) RevertSnapshot(name string, snapshot string) (int, error) {
+	var response int
+	if err := c.Client.Call(ServiceName+".RevertSnapshot", SnapshotArgs{Name: name, Snapshot: snapshot}, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
@@ -0,0 +1,34 @@
+package ipc
+
+import (
+	"fmt"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/monitor"
+)
+
+func (h *Handler) GetVMStats(args []string, res *[]*monitor.Stats) error {
+	if len(args) != 1 {
+		return fmt.Errorf("GetVMStats: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: GetVMStats(%q)", args[0])
+
+	stats, err := h.monitor.Stats(args[0])
+	if err != nil {
+		return logutils.LogErrorR(err)
+	}
+
+	*res = stats
+	return nil
+}
+
+// GetVMStats returns the resource usage samples of a running virtual machine,
+// oldest first.
+func (c *ClientHandler) GetVMStats(name string) ([]*monitor.Stats, error) {
+	var response []*monitor.Stats
+	if err := c.Client.Call(ServiceName+".GetVMStats", []string{name}, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
@@ -0,0 +1,34 @@
+package ipc
+
+import (
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+)
+
+type DriveThrottleArgs struct {
+	Name     string
+	Drive    string
+	Throttle qemu.DriveThrottle
+}
+
+func (h *Handler) SetDriveThrottle(args DriveThrottleArgs, res *int) error {
+	*res = 0
+
+	logutils.Notice.Printf("ipc: SetDriveThrottle(%q, %q)", args.Name, args.Drive)
+
+	if err := h.monitor.SetDriveThrottle(args.Name, args.Drive, &args.Throttle); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) SetDriveThrottle(name string, drive string, throttle *qemu.DriveThrottle) (int, error) {
+	var response int
+	args := DriveThrottleArgs{Name: name, Drive: drive, Throttle: *throttle}
+	if err := c.Client.Call(ServiceName+".SetDriveThrottle", args, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
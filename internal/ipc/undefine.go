@@ -0,0 +1,32 @@
+package ipc
+
+import (
+	"fmt"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+)
+
+func (h *Handler) UndefineVM(args []string, res *int) error {
+	*res = 0
+
+	if len(args) != 1 {
+		return fmt.Errorf("UndefineVM: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: UndefineVM(%q)", args[0])
+
+	if err := h.monitor.Undefine(args[0]); err != nil {
+		*res = 1
+		return logutils.LogErrorR(err)
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) UndefineVM(name string) (int, error) {
+	var response int
+	if err := c.Client.Call(ServiceName+".UndefineVM", []string{name}, &response); err != nil {
+		return 2, err
+	}
+	return response, nil
+}
@@ -0,0 +1,40 @@
+package ipc
+
+import (
+	"fmt"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+)
+
+// ValidateVM returns the list of errors found in the configuration of a
+// virtual machine. an empty list means that the configuration is valid.
+func (h *Handler) ValidateVM(args []string, res *[]string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("ValidateVM: requires 1 argument")
+	}
+
+	logutils.Notice.Printf("ipc: ValidateVM(%q)", args[0])
+
+	*res = []string{}
+
+	if err := h.monitor.Validate(args[0]); err != nil {
+		errs, ok := err.(qemu.ConfigErrors)
+		if !ok {
+			return logutils.LogErrorR(err)
+		}
+		for _, e := range errs {
+			*res = append(*res, e.Error())
+		}
+	}
+
+	return nil
+}
+
+func (c *ClientHandler) ValidateVM(name string) ([]string, error) {
+	var response []string
+	if err := c.Client.Call(ServiceName+".ValidateVM", []string{name}, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
@@ -0,0 +1,358 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+	"github.com/rafaelmartins/simplevirt/internal/qmp"
+)
+
+const (
+	backupBitmap = "simplevirt-backup"
+)
+
+var (
+	backupTimeout = 24 * time.Hour
+)
+
+// BackupDrive is the backup of a drive. incremental backups are qcow2
+// images backed by the backup of the drive they are based on, Parent.
+type BackupDrive struct {
+	Drive  string `json:"drive"`
+	File   string `json:"file"`
+	Parent string `json:"parent,omitempty"`
+}
+
+// Backup is a backup of the drives of a virtual machine. full backups start
+// a new chain, and each incremental backup holds the changes made since the
+// previous backup. the backups of a virtual machine are listed in the
+// backups.json file of its backup directory, in creation order.
+type Backup struct {
+	Name        string         `json:"name"`
+	Incremental bool           `json:"incremental"`
+	Created     time.Time      `json:"created"`
+	Drives      []*BackupDrive `json:"drives"`
+}
+
+func backupDir(name string, config *qemu.VirtualMachine) (string, error) {
+	if config.BackupDir == "" {
+		return "", fmt.Errorf("monitor: %s: backup_dir not configured", name)
+	}
+	return filepath.Join(config.BackupDir, name), nil
+}
+
+func readBackups(dir string) ([]*Backup, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "backups.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Backup{}, nil
+		}
+		return nil, err
+	}
+
+	rv := []*Backup{}
+	if err := json.Unmarshal(data, &rv); err != nil {
+		return nil, fmt.Errorf("monitor: %s: invalid backups file: %s", dir, err)
+	}
+	return rv, nil
+}
+
+func writeBackups(dir string, backups []*Backup) error {
+	data, err := json.MarshalIndent(backups, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(dir, "backups.json"), data, 0644)
+}
+
+// chownRunAs gives a file to the user that runs qemu, if any, so that qemu
+// can write to it.
+func chownRunAs(file string, runAs string) error {
+	if runAs == "" {
+		return nil
+	}
+
+	u, err := user.Lookup(runAs)
+	if err != nil {
+		return err
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+
+	return os.Chown(file, uid, gid)
+}
+
+// startBackup starts the backup jobs of all the drives at the same point in
+// time, returning their ids. previous is the backup that an incremental
+// backup is based on.
+func (i *Instance) startBackup(dir string, backup *Backup, previous *Backup) ([]string, error) {
+	actions := []*qmp.TransactionAction{}
+	jobs := []string{}
+
+	cleanup := func() {
+		for _, bd := range backup.Drives {
+			if err := os.Remove(bd.File); err != nil && !os.IsNotExist(err) {
+				logutils.LogError(err)
+			}
+		}
+	}
+
+	for _, idx := range dataDrives(i.Config) {
+		drv := i.Config.Drives[idx-1]
+		drive := drv.DeviceID(idx)
+
+		node, err := i.queryBlockNode(idx, drv)
+		if err != nil {
+			return nil, err
+		}
+
+		bd := &BackupDrive{
+			Drive: drive,
+			File:  filepath.Join(dir, fmt.Sprintf("%s-%s.qcow2", backup.Name, drive)),
+		}
+		if _, err := os.Stat(bd.File); err == nil {
+			return nil, fmt.Errorf("monitor: %s: %s: file already exists: %s", i.Name, drive, bd.File)
+		}
+
+		autoDismiss := false
+		args := &qmp.DriveBackup{
+			JobID:       "backup-" + drive,
+			Device:      node,
+			Target:      bd.File,
+			Format:      "qcow2",
+			AutoDismiss: &autoDismiss,
+		}
+
+		if backup.Incremental {
+			for _, pd := range previous.Drives {
+				if pd.Drive == drive {
+					bd.Parent = pd.File
+				}
+			}
+			if bd.Parent == "" {
+				cleanup()
+				return nil, fmt.Errorf("monitor: %s: %s: not found in the previous backup, a full backup is required", i.Name, drive)
+			}
+
+			// the target must be backed by the previous backup, so qemu
+			// can't create it
+			if err := qemu.CreateOverlay(bd.File, bd.Parent, "qcow2"); err != nil {
+				cleanup()
+				return nil, err
+			}
+			backup.Drives = append(backup.Drives, bd)
+			if err := chownRunAs(bd.File, i.Config.RunAs); err != nil {
+				cleanup()
+				return nil, err
+			}
+
+			args.Sync = "incremental"
+			args.Mode = "existing"
+			args.Bitmap = backupBitmap
+		} else {
+			backup.Drives = append(backup.Drives, bd)
+
+			// changes are tracked from the start of the full backup. a
+			// previous bitmap may not exist. backups of a virtual machine
+			// don't run concurrently, so no running job uses it
+			ctx, cancel := qmpContext()
+			i.qmp.BlockDirtyBitmapRemove(ctx, node, backupBitmap)
+			cancel()
+
+			actions = append(actions, &qmp.TransactionAction{
+				Type: "block-dirty-bitmap-add",
+				Data: &qmp.BlockDirtyBitmap{
+					Node:       node,
+					Name:       backupBitmap,
+					Persistent: drv.Format == "qcow2",
+				},
+			})
+
+			args.Sync = "full"
+			args.Mode = "absolute-paths"
+		}
+
+		actions = append(actions, &qmp.TransactionAction{Type: "drive-backup", Data: args})
+		jobs = append(jobs, args.JobID)
+	}
+
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("monitor: %s: no drives to backup", i.Name)
+	}
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	if err := i.qmp.Transaction(ctx, actions); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// removeBackupBitmaps removes the dirty bitmaps of all the drives, so that
+// incremental backups fail until the next full backup.
+func (i *Instance) removeBackupBitmaps() {
+	for _, idx := range dataDrives(i.Config) {
+		node, err := i.queryBlockNode(idx, i.Config.Drives[idx-1])
+		if err != nil {
+			logutils.LogError(err)
+			continue
+		}
+
+		ctx, cancel := qmpContext()
+		i.qmp.BlockDirtyBitmapRemove(ctx, node, backupBitmap)
+		cancel()
+	}
+}
+
+// Backup creates a backup of the drives of a running virtual machine in its
+// backup directory. incremental backups require a previous backup, and
+// the dirty bitmaps created by the last full backup, that are lost if the
+// virtual machine is restarted, unless all the images are qcow2.
+func (m *Monitor) Backup(name string, incremental bool) error {
+	logutils.Notice.Printf("monitor: requesting backup: %s (incremental: %t)", name, incremental)
+
+	instance, err := m.runningInstance(name)
+	if err != nil {
+		return err
+	}
+
+	dir, err := backupDir(name, instance.Config)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := chownRunAs(dir, instance.Config.RunAs); err != nil {
+		return err
+	}
+
+	// a full backup replaces the bitmaps used by the running jobs, and an
+	// incremental backup must be based on the last one, so only one backup
+	// of a virtual machine runs at a time
+	m.backupsMutex.Lock()
+	if m.backupsRunning[name] {
+		m.backupsMutex.Unlock()
+		return fmt.Errorf("monitor: %s: backup in progress", name)
+	}
+	m.backupsRunning[name] = true
+	backups, err := readBackups(dir)
+	m.backupsMutex.Unlock()
+
+	defer func() {
+		m.backupsMutex.Lock()
+		delete(m.backupsRunning, name)
+		m.backupsMutex.Unlock()
+	}()
+
+	if err != nil {
+		return err
+	}
+
+	var previous *Backup
+	if incremental {
+		if len(backups) == 0 {
+			return fmt.Errorf("monitor: %s: no previous backup, a full backup is required", name)
+		}
+		previous = backups[len(backups)-1]
+	}
+
+	// backups run one at a time, and take way longer than a microsecond
+	now := time.Now()
+	backup := &Backup{
+		Name:        now.Format("20060102-150405.000000"),
+		Incremental: incremental,
+		Created:     now,
+		Drives:      []*BackupDrive{},
+	}
+
+	var jobs []string
+	if err := instance.call(func() error {
+		var err error
+		jobs, err = instance.startBackup(dir, backup, previous)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	// backups take a while, and the virtual machine must remain manageable
+	// meanwhile, so the jobs are not waited in the instance goroutine
+	for _, job := range jobs {
+		// all the jobs must be dismissed, even after a failure
+		if e := instance.waitJob(job, backupTimeout); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if err != nil {
+		for _, bd := range backup.Drives {
+			if err := os.Remove(bd.File); err != nil && !os.IsNotExist(err) {
+				logutils.LogError(err)
+			}
+		}
+
+		// the bitmaps of the jobs that succeeded were cleared, and the
+		// changes they tracked are not in any backup now
+		logutils.LogError(instance.call(func() error {
+			instance.removeBackupBitmaps()
+			return nil
+		}))
+
+		return fmt.Errorf("%s\nmonitor: %s: backup failed, a full backup is required", err, name)
+	}
+
+	m.backupsMutex.Lock()
+	defer m.backupsMutex.Unlock()
+
+	backups, err = readBackups(dir)
+	if err != nil {
+		return err
+	}
+
+	return writeBackups(dir, append(backups, backup))
+}
+
+// Backups lists the backups of a virtual machine, in creation order.
+func (m *Monitor) Backups(name string) ([]*Backup, error) {
+	if err := qemu.CheckName(name); err != nil {
+		return nil, err
+	}
+
+	config, err := qemu.ParseConfig(m.ConfigDir, name)
+	if instance := m.Get(name); instance != nil {
+		config, err = instance.Config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := backupDir(name, config)
+	if err != nil {
+		return nil, err
+	}
+
+	m.backupsMutex.Lock()
+	defer m.backupsMutex.Unlock()
+
+	return readBackups(dir)
+}
@@ -0,0 +1,164 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+)
+
+// CgroupUsage is the resource usage of the cgroup of a virtual machine. cpu
+// time is in microseconds, memory and io in bytes.
+type CgroupUsage struct {
+	CPUTime    int64 `json:"cpu_time" yaml:"cpu_time"`
+	Memory     int64 `json:"memory" yaml:"memory"`
+	PIDs       int64 `json:"pids" yaml:"pids"`
+	ReadBytes  int64 `json:"read_bytes" yaml:"read_bytes"`
+	WriteBytes int64 `json:"write_bytes" yaml:"write_bytes"`
+}
+
+func (m *Monitor) cgroupPath(name string) string {
+	if m.CgroupParent == "" {
+		return ""
+	}
+	return filepath.Join(m.CgroupParent, name)
+}
+
+func writeCgroupFile(dir string, name string, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("monitor: failed to write cgroup file: %s", err)
+	}
+	return nil
+}
+
+func readCgroupInt(dir string, name string) (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return -1, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readCgroupKeys sums the values of keys in a cgroup file with key=value or
+// "key value" pairs, like cpu.stat and io.stat.
+func readCgroupKeys(dir string, name string, keys map[string]*int64) error {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for j, field := range fields {
+			key, value := field, ""
+			if pieces := strings.SplitN(field, "=", 2); len(pieces) == 2 {
+				key, value = pieces[0], pieces[1]
+			} else if j+1 < len(fields) {
+				value = fields[j+1]
+			}
+			if v, ok := keys[key]; ok {
+				n, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return err
+				}
+				*v += n
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// setupCgroup moves the qemu process into its own cgroup, below the cgroup
+// parent, with the limits from the configuration.
+func (i *Instance) setupCgroup() error {
+	path := i.monitor.cgroupPath(i.Name)
+	if path == "" {
+		if i.Config.Cgroup.Enabled() {
+			logutils.Warning.Printf("monitor: %s: cgroup limits ignored, no cgroup parent configured", i.Name)
+		}
+		return nil
+	}
+
+	files, err := i.Config.CgroupFiles()
+	if err != nil {
+		return err
+	}
+
+	parent := i.monitor.CgroupParent
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	if err := writeCgroupFile(parent, "cgroup.subtree_control", "+cpu +io +memory +pids"); err != nil {
+		return err
+	}
+
+	// a cgroup left behind by a previous run may have stale io limits
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logutils.LogError(err)
+	}
+	if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	for _, f := range files {
+		if err := writeCgroupFile(path, f.Name, f.Value); err != nil {
+			return err
+		}
+	}
+
+	i.mutex.RLock()
+	pid := i.pid
+	i.mutex.RUnlock()
+
+	if err := writeCgroupFile(path, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+		return err
+	}
+
+	logutils.Notice.Printf("monitor: %s: cgroup: %s", i.Name, path)
+
+	return nil
+}
+
+// removeCgroup removes the cgroup of the virtual machine, after its process
+// exited.
+func (i *Instance) removeCgroup() {
+	path := i.monitor.cgroupPath(i.Name)
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logutils.LogError(err)
+	}
+}
+
+func (i *Instance) cgroupUsage() (*CgroupUsage, error) {
+	path := i.monitor.cgroupPath(i.Name)
+	if path == "" {
+		return nil, nil
+	}
+
+	rv := &CgroupUsage{}
+	var err error
+
+	if err := readCgroupKeys(path, "cpu.stat", map[string]*int64{"usage_usec": &rv.CPUTime}); err != nil {
+		return nil, err
+	}
+	if rv.Memory, err = readCgroupInt(path, "memory.current"); err != nil {
+		return nil, err
+	}
+	if rv.PIDs, err = readCgroupInt(path, "pids.current"); err != nil {
+		return nil, err
+	}
+	if err := readCgroupKeys(path, "io.stat", map[string]*int64{"rbytes": &rv.ReadBytes, "wbytes": &rv.WriteBytes}); err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
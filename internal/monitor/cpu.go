@@ -0,0 +1,145 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qmp"
+)
+
+func propValue(p *int) int {
+	if p == nil {
+		return -1
+	}
+	return *p
+}
+
+func cpuProps(cpu *qmp.HotpluggableCPU) []int {
+	p := cpu.Props
+	return []int{propValue(p.NodeID), propValue(p.SocketID), propValue(p.DieID), propValue(p.CoreID), propValue(p.ThreadID)}
+}
+
+func (i *Instance) vcpus() (int, error) {
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	cpus, err := i.qmp.QueryCPUsFast(ctx)
+	if err != nil {
+		return -1, err
+	}
+	return len(cpus), nil
+}
+
+func (i *Instance) setVCPUs(count int) error {
+	max, err := i.Config.MaxCPUs()
+	if err != nil {
+		return err
+	}
+	if count < 1 || count > max {
+		return fmt.Errorf("monitor: %s: invalid number of vcpus (%d). must be between 1 and %d", i.Name, count, max)
+	}
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	cpus, err := i.qmp.QueryHotpluggableCPUs(ctx)
+	if err != nil {
+		return err
+	}
+
+	current := 0
+	free := []*qmp.HotpluggableCPU{}
+	for _, cpu := range cpus {
+		if cpu.QOMPath != "" {
+			current += cpu.VCPUsCount
+		} else {
+			free = append(free, cpu)
+		}
+	}
+
+	if count < current {
+		return fmt.Errorf("monitor: %s: vcpus can't be removed (%d running)", i.Name, current)
+	}
+
+	// fill the slots in topology order, as qemu does at startup
+	sort.Slice(free, func(a, b int) bool {
+		pa, pb := cpuProps(free[a]), cpuProps(free[b])
+		for j := range pa {
+			if pa[j] != pb[j] {
+				return pa[j] < pb[j]
+			}
+		}
+		return false
+	})
+
+	// slots may hold more than one vcpu (e.g. a core with its threads), and
+	// are plugged whole. fail before plugging anything if count can't be hit
+	plug := []*qmp.HotpluggableCPU{}
+	total := current
+	for _, cpu := range free {
+		if total >= count {
+			break
+		}
+		if total+cpu.VCPUsCount > count {
+			return fmt.Errorf("monitor: %s: invalid number of vcpus (%d). vcpus are hotplugged %d at a time (%d running)",
+				i.Name, count, cpu.VCPUsCount, current)
+		}
+		plug = append(plug, cpu)
+		total += cpu.VCPUsCount
+	}
+
+	for _, cpu := range plug {
+		dev := map[string]interface{}{
+			"driver": cpu.Type,
+			"id":     fmt.Sprintf("vcpu%d", current),
+		}
+		for _, p := range []struct {
+			name  string
+			value *int
+		}{
+			{"node-id", cpu.Props.NodeID},
+			{"socket-id", cpu.Props.SocketID},
+			{"die-id", cpu.Props.DieID},
+			{"core-id", cpu.Props.CoreID},
+			{"thread-id", cpu.Props.ThreadID},
+		} {
+			if p.value != nil {
+				dev[p.name] = *p.value
+			}
+		}
+
+		if err := i.qmp.DeviceAdd(ctx, dev); err != nil {
+			return err
+		}
+		current += cpu.VCPUsCount
+
+		// restarts and migrations keep the vcpus
+		i.Config.CPUs = current
+	}
+
+	logutils.LogError(i.writeState())
+	logutils.LogError(i.applyPinning())
+
+	if current < count {
+		return fmt.Errorf("monitor: %s: no free vcpu slots (%d running)", i.Name, current)
+	}
+
+	return nil
+}
+
+// SetVCPUs hotplugs vcpus into a running virtual machine, up to count, that
+// can't be greater than cpu_topology.maxcpus, and must be reachable by the
+// hotplug slots, that may hold more than one vcpu. vcpus can't be removed.
+func (m *Monitor) SetVCPUs(name string, count int) error {
+	logutils.Notice.Printf("monitor: requesting vcpus change: %s: %d", name, count)
+
+	instance, err := m.runningInstance(name)
+	if err != nil {
+		return err
+	}
+
+	return instance.call(func() error {
+		return instance.setVCPUs(count)
+	})
+}
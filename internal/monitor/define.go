@@ -0,0 +1,114 @@
+package monitor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+)
+
+// Define validates and writes the configuration of a virtual machine to the
+// configuration directory, replacing any existing one. a running virtual
+// machine keeps its current configuration until restarted.
+func (m *Monitor) Define(name string, data []byte) error {
+	logutils.Notice.Printf("monitor: requesting define: %s", name)
+
+	if _, err := qemu.ValidateConfig(name, data); err != nil {
+		return err
+	}
+
+	file, err := qemu.ConfigFile(m.ConfigDir, name)
+	if err != nil {
+		file = filepath.Join(m.ConfigDir, name+".yml")
+	}
+
+	return writeFileAtomic(file, data, 0644)
+}
+
+// Validate validates the configuration file of a virtual machine. see
+// qemu.ValidateConfig.
+func (m *Monitor) Validate(name string) error {
+	cfg, err := qemu.ConfigFile(m.ConfigDir, name)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(cfg)
+	if err != nil {
+		return err
+	}
+
+	_, err = qemu.ValidateConfig(name, data)
+	return err
+}
+
+// CommandLine returns the command line that would be used to start a
+// virtual machine. as tap devices are only created when starting, their
+// names are replaced with placeholders.
+func (m *Monitor) CommandLine(name string) ([]string, error) {
+	config, err := qemu.ParseConfig(m.ConfigDir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, nic := range config.NICs {
+		if nic != nil && nic.Bridge != "" {
+			nic.SetDevice("<tap>")
+		}
+	}
+
+	inst := &Instance{monitor: m, Name: name}
+	config.SetName(name)
+	config.SetQMP(inst.QMPSocket())
+	config.SetPIDFile(inst.PIDFile())
+	config.SetConsole(inst.ConsoleSocket())
+
+	return qemu.CommandLine(config)
+}
+
+func (m *Monitor) Undefine(name string) error {
+	logutils.Notice.Printf("monitor: requesting undefine: %s", name)
+
+	if err := qemu.CheckName(name); err != nil {
+		return err
+	}
+
+	// same order as the snapshot operations
+	m.snapshotsMutex.Lock()
+	defer m.snapshotsMutex.Unlock()
+
+	// hold the lock, so that the virtual machine can't be started while
+	// its configuration is removed
+	m.instancesMutex.Lock()
+	defer m.instancesMutex.Unlock()
+
+	if _, ok := m.instances[name]; ok {
+		return fmt.Errorf("monitor: %s: virtual machine is running", name)
+	}
+
+	found := false
+	for {
+		file, err := qemu.ConfigFile(m.ConfigDir, name)
+		if err != nil {
+			break
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		found = true
+	}
+
+	if !found {
+		return fmt.Errorf("monitor: virtual machine not found: %s", name)
+	}
+
+	if err := m.removeSaved(name); err != nil {
+		return err
+	}
+
+	// the images of the snapshots are left alone
+	return m.writeSnapshots(name, nil)
+}
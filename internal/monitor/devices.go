@@ -0,0 +1,454 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+	"github.com/rafaelmartins/simplevirt/internal/qmp"
+)
+
+var (
+	// time given to the guest to release a device after device_del
+	unplugTimeout = 10 * time.Second
+)
+
+// findDrive returns the index (starting from 1) and the configuration of a
+// drive, by its name, as returned by qemu.Drive.DeviceID.
+func (i *Instance) findDrive(drive string) (int, *qemu.Drive, error) {
+	for idx, drv := range i.Config.Drives {
+		if drv != nil && drv.DeviceID(idx+1) == drive {
+			return idx + 1, drv, nil
+		}
+	}
+	return -1, nil, fmt.Errorf("monitor: %s: drive not found: %s", i.Name, drive)
+}
+
+// backendName returns the name of the block backend of legacy drive number
+// idx. qemu names the legacy drives without id itself (e.g. virtio0), and
+// query-block lists them in the order of the command line, before the
+// default drives.
+func backendName(blocks []*qmp.BlockInfo, drives []*qemu.Drive, idx int) string {
+	if id := drives[idx-1].ID; id != "" {
+		return id
+	}
+
+	n := 0
+	for _, drv := range drives[:idx-1] {
+		if drv != nil && drv.Device == "" {
+			n++
+		}
+	}
+
+	for _, block := range blocks {
+		if block.Device == "" {
+			continue
+		}
+		if n == 0 {
+			return block.Device
+		}
+		n--
+	}
+	return ""
+}
+
+// driveTarget returns how qmp commands select a drive: legacy drives by the
+// name of their block backend, -blockdev drives by the id of their device.
+func driveTarget(blocks []*qmp.BlockInfo, drives []*qemu.Drive, idx int) (string, string) {
+	drv := drives[idx-1]
+	if drv.Device == "" {
+		return backendName(blocks, drives, idx), ""
+	}
+	return "", drv.DeviceID(idx)
+}
+
+// queryDriveTarget is like driveTarget, but only asks qemu for the block
+// backends when needed.
+func (i *Instance) queryDriveTarget(idx int, drv *qemu.Drive) (string, string, error) {
+	if drv.Device != "" || drv.ID != "" {
+		device, id := driveTarget(nil, i.Config.Drives, idx)
+		return device, id, nil
+	}
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	blocks, err := i.qmp.QueryBlock(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	device, id := driveTarget(blocks, i.Config.Drives, idx)
+	if device == "" && id == "" {
+		return "", "", fmt.Errorf("monitor: %s: drive not found by qemu: %s", i.Name, drv.DeviceID(idx))
+	}
+	return device, id, nil
+}
+
+// editConfig applies edit to the configuration file of a virtual machine,
+// with the index of drive as found in the file, that may have been changed
+// since the virtual machine was started.
+func (m *Monitor) editConfig(name string, drive string, edit func(data []byte, idx int) ([]byte, error)) error {
+	file, err := qemu.ConfigFile(m.ConfigDir, name)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	idx := -1
+	if drive != "" {
+		config, err := qemu.LoadConfig(data)
+		if err != nil {
+			return err
+		}
+		for j, drv := range config.Drives {
+			if drv != nil && drv.DeviceID(j+1) == drive {
+				idx = j + 1
+				break
+			}
+		}
+		if idx < 0 {
+			return fmt.Errorf("monitor: %s: drive not found in configuration file: %s", name, drive)
+		}
+	}
+
+	data, err = edit(data, idx)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(file, data, 0644)
+}
+
+// updated must be called after the running configuration is changed.
+func (i *Instance) updated(drive string, persist bool, edit func(data []byte, idx int) ([]byte, error)) error {
+	logutils.LogError(i.writeState())
+
+	if !persist {
+		return nil
+	}
+
+	if err := i.monitor.editConfig(i.Name, drive, edit); err != nil {
+		return fmt.Errorf("monitor: %s: virtual machine changed, but configuration not saved: %s", i.Name, err)
+	}
+
+	return nil
+}
+
+func (i *Instance) changeMedia(drive string, file string, force bool, persist bool) error {
+	idx, drv, err := i.findDrive(drive)
+	if err != nil {
+		return err
+	}
+
+	if drv.Media != "cdrom" {
+		return fmt.Errorf("monitor: %s: %s: not a cdrom drive", i.Name, drive)
+	}
+
+	device, id, err := i.queryDriveTarget(idx, drv)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	if file == "" {
+		err = i.qmp.Eject(ctx, device, id, force)
+	} else {
+		err = i.qmp.BlockdevChangeMedium(ctx, device, id, file, drv.Format)
+	}
+	if err != nil {
+		return err
+	}
+
+	drv.File = file
+
+	return i.updated(drive, persist, func(data []byte, idx int) ([]byte, error) {
+		return qemu.SetConfigDriveFile(data, idx, file)
+	})
+}
+
+func (i *Instance) attachDisk(drv *qemu.Drive, persist bool) error {
+	idx := len(i.Config.Drives) + 1
+
+	hotplug, err := qemu.NewDriveHotplug(idx, drv, i.Config.Drives)
+	if err != nil {
+		return err
+	}
+
+	// the default id depends on the position of the drive, that changes if
+	// other drives are detached
+	drv.ID = drv.DeviceID(idx)
+
+	// the rollback gets new contexts, the ones of the commands that failed
+	// may have expired
+	rollback := []func() error{}
+	undo := func() {
+		for j := len(rollback) - 1; j >= 0; j-- {
+			logutils.LogError(rollback[j]())
+		}
+	}
+	remove := func(del func(ctx context.Context, id string) error, id string) {
+		rollback = append(rollback, func() error {
+			ctx, cancel := qmpContext()
+			defer cancel()
+			return del(ctx, id)
+		})
+	}
+
+	if hotplug.IOThread != "" {
+		ctx, cancel := qmpContext()
+		err := i.qmp.ObjectAdd(ctx, "iothread", hotplug.IOThread)
+		cancel()
+		if err != nil {
+			return err
+		}
+		remove(i.qmp.ObjectDel, hotplug.IOThread)
+	}
+
+	if hotplug.ThrottleGroup != nil {
+		ctx, cancel := qmpContext()
+		err := i.qmp.ObjectAddOptions(ctx, hotplug.ThrottleGroup)
+		cancel()
+		if err != nil {
+			undo()
+			return err
+		}
+		remove(i.qmp.ObjectDel, qemu.DriveThrottleGroup(idx, drv))
+	}
+
+	for j, node := range hotplug.Blockdevs {
+		ctx, cancel := qmpContext()
+		err := i.qmp.BlockdevAdd(ctx, node)
+		cancel()
+		if err != nil {
+			undo()
+			return err
+		}
+		remove(i.qmp.BlockdevDel, qemu.DriveNodeNames(idx, drv)[len(hotplug.Blockdevs)-1-j])
+	}
+
+	ctx, cancel := qmpContext()
+	err = i.qmp.DeviceAdd(ctx, hotplug.Device)
+	cancel()
+	if err != nil {
+		undo()
+		return err
+	}
+
+	i.Config.Drives = append(i.Config.Drives, drv)
+
+	return i.updated("", persist, func(data []byte, idx int) ([]byte, error) {
+		return qemu.AppendConfigDrive(data, drv)
+	})
+}
+
+// startDetach asks the guest to release the device of a drive. the returned
+// channel is closed when qemu reports that the device was removed.
+func (i *Instance) startDetach(drive string) (<-chan struct{}, error) {
+	_, drv, err := i.findDrive(drive)
+	if err != nil {
+		return nil, err
+	}
+
+	if drv.Device == "" {
+		return nil, fmt.Errorf("monitor: %s: %s: only drives with device can be detached", i.Name, drive)
+	}
+	if drv.Device == "ide-hd" {
+		return nil, fmt.Errorf("monitor: %s: %s: ide-hd does not support hotplug", i.Name, drive)
+	}
+	if _, ok := i.unplugs[drive]; ok {
+		return nil, fmt.Errorf("monitor: %s: %s: detach in progress", i.Name, drive)
+	}
+
+	// the event is handled by the instance goroutine, so it can't be missed
+	// by registering the channel before the command
+	unplugged := make(chan struct{})
+	i.unplugs[drive] = unplugged
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	if err := i.qmp.DeviceDel(ctx, drive); err != nil {
+		delete(i.unplugs, drive)
+		return nil, err
+	}
+
+	return unplugged, nil
+}
+
+// finishDetach removes the block nodes and objects of a drive whose device
+// was removed, and the drive from the configuration.
+func (i *Instance) finishDetach(drive string, persist bool) error {
+	idx, drv, err := i.findDrive(drive)
+	if err != nil {
+		return err
+	}
+
+	// nodes of cdroms are replaced when media is changed, and removed with
+	// the device, so failures are not fatal here
+	if drv.File != "" {
+		for _, node := range qemu.DriveNodeNames(idx, drv) {
+			ctx, cancel := qmpContext()
+			logutils.LogError(i.qmp.BlockdevDel(ctx, node))
+			cancel()
+		}
+	}
+	if group := qemu.DriveThrottleGroup(idx, drv); group != "" {
+		ctx, cancel := qmpContext()
+		logutils.LogError(i.qmp.ObjectDel(ctx, group))
+		cancel()
+	}
+	if iothread := qemu.DriveIOThread(idx, drv); iothread != "" {
+		ctx, cancel := qmpContext()
+		logutils.LogError(i.qmp.ObjectDel(ctx, iothread))
+		cancel()
+	}
+
+	// keep the names of the drives after the removed one
+	drives := []*qemu.Drive{}
+	for j, d := range i.Config.Drives {
+		if j+1 == idx {
+			continue
+		}
+		if d != nil && j+1 > idx {
+			d.ID = d.DeviceID(j + 1)
+		}
+		drives = append(drives, d)
+	}
+	i.Config.Drives = drives
+
+	return i.updated(drive, persist, qemu.RemoveConfigDrive)
+}
+
+func (m *Monitor) runningInstance(name string) (*Instance, error) {
+	instance := m.Get(name)
+	if instance == nil || !instance.ProcessRunning() {
+		return nil, fmt.Errorf("monitor: %q not running", name)
+	}
+	return instance, nil
+}
+
+// withInstance calls online in the goroutine of the running instance of a
+// virtual machine or, if it is not running, calls offline, holding the lock
+// that prevents it from being started. a nil function means that the
+// operation is not supported in that state.
+func (m *Monitor) withInstance(name string, online func(*Instance) error, offline func() error) error {
+	m.instancesMutex.Lock()
+	instance, ok := m.instances[name]
+	if !ok {
+		defer m.instancesMutex.Unlock()
+		if offline == nil {
+			return fmt.Errorf("monitor: %q not running", name)
+		}
+		return offline()
+	}
+	m.instancesMutex.Unlock()
+
+	if online == nil {
+		return fmt.Errorf("monitor: %s: virtual machine is running", name)
+	}
+	if !instance.ProcessRunning() {
+		return fmt.Errorf("monitor: %q not running", name)
+	}
+
+	return instance.call(func() error {
+		return online(instance)
+	})
+}
+
+// ChangeMedia inserts file into a cdrom drive of a running virtual machine,
+// replacing the current media, if any.
+func (m *Monitor) ChangeMedia(name string, drive string, file string, persist bool) error {
+	logutils.Notice.Printf("monitor: requesting media change: %s: %s: %s", name, drive, file)
+
+	if file == "" {
+		return fmt.Errorf("monitor: %s: %s: missing media file", name, drive)
+	}
+
+	instance, err := m.runningInstance(name)
+	if err != nil {
+		return err
+	}
+
+	return instance.call(func() error {
+		return instance.changeMedia(drive, file, false, persist)
+	})
+}
+
+func (m *Monitor) EjectMedia(name string, drive string, force bool, persist bool) error {
+	logutils.Notice.Printf("monitor: requesting media eject: %s: %s", name, drive)
+
+	instance, err := m.runningInstance(name)
+	if err != nil {
+		return err
+	}
+
+	return instance.call(func() error {
+		return instance.changeMedia(drive, "", force, persist)
+	})
+}
+
+// AttachDisk adds a drive to a running virtual machine. the drive must use
+// the -blockdev/-device syntax, see qemu.NewDriveHotplug.
+func (m *Monitor) AttachDisk(name string, drv *qemu.Drive, persist bool) error {
+	logutils.Notice.Printf("monitor: requesting disk attach: %s: %s", name, drv.File)
+
+	instance, err := m.runningInstance(name)
+	if err != nil {
+		return err
+	}
+
+	return instance.call(func() error {
+		return instance.attachDisk(drv, persist)
+	})
+}
+
+func (m *Monitor) DetachDisk(name string, drive string, persist bool) error {
+	logutils.Notice.Printf("monitor: requesting disk detach: %s: %s", name, drive)
+
+	instance, err := m.runningInstance(name)
+	if err != nil {
+		return err
+	}
+
+	var unplugged <-chan struct{}
+	if err := instance.call(func() error {
+		var err error
+		unplugged, err = instance.startDetach(drive)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	// the device is only removed when the guest releases it, that may take
+	// a while or never happen, so it is not waited in the instance goroutine
+	timer := time.NewTimer(unplugTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-unplugged:
+	case <-timer.C:
+		logutils.LogError(instance.call(func() error {
+			if instance.unplugs[drive] == unplugged {
+				delete(instance.unplugs, drive)
+			}
+			return nil
+		}))
+		return fmt.Errorf("monitor: %s: %s: device removal not completed by the guest", name, drive)
+	case <-instance.done:
+		return fmt.Errorf("monitor: %q not running", name)
+	}
+
+	return instance.call(func() error {
+		return instance.finishDetach(drive, persist)
+	})
+}
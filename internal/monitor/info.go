@@ -0,0 +1,149 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+)
+
+type NICInfo struct {
+	Device string `json:"device" yaml:"device"`
+	Bridge string `json:"bridge" yaml:"bridge"`
+}
+
+// Info describes a virtual machine. it is sent over the control socket, and
+// printed by simplevirtctl, so field names are part of its output schema.
+type Info struct {
+	Name        string         `json:"name" yaml:"name"`
+	Status      string         `json:"status" yaml:"status"`
+	PID         int            `json:"pid" yaml:"pid"`
+	StartedAt   time.Time      `json:"started_at" yaml:"started_at"`
+	Uptime      int64          `json:"uptime" yaml:"uptime"`
+	Retries     int            `json:"retries" yaml:"retries"`
+	NICs        []*NICInfo     `json:"nics" yaml:"nics"`
+	VNC         string         `json:"vnc" yaml:"vnc"`
+	VCPUs       int            `json:"vcpus" yaml:"vcpus"`
+	Memory      int64          `json:"memory" yaml:"memory"`
+	Pinning     []*PinningInfo `json:"pinning" yaml:"pinning"`
+	Cgroup      *CgroupUsage   `json:"cgroup,omitempty" yaml:"cgroup,omitempty"`
+	CommandLine []string       `json:"command_line" yaml:"command_line"`
+	ConfigFile  string         `json:"config_file" yaml:"config_file"`
+}
+
+func processCmdline(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(string(bytes.TrimRight(data, "\x00")), "\x00"), nil
+}
+
+func (i *Instance) vncAddress() string {
+	if i.Config.VNCDisplay == "" {
+		return ""
+	}
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	vnc, err := i.qmp.QueryVNC(ctx)
+	if err != nil || !vnc.Enabled || vnc.Service == "" {
+		return i.Config.VNCDisplay
+	}
+
+	return net.JoinHostPort(vnc.Host, vnc.Service)
+}
+
+func (i *Instance) Info() *Info {
+	info := &Info{
+		Name:   i.Name,
+		Status: i.Status(),
+		PID:    -1,
+		NICs:   []*NICInfo{},
+	}
+
+	if cfg, err := qemu.ConfigFile(i.monitor.ConfigDir, i.Name); err == nil {
+		info.ConfigFile = cfg
+	}
+
+	for _, nic := range i.NICs {
+		info.NICs = append(info.NICs, &NICInfo{Device: nic.ID, Bridge: nic.Bridge})
+	}
+
+	i.mutex.RLock()
+	info.Retries = i.retries
+	startedAt := i.startedAt
+	i.mutex.RUnlock()
+
+	if !i.ProcessRunning() {
+		return info
+	}
+
+	i.mutex.RLock()
+	info.PID = i.pid
+	i.mutex.RUnlock()
+
+	if !startedAt.IsZero() {
+		info.StartedAt = startedAt
+		info.Uptime = int64(time.Since(startedAt).Seconds())
+	}
+
+	cmdline, err := processCmdline(info.PID)
+	logutils.LogError(err)
+	info.CommandLine = cmdline
+
+	info.VNC = i.vncAddress()
+
+	if vcpus, err := i.vcpus(); err == nil {
+		info.VCPUs = vcpus
+	} else {
+		logutils.LogError(err)
+	}
+
+	if memory, err := i.memory(); err == nil {
+		info.Memory = memory
+	} else {
+		logutils.LogError(err)
+	}
+
+	if pinning, err := i.pinning(); err == nil {
+		info.Pinning = pinning
+	} else {
+		logutils.LogError(err)
+	}
+
+	if usage, err := i.cgroupUsage(); err == nil {
+		info.Cgroup = usage
+	} else {
+		logutils.LogError(err)
+	}
+
+	return info
+}
+
+func (m *Monitor) Info(name string) (*Info, error) {
+	instance := m.Get(name)
+	if instance != nil {
+		return instance.Info(), nil
+	}
+
+	cfg, err := qemu.ConfigFile(m.ConfigDir, name)
+	if err != nil {
+		return nil, fmt.Errorf("monitor: virtual machine not found: %s", name)
+	}
+
+	return &Info{
+		Name:       name,
+		Status:     "stopped",
+		PID:        -1,
+		NICs:       []*NICInfo{},
+		ConfigFile: cfg,
+	}, nil
+}
@@ -1,6 +1,8 @@
 package monitor
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
@@ -15,59 +17,129 @@ import (
 	"github.com/rafaelmartins/simplevirt/internal/qmp"
 )
 
+var (
+	// time given to the qmp session to deliver the events sent by qemu
+	// before it exited
+	exitEventsTimeout = time.Second
+)
+
 type Operation int
 
 const (
 	Start Operation = iota
 	Shutdown
 	Reset
+	Detach
+	Pause
+	Resume
+	Call
+	Save
+	Migrate
 )
 
+type opRequest struct {
+	op     Operation
+	result chan error
+	fn     func() error
+}
+
 type Instance struct {
-	monitor  *Monitor
-	Config   *qemu.VirtualMachine `json:"config"`
-	Name     string               `json:"name"`
-	NICs     []*NIC               `json:"nics"`
-	pid      int
-	retries  int
-	op       Operation
-	opMutex  *sync.RWMutex
-	opResult chan error
+	monitor      *Monitor
+	Config       *qemu.VirtualMachine `json:"config"`
+	Name         string               `json:"name"`
+	NICs         []*NIC               `json:"nics"`
+	qmp          *qmp.Session
+	pid          int
+	retries      int
+	mutex        *sync.RWMutex
+	ops          chan *opRequest
+	done         chan struct{}
+	exited       <-chan struct{}
+	unwatch      func()
+	retry        <-chan time.Time
+	stable       <-chan time.Time
+	lastShutdown *shutdownEventData
+	panicked     bool
+	startedAt    time.Time
+	stats        statsRing
+
+	// set while the instance waits for a virtual machine migrated from
+	// another host, to the uri qemu listens on
+	incoming string
+
+	// set while the virtual machine is migrated to another host
+	migrating bool
+
+	// channels closed when the devices being detached are removed, by id
+	unplugs map[string]chan struct{}
 }
 
-func newInstance(monitor *Monitor, name string, result chan error) (*Instance, error) {
-	// NOTE: creating an instance WON'T start qemu. the monitor will start it
-	//       as soon as it notices a non-running instance in the registry.
+type shutdownEventData struct {
+	Guest  bool   `json:"guest"`
+	Reason string `json:"reason"`
+}
+
+type deviceDeletedEventData struct {
+	Device string `json:"device"`
+	Path   string `json:"path"`
+}
+
+func newInstance(monitor *Monitor, name string) (*Instance, error) {
+	// NOTE: creating an instance WON'T start qemu. the instance goroutine
+	//       must be started with run(), and a Start operation requested.
 
 	if monitor == nil {
 		return nil, fmt.Errorf("monitor: %s: invalid monitor", name)
 	}
 
-	config, err := qemu.ParseConfig(monitor.ConfigDir, name)
+	// a saved state can only be restored with the configuration it was
+	// saved with
+	var config *qemu.VirtualMachine
+	saved, err := monitor.readSaved(name)
 	if err != nil {
 		return nil, err
 	}
+	if saved != nil {
+		config = saved.Config
+	} else {
+		config, err = qemu.ParseConfig(monitor.ConfigDir, name)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	nics, err := newNICs(name, config)
 	if err != nil {
 		return nil, err
 	}
 
+	return newInstanceFromConfig(monitor, name, config, nics)
+}
+
+func newInstanceFromConfig(monitor *Monitor, name string, config *qemu.VirtualMachine, nics []*NIC) (*Instance, error) {
 	inst := Instance{
-		monitor:  monitor,
-		Config:   config,
-		Name:     name,
-		NICs:     nics,
-		pid:      -1,
-		retries:  0,
-		op:       Start,
-		opMutex:  &sync.RWMutex{},
-		opResult: result,
+		monitor: monitor,
+		Config:  config,
+		Name:    name,
+		NICs:    nics,
+		pid:     -1,
+		retries: 0,
+		mutex:   &sync.RWMutex{},
+		ops:     make(chan *opRequest),
+		done:    make(chan struct{}),
+		unplugs: make(map[string]chan struct{}),
 	}
 
 	inst.Config.SetName(inst.Name)
 	inst.Config.SetQMP(inst.QMPSocket())
 	inst.Config.SetPIDFile(inst.PIDFile())
+	inst.Config.SetConsole(inst.ConsoleSocket())
+
+	var err error
+	inst.qmp, err = qmp.NewSession(inst.QMPSocket())
+	if err != nil {
+		return nil, err
+	}
 
 	return &inst, nil
 }
@@ -88,6 +160,14 @@ func (i *Instance) QMPSocket() string {
 	return filepath.Join(i.monitor.RuntimeDir, fmt.Sprintf("%s.sock", i.Name))
 }
 
+func (i *Instance) ConsoleSocket() string {
+	if i.Name == "" {
+		return ""
+	}
+
+	return filepath.Join(i.monitor.RuntimeDir, fmt.Sprintf("%s.console", i.Name))
+}
+
 func (i *Instance) PID() (int, error) {
 	file := i.PIDFile()
 	if file == "" {
@@ -107,22 +187,25 @@ func (i *Instance) PID() (int, error) {
 	return pid, nil
 }
 
-func (i *Instance) QMP() (*qmp.QMP, error) {
-	socket := i.QMPSocket()
-	if socket == "" {
-		return nil, fmt.Errorf("monitor: can't guess QMP socket path")
+func qmpContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), qmp.DefaultTimeout)
+}
+
+func (i *Instance) QMP() (*qmp.Session, error) {
+	if i.qmp == nil {
+		return nil, fmt.Errorf("monitor: %s: QMP session not available", i.Name)
 	}
 
-	return &qmp.QMP{Socket: socket}, nil
+	return i.qmp, nil
 }
 
 func (i *Instance) ProcessRunning() bool {
-	// if pid is set
-	if i.pid > 0 {
-		// check if process still alive
-		if err := syscall.Kill(i.pid, syscall.Signal(0)); err == nil {
-			return true
-		}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	// if pid is set, check if process still alive
+	if processAlive(i.pid) {
+		return true
 	}
 
 	// fallback to re-reading PID file
@@ -132,16 +215,23 @@ func (i *Instance) ProcessRunning() bool {
 	}
 	i.pid = pid
 
-	return syscall.Kill(pid, syscall.Signal(0)) == nil
+	return processAlive(pid)
 }
 
 func (i *Instance) QMPStatus() (string, error) {
+	if ok := i.ProcessRunning(); !ok {
+		return "exited", nil
+	}
+
 	qmp, err := i.QMP()
 	if err != nil {
 		return "exited", err
 	}
 
-	status, err := qmp.QueryStatus()
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	status, err := qmp.QueryStatus(ctx)
 	if err != nil {
 		return "exited", err
 	}
@@ -155,7 +245,10 @@ func (i *Instance) QMPRunning() (bool, error) {
 		return false, err
 	}
 
-	status, err := qmp.QueryStatus()
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	status, err := qmp.QueryStatus(ctx)
 	if err != nil {
 		return false, err
 	}
@@ -169,12 +262,14 @@ func (i *Instance) Status() string {
 	return status
 }
 
+// Running returns true if the virtual machine process is alive and its QMP
+// socket responds. paused virtual machines are still considered running.
 func (i *Instance) Running() bool {
 	if ok := i.ProcessRunning(); !ok {
 		return false
 	}
 
-	if ok, err := i.QMPRunning(); err != nil || !ok {
+	if _, err := i.QMPRunning(); err != nil {
 		logutils.LogError(err)
 		return false
 	}
@@ -182,23 +277,307 @@ func (i *Instance) Running() bool {
 	return true
 }
 
-func (i *Instance) Start() error {
-	if running := i.ProcessRunning(); running {
+func (i *Instance) Paused() bool {
+	status, err := i.QMPStatus()
+	if err != nil {
+		logutils.LogError(err)
+		return false
+	}
+
+	return status == "paused"
+}
+
+func (i *Instance) request(op Operation, result chan error) error {
+	select {
+	case i.ops <- &opRequest{op: op, result: result}:
 		return nil
+	case <-i.done:
+		return fmt.Errorf("monitor: %q not running", i.Name)
+	}
+}
+
+// call runs fn in the instance goroutine, serialized with the other
+// operations, and waits for its result.
+func (i *Instance) call(fn func() error) error {
+	result := make(chan error)
+	select {
+	case i.ops <- &opRequest{op: Call, result: result, fn: fn}:
+		return <-result
+	case <-i.done:
+		return fmt.Errorf("monitor: %q not running", i.Name)
 	}
+}
 
-	i.opMutex.RLock()
+func (i *Instance) reply(req *opRequest, err error) {
+	if req.result != nil {
+		req.result <- err
+		return
+	}
+	logutils.LogError(err)
+}
 
-	if i.retries > i.Config.MaximumRetries {
-		i.opMutex.RUnlock()
-		if err := i.Shutdown(); err != nil {
-			return err
+func (i *Instance) watch() {
+	i.unwatchProcess()
+
+	i.mutex.RLock()
+	pid := i.pid
+	i.mutex.RUnlock()
+
+	i.exited, i.unwatch = watchProcess(pid)
+}
+
+func (i *Instance) unwatchProcess() {
+	if i.unwatch != nil {
+		i.unwatch()
+	}
+	i.exited = nil
+	i.unwatch = nil
+}
+
+func (i *Instance) handleEvent(ev *qmp.Event) {
+	switch ev.Event {
+	case "SHUTDOWN":
+		data := &shutdownEventData{}
+		if err := json.Unmarshal(ev.Data, data); err != nil {
+			logutils.LogError(err)
+		}
+		if data.Guest {
+			logutils.Warning.Printf("monitor: %s: guest initiated shutdown (%s)", i.Name, data.Reason)
+		} else {
+			logutils.Warning.Printf("monitor: %s: host initiated shutdown (%s)", i.Name, data.Reason)
+		}
+		i.lastShutdown = data
+
+	case "GUEST_PANICKED":
+		logutils.Error.Printf("monitor: %s: guest panicked", i.Name)
+		i.panicked = true
+
+	case "DEVICE_DELETED":
+		data := &deviceDeletedEventData{}
+		if err := json.Unmarshal(ev.Data, data); err != nil {
+			logutils.LogError(err)
+		}
+		logutils.Notice.Printf("monitor: %s: device deleted: %s", i.Name, data.Path)
+		if unplugged, ok := i.unplugs[data.Device]; ok {
+			close(unplugged)
+			delete(i.unplugs, data.Device)
+		}
+
+	default:
+		logutils.Notice.Printf("monitor: %s: qmp event: %s", i.Name, ev.Event)
+	}
+}
+
+// drainEvents handles the events sent by qemu before it exited, that may be
+// still pending when the exit is noticed, so that the exit reason is known.
+func (i *Instance) drainEvents(events <-chan *qmp.Event) <-chan *qmp.Event {
+	timer := time.NewTimer(exitEventsTimeout)
+	defer timer.Stop()
+
+	// the session disconnects after delivering everything read from the
+	// socket
+	disconnected := i.qmp.Disconnected()
+	for disconnected != nil {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			i.handleEvent(ev)
+		case <-disconnected:
+			disconnected = nil
+		case <-timer.C:
+			return events
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			i.handleEvent(ev)
+		default:
+			return events
 		}
-		return fmt.Errorf("monitor: %s: maximum number of retries exceeded (%d)",
-			i.Name, i.Config.MaximumRetries)
 	}
+}
+
+func (i *Instance) run() {
+	defer close(i.done)
+
+	events := i.qmp.Events()
+
+	// nothing is sampled until start sets the pid of the process
+	i.mutex.Lock()
+	i.stats.reset(0)
+	i.mutex.Unlock()
+
+	go i.runStats(statsInterval)
+
+	for {
+		select {
+		case req := <-i.ops:
+			switch req.op {
+			case Start:
+				i.reply(req, i.start())
+
+			case Shutdown:
+				err := i.shutdown()
+				if err != nil && i.ProcessRunning() {
+					i.reply(req, err)
+					continue
+				}
+				i.remove()
+				i.reply(req, err)
+				return
+
+			case Reset:
+				i.reply(req, i.reset())
+
+			case Pause:
+				i.reply(req, i.pause())
+
+			case Resume:
+				i.reply(req, i.resume())
+
+			case Call:
+				i.reply(req, req.fn())
+
+			case Save:
+				if err := i.save(); err != nil {
+					i.reply(req, err)
+					continue
+				}
+				i.remove()
+				i.reply(req, nil)
+				return
+
+			case Migrate:
+				// like Call, but the virtual machine is gone from this host
+				// on success
+				if err := req.fn(); err != nil {
+					i.reply(req, err)
+					continue
+				}
+				i.remove()
+				i.reply(req, nil)
+				return
+
+			case Detach:
+				// stop supervising the virtual machine, but leave it running
+				// to be adopted by another monitor.
+				logutils.Warning.Printf("monitor: %s: detach", i.Name)
+				i.unwatchProcess()
+				i.monitor.instancesMutex.Lock()
+				delete(i.monitor.instances, i.Name)
+				i.monitor.instancesMutex.Unlock()
+				i.reply(req, i.qmp.Close())
+				return
+			}
+
+		case <-i.exited:
+			i.unwatchProcess()
+			i.stable = nil
+
+			i.mutex.Lock()
+			i.stats.reset(0)
+			i.mutex.Unlock()
+			events = i.drainEvents(events)
+
+			reason := i.exitReason()
+			logutils.Warning.Printf("monitor: %s: process exited (%s)", i.Name, reason)
+
+			if !shouldRestart(i.Config.RestartPolicy, reason) {
+				logutils.Warning.Printf("monitor: %s: not restarting (restart policy: %s)", i.Name,
+					i.Config.RestartPolicy)
+				logutils.LogError(i.shutdown())
+				i.remove()
+				return
+			}
+
+			i.mutex.Lock()
+			i.retries++
+			i.mutex.Unlock()
+			i.scheduleRetry()
+
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			i.handleEvent(ev)
+
+		case <-i.stable:
+			i.stable = nil
+			if i.retries > 0 {
+				logutils.Notice.Printf("monitor: %s: running for %ds, resetting retries", i.Name,
+					i.Config.RestartBackoff.SuccessWindow)
+			}
+			i.mutex.Lock()
+			i.retries = 0
+			i.mutex.Unlock()
+
+		case <-i.retry:
+			i.retry = nil
+
+			if i.retries > i.Config.MaximumRetries {
+				logutils.Error.Printf("monitor: %s: maximum number of retries exceeded (%d)",
+					i.Name, i.Config.MaximumRetries)
+				logutils.LogError(i.shutdown())
+				i.remove()
+				return
+			}
+
+			logutils.LogError(i.start())
+		}
+	}
+}
 
-	defer i.opMutex.RUnlock()
+func (i *Instance) remove() {
+	i.monitor.instancesMutex.Lock()
+	if inst, ok := i.monitor.instances[i.Name]; ok && inst == i {
+		delete(i.monitor.instances, i.Name)
+	}
+	i.monitor.instancesMutex.Unlock()
+
+	if err := i.qmp.Close(); err != nil {
+		logutils.LogError(err)
+	}
+
+	logutils.LogError(i.removeState())
+}
+
+func (i *Instance) scheduleRetry() {
+	delay := i.retryDelay()
+	logutils.Notice.Printf("monitor: %s: restarting in %s", i.Name, delay)
+	i.retry = time.After(delay)
+}
+
+func (i *Instance) started() {
+	i.lastShutdown = nil
+	i.panicked = false
+	i.retry = nil
+	i.stable = nil
+	if window := i.Config.RestartBackoff.SuccessWindow; window > 0 {
+		i.stable = time.After(time.Duration(window) * time.Second)
+	}
+}
+
+func (i *Instance) start() error {
+	if running := i.ProcessRunning(); running {
+		if i.exited == nil {
+			i.watch()
+			i.started()
+
+			// adopted, the samples of the running process start now
+			i.mutex.Lock()
+			i.stats.reset(i.pid)
+			i.mutex.Unlock()
+		}
+		return nil
+	}
 
 	logutils.Warning.Printf("monitor: %s: start", i.Name)
 
@@ -206,25 +585,83 @@ func (i *Instance) Start() error {
 		logutils.Warning.Printf("monitor: %s: start: retry %d", i.Name, i.retries)
 	}
 
+	var saved *savedState
+	if i.incoming != "" {
+		i.Config.SetIncoming(i.incoming)
+		defer i.Config.SetIncoming("")
+	} else {
+		var err error
+		saved, err = i.monitor.readSaved(i.Name)
+		if err != nil {
+			return err
+		}
+		if saved != nil {
+			stateFile, _ := i.monitor.savedFiles(i.Name)
+			i.Config.SetIncoming("exec:cat " + shellQuote(stateFile))
+			defer i.Config.SetIncoming("")
+		}
+	}
+
 	if err := qemu.Run(i.Config); err != nil {
 		logutils.Warning.Printf("monitor: %s: start: failed", i.Name)
-		defer func() { i.retries++ }()
-		if i.retries == 0 {
+		i.mutex.Lock()
+		i.retries++
+		i.mutex.Unlock()
+		i.scheduleRetry()
+		if i.retries == 1 {
 			return fmt.Errorf("%s\nmonitor: %s: start: failed: will retry %d times ...",
 				err, i.Name, i.Config.MaximumRetries)
 		}
 		return err
-	} else {
-		logutils.Warning.Printf("monitor: %s: start: done", i.Name)
 	}
 
+	if !i.ProcessRunning() {
+		// qemu daemonized, but exited before we could read its pid file
+		logutils.Warning.Printf("monitor: %s: start: process exited", i.Name)
+		i.mutex.Lock()
+		i.retries++
+		i.mutex.Unlock()
+		i.scheduleRetry()
+		return nil
+	}
+	i.watch()
+	i.started()
+
+	if err := i.setupCgroup(); err != nil {
+		// the exit is handled as a crash
+		logutils.LogError(i.kill())
+		return err
+	}
+
+	if saved != nil {
+		if err := i.restore(saved); err != nil {
+			// the exit is handled as a crash
+			logutils.LogError(i.kill())
+			return err
+		}
+	}
+
+	if err := i.applyPinning(); err != nil {
+		// the exit is handled as a crash
+		logutils.LogError(i.kill())
+		return err
+	}
+
+	i.mutex.Lock()
+	i.startedAt = time.Now()
+	i.stats.reset(i.pid)
+	i.mutex.Unlock()
+
+	if err := i.writeState(); err != nil {
+		logutils.Error.Printf("monitor: %s: failed to write state file: %s", i.Name, err)
+	}
+
+	logutils.Warning.Printf("monitor: %s: start: done", i.Name)
+
 	return nil
 }
 
-func (i *Instance) Reset() error {
-	i.opMutex.RLock()
-	defer i.opMutex.RUnlock()
-
+func (i *Instance) reset() error {
 	if running := i.Running(); !running {
 		return nil
 	}
@@ -236,67 +673,143 @@ func (i *Instance) Reset() error {
 		return err
 	}
 
-	if err := qmp.Reset(); err != nil {
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	if err := qmp.Reset(ctx); err != nil {
 		return err
 	}
 
-	i.op = Start
-
 	logutils.Warning.Printf("monitor: %s: reset: done", i.Name)
 
 	return nil
 }
 
+func (i *Instance) pause() error {
+	if running := i.Running(); !running {
+		return fmt.Errorf("monitor: %s: not running", i.Name)
+	}
+
+	if paused := i.Paused(); paused {
+		return nil
+	}
+
+	logutils.Warning.Printf("monitor: %s: pause", i.Name)
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	if err := i.qmp.Stop(ctx); err != nil {
+		return err
+	}
+
+	logutils.Warning.Printf("monitor: %s: pause: done", i.Name)
+
+	return nil
+}
+
+func (i *Instance) resume() error {
+	if running := i.Running(); !running {
+		return fmt.Errorf("monitor: %s: not running", i.Name)
+	}
+
+	if paused := i.Paused(); !paused {
+		return nil
+	}
+
+	logutils.Warning.Printf("monitor: %s: resume", i.Name)
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	if err := i.qmp.Cont(ctx); err != nil {
+		return err
+	}
+
+	logutils.Warning.Printf("monitor: %s: resume: done", i.Name)
+
+	return nil
+}
+
 func (i *Instance) shutdown() error {
-	qmp, err := i.QMP()
-	if err == nil {
-		logutils.Notice.Printf("monitor: %s: sending powerdown command (%ds timeout)", i.Name,
-			i.Config.ShutdownTimeout)
-		if err := qmp.Powerdown(); err != nil {
-			logutils.LogError(err)
+	logutils.Warning.Printf("monitor: %s: shutdown", i.Name)
+
+	if ok := i.ProcessRunning(); ok {
+		if i.exited == nil {
+			i.watch()
 		}
 
-		for j := 0; j < i.Config.ShutdownTimeout; j++ {
-			if ok := i.ProcessRunning(); !ok {
-				break
+		if i.incoming != "" {
+			// the guest is not running here yet, there's nothing to power down
+			logutils.LogError(i.kill())
+		} else {
+			// the migration is waited apart from the instance goroutine,
+			// that fails after this
+			if i.migrating {
+				logutils.Notice.Printf("monitor: %s: cancelling migration", i.Name)
+
+				ctx, cancel := qmpContext()
+				logutils.LogError(i.qmp.MigrateCancel(ctx))
+				cancel()
 			}
-			time.Sleep(time.Second)
-		}
-	}
 
-	if ok := i.ProcessRunning(); ok {
-		logutils.Notice.Printf("monitor: %s: sending SIGKILL", i.Name)
+			// a paused guest can't handle the ACPI powerdown event
+			if i.Paused() {
+				logutils.LogError(i.resume())
+			}
+
+			logutils.Notice.Printf("monitor: %s: sending powerdown command (%ds timeout)", i.Name,
+				i.Config.ShutdownTimeout)
 
-		// if process is running, our cached PID is valid
-		if err := syscall.Kill(i.pid, syscall.SIGKILL); err != nil {
+			ctx, cancel := qmpContext()
+			if err := i.qmp.Powerdown(ctx); err != nil {
+				logutils.LogError(err)
+			}
+			cancel()
+		}
+
+		if err := i.waitExit(); err != nil {
 			return err
 		}
 	}
 
-	logutils.Notice.Printf("monitor: %s: waiting for process to exit", i.Name)
-	for i.ProcessRunning() {
-		time.Sleep(time.Second)
+	i.unwatchProcess()
+	i.removeCgroup()
+
+	if err := CleanupNICs(i.Name, i.NICs); err != nil {
+		return err
 	}
 
-	return CleanupNICs(i.Name, i.NICs)
-}
+	logutils.Warning.Printf("monitor: %s: shutdown: done", i.Name)
 
-func (i *Instance) Shutdown() error {
-	i.monitor.instancesMutex.Lock()
-	defer i.monitor.instancesMutex.Unlock()
+	return nil
+}
 
-	i.opMutex.RLock()
-	defer i.opMutex.RUnlock()
+func (i *Instance) kill() error {
+	logutils.Notice.Printf("monitor: %s: sending SIGKILL", i.Name)
 
-	logutils.Warning.Printf("monitor: %s: shutdown", i.Name)
+	i.mutex.RLock()
+	pid := i.pid
+	i.mutex.RUnlock()
 
-	if err := i.shutdown(); err != nil {
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
 		return err
 	}
+	return nil
+}
 
-	delete(i.monitor.instances, i.Name)
-
-	logutils.Warning.Printf("monitor: %s: shutdown: done", i.Name)
+// waitExit waits for the process to exit, killing it after the shutdown
+// timeout.
+func (i *Instance) waitExit() error {
+	select {
+	case <-i.exited:
+	case <-time.After(time.Duration(i.Config.ShutdownTimeout) * time.Second):
+		if err := i.kill(); err != nil {
+			return err
+		}
 
+		logutils.Notice.Printf("monitor: %s: waiting for process to exit", i.Name)
+		<-i.exited
+	}
 	return nil
 }
@@ -0,0 +1,65 @@
+package monitor
+
+import (
+	"fmt"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+)
+
+// memory returns the memory of the guest in bytes, as reported by the
+// balloon device, if any.
+func (i *Instance) memory() (int64, error) {
+	if !i.Config.Balloon {
+		return i.Config.RAMSize()
+	}
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	balloon, err := i.qmp.QueryBalloon(ctx)
+	if err != nil {
+		return -1, err
+	}
+	return balloon.Actual, nil
+}
+
+// SetMemory asks the guest of a running virtual machine to change its
+// memory to size, with the syntax of the ram option, using the balloon
+// device. size can't be larger than the ram of the virtual machine, and the
+// change is lost when it restarts.
+func (m *Monitor) SetMemory(name string, size string) error {
+	logutils.Notice.Printf("monitor: requesting memory change: %s: %s", name, size)
+
+	value, err := qemu.ParseRAM(size)
+	if err != nil {
+		return err
+	}
+	if value == 0 {
+		return fmt.Errorf("monitor: %s: invalid memory size: %s", name, size)
+	}
+
+	instance, err := m.runningInstance(name)
+	if err != nil {
+		return err
+	}
+
+	return instance.call(func() error {
+		if !instance.Config.Balloon {
+			return fmt.Errorf("monitor: %s: balloon not enabled", name)
+		}
+
+		ram, err := instance.Config.RAMSize()
+		if err != nil {
+			return err
+		}
+		if value > ram {
+			return fmt.Errorf("monitor: %s: memory size larger than ram: %s", name, size)
+		}
+
+		ctx, cancel := qmpContext()
+		defer cancel()
+
+		return instance.qmp.Balloon(ctx, value)
+	})
+}
@@ -0,0 +1,349 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+)
+
+var (
+	migrateTimeout = time.Hour
+)
+
+// MigrationStatus is the progress of the migration of a virtual machine.
+// sizes are in bytes.
+type MigrationStatus struct {
+	Status      string `json:"status" yaml:"status"`
+	Transferred int64  `json:"transferred" yaml:"transferred"`
+	Remaining   int64  `json:"remaining" yaml:"remaining"`
+	Total       int64  `json:"total" yaml:"total"`
+	Error       string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// incomingPort returns the tcp port qemu listens on for an incoming
+// migration.
+func (i *Instance) incomingPort() (int, error) {
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	info, err := i.qmp.QueryMigrate(ctx)
+	if err != nil {
+		return -1, err
+	}
+
+	for _, addr := range info.SocketAddress {
+		if addr.Type == "inet" {
+			return strconv.Atoi(addr.Port)
+		}
+	}
+	return -1, fmt.Errorf("monitor: %s: incoming migration address not found", i.Name)
+}
+
+// startMigration starts sending the virtual machine to another qemu process,
+// listening on uri.
+func (i *Instance) startMigration(uri string) error {
+	if ok := i.ProcessRunning(); !ok {
+		return fmt.Errorf("monitor: %q not running", i.Name)
+	}
+	if i.incoming != "" {
+		return fmt.Errorf("monitor: %s: waiting for an incoming migration", i.Name)
+	}
+	if i.migrating {
+		return fmt.Errorf("monitor: %s: migration in progress", i.Name)
+	}
+	if i.exited == nil {
+		i.watch()
+	}
+
+	logutils.Warning.Printf("monitor: %s: migrate: %s", i.Name, uri)
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	if err := i.qmp.Migrate(ctx, uri); err != nil {
+		return err
+	}
+
+	i.migrating = true
+	return nil
+}
+
+// finishMigration stops the virtual machine after the migration completes.
+func (i *Instance) finishMigration() error {
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	if err := i.qmp.Quit(ctx); err != nil {
+		logutils.LogError(err)
+	}
+	if err := i.waitExit(); err != nil {
+		return err
+	}
+
+	i.unwatchProcess()
+	i.removeCgroup()
+
+	if err := CleanupNICs(i.Name, i.NICs); err != nil {
+		return err
+	}
+
+	logutils.Warning.Printf("monitor: %s: migrate: done", i.Name)
+
+	return nil
+}
+
+// RunningConfig returns the configuration a running virtual machine was
+// started with, including the runtime changes, as JSON.
+func (m *Monitor) RunningConfig(name string) ([]byte, error) {
+	instance, err := m.runningInstance(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []byte
+	if err := instance.call(func() error {
+		var err error
+		rv, err = json.Marshal(instance.Config)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+// PrepareMigration starts a virtual machine that waits for its state to be
+// migrated from another host, with the configuration returned by
+// RunningConfig there. qemu listens on address, on a tcp port picked by
+// itself, that is returned.
+func (m *Monitor) PrepareMigration(name string, data []byte, address string) (int, error) {
+	logutils.Notice.Printf("monitor: requesting migration preparation: %s (%s)", name, address)
+
+	if address == "" {
+		return -1, fmt.Errorf("monitor: %s: migration address required", name)
+	}
+
+	config := &qemu.VirtualMachine{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return -1, fmt.Errorf("monitor: %s: invalid configuration: %s", name, err)
+	}
+	if err := qemu.CheckConfig(name, config); err != nil {
+		return -1, err
+	}
+
+	m.instancesMutex.Lock()
+
+	if _, ok := m.instances[name]; ok {
+		m.instancesMutex.Unlock()
+		return -1, fmt.Errorf("monitor: %s: already running", name)
+	}
+
+	// the saved state would be restored instead
+	saved, err := m.readSaved(name)
+	if err != nil {
+		m.instancesMutex.Unlock()
+		return -1, err
+	}
+	if saved != nil {
+		m.instancesMutex.Unlock()
+		return -1, fmt.Errorf("monitor: %s: virtual machine has a saved state", name)
+	}
+
+	nics, err := newNICs(name, config)
+	if err != nil {
+		m.instancesMutex.Unlock()
+		return -1, err
+	}
+
+	instance, err := newInstanceFromConfig(m, name, config, nics)
+	if err != nil {
+		logutils.LogError(CleanupNICs(name, nics))
+		m.instancesMutex.Unlock()
+		return -1, err
+	}
+	instance.incoming = "tcp:" + net.JoinHostPort(address, "0")
+
+	m.instances[name] = instance
+	m.instancesMutex.Unlock()
+
+	go instance.run()
+
+	result := make(chan error)
+	if err := instance.request(Start, result); err != nil {
+		return -1, err
+	}
+	err = <-result
+	port := -1
+	if err == nil {
+		port, err = instance.incomingPort()
+	}
+	if err != nil {
+		// don't retry, the source is not waiting anymore
+		if err2 := instance.request(Shutdown, result); err2 == nil {
+			logutils.LogError(<-result)
+		}
+		return -1, err
+	}
+
+	return port, nil
+}
+
+// FinishMigration resumes a virtual machine migrated from another host,
+// unless it was paused there, after the migration completes.
+func (m *Monitor) FinishMigration(name string, paused bool) error {
+	logutils.Notice.Printf("monitor: requesting migration finish: %s", name)
+
+	instance, err := m.runningInstance(name)
+	if err != nil {
+		return err
+	}
+
+	checkIncoming := func() error {
+		if instance.incoming == "" {
+			return fmt.Errorf("monitor: %s: not waiting for an incoming migration", name)
+		}
+		return nil
+	}
+
+	if err := instance.call(checkIncoming); err != nil {
+		return err
+	}
+
+	// the virtual machine must remain manageable while the migration runs,
+	// to be aborted if needed
+	if err := instance.waitMigration(migrateTimeout); err != nil {
+		return err
+	}
+
+	return instance.call(func() error {
+		if err := checkIncoming(); err != nil {
+			return err
+		}
+
+		// from now on, the virtual machine is restarted from scratch
+		instance.incoming = ""
+
+		if !paused {
+			ctx, cancel := qmpContext()
+			defer cancel()
+
+			if err := instance.qmp.Cont(ctx); err != nil {
+				return err
+			}
+		}
+
+		logutils.LogError(instance.writeState())
+
+		logutils.Warning.Printf("monitor: %s: incoming migration: done", name)
+
+		return nil
+	})
+}
+
+// AbortMigration stops a virtual machine that waits for an incoming
+// migration.
+func (m *Monitor) AbortMigration(name string, result chan error) error {
+	logutils.Notice.Printf("monitor: requesting migration abort: %s", name)
+
+	instance := m.Get(name)
+	if instance == nil {
+		return fmt.Errorf("monitor: %q not running", name)
+	}
+
+	incoming := false
+	if err := instance.call(func() error {
+		incoming = instance.incoming != ""
+		return nil
+	}); err != nil {
+		return err
+	}
+	if !incoming {
+		return fmt.Errorf("monitor: %s: not waiting for an incoming migration", name)
+	}
+
+	return instance.request(Shutdown, result)
+}
+
+// Migrate sends a running virtual machine to another host, where it must
+// have been prepared with PrepareMigration, and stops it here after the
+// migration completes. the virtual machine keeps running here if anything
+// fails, or if it is shut down meanwhile, cancelling the migration.
+func (m *Monitor) Migrate(name string, uri string, result chan error) error {
+	logutils.Notice.Printf("monitor: requesting migration: %s: %s", name, uri)
+
+	instance := m.Get(name)
+	if instance == nil {
+		return fmt.Errorf("monitor: %q not running", name)
+	}
+
+	if err := instance.call(func() error {
+		return instance.startMigration(uri)
+	}); err != nil {
+		return err
+	}
+
+	// migrations take a while, and the virtual machine must remain
+	// manageable meanwhile, so the migration is not waited in the instance
+	// goroutine. qemu resumes the virtual machine by itself if the migration
+	// fails
+	go func() {
+		err := instance.waitMigration(migrateTimeout)
+
+		req := &opRequest{
+			op:     Migrate,
+			result: result,
+			fn: func() error {
+				instance.migrating = false
+				if err != nil {
+					return err
+				}
+				return instance.finishMigration()
+			},
+		}
+
+		select {
+		case instance.ops <- req:
+		case <-instance.done:
+			if err == nil {
+				err = fmt.Errorf("monitor: %q not running", name)
+			}
+			instance.reply(req, err)
+		}
+	}()
+
+	return nil
+}
+
+// MigrationStatus returns the progress of the migration of a virtual
+// machine, in either direction.
+func (m *Monitor) MigrationStatus(name string) (*MigrationStatus, error) {
+	instance, err := m.runningInstance(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	info, err := instance.qmp.QueryMigrate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &MigrationStatus{
+		Status: info.Status,
+		Error:  info.ErrorDesc,
+	}
+	if info.RAM != nil {
+		rv.Transferred = info.RAM.Transferred
+		rv.Remaining = info.RAM.Remaining
+		rv.Total = info.RAM.Total
+	}
+
+	return rv, nil
+}
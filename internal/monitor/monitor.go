@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"sort"
 	"sync"
-	"time"
 
 	"github.com/rafaelmartins/simplevirt/internal/logutils"
 	"github.com/rafaelmartins/simplevirt/internal/qemu"
@@ -13,78 +12,52 @@ import (
 type Monitor struct {
 	ConfigDir  string
 	RuntimeDir string
+	StateDir   string
+
+	// cgroup v2 directory where the cgroups of the virtual machines are
+	// created. disabled if empty
+	CgroupParent string
+
+	// save the running virtual machines on cleanup, instead of shutting
+	// them down
+	SaveOnCleanup bool
 
 	instances      map[string]*Instance
 	instancesMutex *sync.RWMutex
-	exit           bool
-	exitChan       chan bool
+	snapshotsMutex *sync.Mutex
+	backupsMutex   *sync.Mutex
+	backupsRunning map[string]bool
 }
 
-func NewMonitor(configDir string, runtimeDir string) (*Monitor, error) {
+func NewMonitor(configDir string, runtimeDir string, stateDir string, cgroupParent string, saveOnCleanup bool) (*Monitor, error) {
 	mon := Monitor{
 		ConfigDir:      configDir,
 		RuntimeDir:     runtimeDir,
+		StateDir:       stateDir,
+		CgroupParent:   cgroupParent,
+		SaveOnCleanup:  saveOnCleanup,
 		instances:      make(map[string]*Instance),
 		instancesMutex: &sync.RWMutex{},
-		exit:           false,
-		exitChan:       make(chan bool),
-	}
-
-	go func() {
-		for {
-			for name, _ := range mon.instances {
-				instance := mon.Get(name)
-				if instance == nil {
-					continue
-				}
-
-				var err error
-
-				switch instance.op {
-				case Start:
-					err = instance.Start()
-
-				case Shutdown:
-					err = instance.Shutdown()
-
-				case Reset:
-					err = instance.Reset()
-				}
-
-				if instance.opResult != nil {
-					select {
-					case instance.opResult <- err:
-					default:
-						if err != nil {
-							logutils.LogError(err)
-						}
-					}
-					instance.opResult = nil
-
-					continue
-				}
-
-				if err != nil {
-					logutils.LogError(err)
-				}
-			}
-
-			if mon.exit {
-				mon.exitChan <- true
-				break
-			}
+		snapshotsMutex: &sync.Mutex{},
+		backupsMutex:   &sync.Mutex{},
+		backupsRunning: make(map[string]bool),
+	}
 
-			time.Sleep(time.Second)
-		}
-	}()
+	if err := mon.adoptAll(); err != nil {
+		logutils.LogError(err)
+	}
 
 	vms, err := qemu.ListConfigs(configDir)
 	if err != nil {
-		mon.Cleanup()
+		mon.Detach()
 		return nil, err
 	}
 
 	for _, vmName := range vms {
+		if mon.Get(vmName) != nil {
+			continue
+		}
+
 		vm, err := qemu.ParseConfig(configDir, vmName)
 		if err != nil {
 			logutils.LogError(err)
@@ -101,15 +74,44 @@ func NewMonitor(configDir string, runtimeDir string) (*Monitor, error) {
 
 func (m *Monitor) Cleanup() {
 	logutils.Notice.Printf("monitor: cleanup")
+	if m.SaveOnCleanup {
+		m.requestAll(Save)
+	}
 
-	m.exit = true
-	_ = <-m.exitChan
+	// virtual machines that failed to save are still there
+	m.requestAll(Shutdown)
+}
+
+// Detach stops supervising all the virtual machines, leaving them running, so
+// that they can be adopted by the next monitor started.
+func (m *Monitor) Detach() {
+	logutils.Notice.Printf("monitor: detach")
+	m.requestAll(Detach)
+}
 
+func (m *Monitor) requestAll(op Operation) {
+	m.instancesMutex.RLock()
+	instances := []*Instance{}
 	for _, instance := range m.instances {
-		// force cleanup
-		instance.op = Start
-		instance.Shutdown()
+		instances = append(instances, instance)
 	}
+	m.instancesMutex.RUnlock()
+
+	wg := &sync.WaitGroup{}
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(instance *Instance) {
+			defer wg.Done()
+
+			result := make(chan error)
+			if err := instance.request(op, result); err != nil {
+				logutils.LogError(err)
+				return
+			}
+			logutils.LogError(<-result)
+		}(instance)
+	}
+	wg.Wait()
 }
 
 func (m *Monitor) Get(name string) *Instance {
@@ -126,6 +128,9 @@ func (m *Monitor) Get(name string) *Instance {
 func (m *Monitor) Status(name string) string {
 	instance := m.Get(name)
 	if instance == nil {
+		if saved, err := m.readSaved(name); err == nil && saved != nil {
+			return "saved"
+		}
 		return "stopped"
 	}
 
@@ -149,6 +154,7 @@ func (m *Monitor) List() ([]string, error) {
 
 	rv := append([]string{}, conf...)
 
+	m.instancesMutex.RLock()
 	for name, _ := range m.instances {
 		found := false
 		for _, confName := range conf {
@@ -161,6 +167,7 @@ func (m *Monitor) List() ([]string, error) {
 			rv = append(rv, name)
 		}
 	}
+	m.instancesMutex.RUnlock()
 
 	sort.Strings(rv)
 
@@ -170,25 +177,30 @@ func (m *Monitor) List() ([]string, error) {
 func (m *Monitor) Start(name string, result chan error) error {
 	logutils.Notice.Printf("monitor: requesting start: %s", name)
 
-	instance := m.Get(name)
-	if instance != nil {
-		if running := instance.Running(); running {
+	m.instancesMutex.Lock()
+
+	instance, ok := m.instances[name]
+	if ok {
+		m.instancesMutex.Unlock()
+
+		if running := instance.ProcessRunning(); running {
 			return fmt.Errorf("monitor: %s: already running", name)
 		}
 	} else {
-		m.instancesMutex.Lock()
-		defer m.instancesMutex.Unlock()
-
 		var err error
-		instance, err = newInstance(m, name, result)
+		instance, err = newInstance(m, name)
 		if err != nil {
+			m.instancesMutex.Unlock()
 			return err
 		}
 
 		m.instances[name] = instance
+		m.instancesMutex.Unlock()
+
+		go instance.run()
 	}
 
-	return nil
+	return instance.request(Start, result)
 }
 
 func (m *Monitor) Shutdown(name string, result chan error) error {
@@ -199,12 +211,7 @@ func (m *Monitor) Shutdown(name string, result chan error) error {
 		return fmt.Errorf("monitor: %q not running", name)
 	}
 
-	instance.opMutex.Lock()
-	defer instance.opMutex.Unlock()
-	instance.op = Shutdown
-	instance.opResult = result
-
-	return nil
+	return instance.request(Shutdown, result)
 }
 
 func (m *Monitor) Reset(name string, result chan error) error {
@@ -215,10 +222,40 @@ func (m *Monitor) Reset(name string, result chan error) error {
 		return fmt.Errorf("monitor: %q not running", name)
 	}
 
-	instance.opMutex.Lock()
-	defer instance.opMutex.Unlock()
-	instance.op = Reset
-	instance.opResult = result
+	return instance.request(Reset, result)
+}
 
-	return nil
+func (m *Monitor) Pause(name string, result chan error) error {
+	logutils.Notice.Printf("monitor: requesting pause: %s", name)
+
+	instance := m.Get(name)
+	if instance == nil {
+		return fmt.Errorf("monitor: %q not running", name)
+	}
+
+	return instance.request(Pause, result)
+}
+
+func (m *Monitor) Resume(name string, result chan error) error {
+	logutils.Notice.Printf("monitor: requesting resume: %s", name)
+
+	instance := m.Get(name)
+	if instance == nil {
+		return fmt.Errorf("monitor: %q not running", name)
+	}
+
+	return instance.request(Resume, result)
+}
+
+func (m *Monitor) ConsoleSocket(name string) (string, error) {
+	instance := m.Get(name)
+	if instance == nil || !instance.ProcessRunning() {
+		return "", fmt.Errorf("monitor: %q not running", name)
+	}
+
+	if !instance.Config.SerialConsole {
+		return "", fmt.Errorf("monitor: %s: serial console not enabled", name)
+	}
+
+	return instance.ConsoleSocket(), nil
 }
@@ -0,0 +1,1937 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+	"github.com/rafaelmartins/simplevirt/internal/qmp"
+	. "github.com/rafaelmartins/simplevirt/internal/testutils"
+)
+
+const (
+	fakeQEMUEnv = "SIMPLEVIRT_FAKE_QEMU"
+)
+
+// the test binary doubles as a fake qemu binary, that daemonizes and serves
+// a minimal QMP protocol, so that the monitor can be tested without qemu.
+func TestMain(m *testing.M) {
+	if filepath.Base(os.Args[0]) == "qemu-img" {
+		os.Exit(fakeQEMUImg())
+	}
+
+	switch os.Getenv(fakeQEMUEnv) {
+	case "parent":
+		os.Exit(fakeQEMUParent())
+	case "child":
+		os.Exit(fakeQEMUChild())
+	}
+	os.Exit(m.Run())
+}
+
+// fakeQEMUImg creates the images requested by "qemu-img create", with just
+// enough of a qcow2 header to be detected.
+func fakeQEMUImg() int {
+	if len(os.Args) < 3 || os.Args[1] != "create" {
+		return 1
+	}
+	if err := ioutil.WriteFile(os.Args[len(os.Args)-1], []byte("QFI\xfb"), 0644); err != nil {
+		return 1
+	}
+	return 0
+}
+
+func fakeQEMUArg(name string) string {
+	for i, arg := range os.Args {
+		if arg == name && i+1 < len(os.Args) {
+			return os.Args[i+1]
+		}
+	}
+	return ""
+}
+
+func fakeQEMUParams(arg string) map[string]string {
+	rv := map[string]string{}
+	for _, param := range strings.Split(strings.Replace(arg, ",,", "\x00", -1), ",") {
+		kv := strings.SplitN(strings.Replace(param, "\x00", ",", -1), "=", 2)
+		if len(kv) == 2 {
+			rv[kv[0]] = kv[1]
+		} else {
+			rv[kv[0]] = ""
+		}
+	}
+	return rv
+}
+
+// fakeQEMUDevices returns the query-block entries for the drives in the
+// command line, the block nodes with their drivers, the ids of the devices
+// and the limits of the throttle groups.
+func fakeQEMUDevices() ([]map[string]interface{}, map[string]string, map[string]string, map[string]bool, map[string]map[string]interface{}) {
+	blocks := []map[string]interface{}{}
+	nodes := map[string]string{}
+	drivers := map[string]string{}
+	devices := map[string]bool{}
+	groups := map[string]map[string]interface{}{}
+	legacy := map[string]int{}
+
+	for i, arg := range os.Args {
+		if i+1 >= len(os.Args) {
+			break
+		}
+		params := fakeQEMUParams(os.Args[i+1])
+
+		switch arg {
+		case "-drive":
+			// qemu names the drives without id after their interface, but
+			// not always like this (e.g. ide0-hd0)
+			id := params["id"]
+			if id == "" {
+				id = fmt.Sprintf("%s%d", params["if"], legacy[params["if"]])
+				legacy[params["if"]]++
+			}
+			block := map[string]interface{}{"device": id}
+			if params["file"] != "" {
+				block["inserted"] = map[string]interface{}{"file": params["file"], "node-name": "#" + id}
+			}
+			blocks = append(blocks, block)
+
+		case "-blockdev":
+			if params["filename"] != "" {
+				nodes[params["node-name"]] = params["filename"]
+			} else {
+				nodes[params["node-name"]] = nodes[params["file"]]
+			}
+			drivers[params["node-name"]] = params["driver"]
+
+		case "-object":
+			if strings.HasPrefix(os.Args[i+1], "throttle-group,") {
+				groups[params["id"]] = fakeQEMULimits(params)
+			}
+
+		case "-device":
+			devices[params["id"]] = true
+			cdrom := strings.HasPrefix(os.Args[i+1], "scsi-cd,") || strings.HasPrefix(os.Args[i+1], "ide-cd,")
+			if params["drive"] != "" || cdrom {
+				blocks = append(blocks, fakeQEMUBlock(params["id"], params["drive"], nodes[params["drive"]]))
+			}
+		}
+	}
+
+	return blocks, nodes, drivers, devices, groups
+}
+
+// fakeQEMULimits returns the limits property of a throttle group, from its
+// x-* properties.
+func fakeQEMULimits(props map[string]string) map[string]interface{} {
+	rv := map[string]interface{}{}
+	for k, v := range props {
+		if strings.HasPrefix(k, "x-") {
+			rv[strings.TrimPrefix(k, "x-")], _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+	return rv
+}
+
+// fakeQEMUThread starts an os thread, to be reported as a vcpu thread.
+func fakeQEMUThread() int {
+	tid := make(chan int)
+	go func() {
+		runtime.LockOSThread()
+		tid <- syscall.Gettid()
+		select {}
+	}()
+	return <-tid
+}
+
+// fakeQEMUCPUs returns the query-hotpluggable-cpus entries for the -smp
+// argument, one socket per vcpu, or per group of threads if set, like the
+// cores of some machines, in reverse order, as qemu does.
+func fakeQEMUCPUs() []map[string]interface{} {
+	params := fakeQEMUParams(fakeQEMUArg("-smp"))
+	cpus, err := strconv.Atoi(params["cpus"])
+	if err != nil {
+		cpus = 1
+	}
+	max, err := strconv.Atoi(params["maxcpus"])
+	if err != nil {
+		max = cpus
+	}
+	threads, err := strconv.Atoi(params["threads"])
+	if err != nil {
+		threads = 1
+	}
+
+	rv := []map[string]interface{}{}
+	for i := max/threads - 1; i >= 0; i-- {
+		cpu := map[string]interface{}{
+			"type":        "qemu64-x86_64-cpu",
+			"vcpus-count": threads,
+			"props":       map[string]interface{}{"socket-id": i, "core-id": 0, "thread-id": 0},
+		}
+		if i*threads < cpus {
+			cpu["qom-path"] = fmt.Sprintf("/machine/unattached/device[%d]", i)
+			cpu["thread-id"] = fakeQEMUThread()
+		}
+		rv = append(rv, cpu)
+	}
+	return rv
+}
+
+func fakeQEMUBlock(id string, node string, file string) map[string]interface{} {
+	rv := map[string]interface{}{"device": "", "qdev": id}
+	if file != "" {
+		rv["inserted"] = map[string]interface{}{"file": file, "node-name": node}
+	}
+	return rv
+}
+
+func fakeQEMUParent() int {
+	pidfile := fakeQEMUArg("-pidfile")
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), fakeQEMUEnv+"=child")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 1
+	}
+
+	for j := 0; j < 500; j++ {
+		if data, err := ioutil.ReadFile(pidfile); err == nil {
+			if strings.TrimSpace(string(data)) == fmt.Sprintf("%d", cmd.Process.Pid) {
+				return 0
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return 1
+}
+
+func fakeQEMUChild() int {
+	socket := strings.TrimSuffix(strings.TrimPrefix(fakeQEMUArg("-qmp"), "unix:"), ",server,nowait")
+
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return 1
+	}
+	defer l.Close()
+
+	status := "running"
+	migration := map[string]interface{}{}
+	migrationMutex := &sync.Mutex{}
+	received := func(data []byte, err error) {
+		migrationMutex.Lock()
+		defer migrationMutex.Unlock()
+		migration["status"] = "completed"
+		if err != nil || string(data) != "QEVM" {
+			migration["status"] = "failed"
+			migration["error-desc"] = "invalid state"
+		}
+	}
+	if incoming := fakeQEMUArg("-incoming"); strings.HasPrefix(incoming, "tcp:") {
+		status = "paused"
+		ml, err := net.Listen("tcp", strings.TrimPrefix(incoming, "tcp:"))
+		if err != nil {
+			return 1
+		}
+		host, port, _ := net.SplitHostPort(ml.Addr().String())
+		migration["socket-address"] = []map[string]interface{}{{"type": "inet", "host": host, "port": port}}
+		go func() {
+			conn, err := ml.Accept()
+			if err != nil {
+				return
+			}
+			received(ioutil.ReadAll(conn))
+			conn.Close()
+		}()
+	} else if incoming != "" {
+		status = "paused"
+		received(ioutil.ReadFile(strings.Trim(strings.TrimPrefix(incoming, "exec:cat "), "'")))
+	}
+
+	// like qemu, daemonize after listening for the incoming migration
+	if err := ioutil.WriteFile(fakeQEMUArg("-pidfile"), []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		return 1
+	}
+
+	blocks, nodes, drivers, devices, groups := fakeQEMUDevices()
+	vcpus := fakeQEMUCPUs()
+	balloon, _ := qemu.ParseRAM(strings.TrimPrefix(fakeQEMUArg("-m"), "size="))
+	if balloon <= 0 {
+		balloon = 128 << 20
+	}
+	jobs := []map[string]interface{}{}
+	jobBlocks := map[string]map[string]interface{}{}
+	bitmaps := map[string]bool{}
+	nodeCount := 0
+	migrationDone := time.Time{}
+
+	findNode := func(node interface{}) map[string]interface{} {
+		for _, block := range blocks {
+			if inserted, ok := block["inserted"].(map[string]interface{}); ok && inserted["node-name"] == node {
+				return inserted
+			}
+		}
+		return nil
+	}
+	findJob := func(id interface{}) int {
+		for j, job := range jobs {
+			if job["id"] == id {
+				return j
+			}
+		}
+		return -1
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return 1
+		}
+
+		enc := json.NewEncoder(conn)
+		enc.Encode(map[string]interface{}{"QMP": map[string]interface{}{}})
+
+		event := func(name string, data interface{}) {
+			enc.Encode(map[string]interface{}{
+				"event":     name,
+				"data":      data,
+				"timestamp": map[string]int64{"seconds": time.Now().Unix(), "microseconds": 0},
+			})
+		}
+
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+
+			cmd := map[string]interface{}{}
+			if err := json.Unmarshal(line, &cmd); err != nil {
+				break
+			}
+
+			var rv interface{} = map[string]interface{}{}
+			var qerr interface{}
+			exit := false
+
+			args, _ := cmd["arguments"].(map[string]interface{})
+			findBlock := func() map[string]interface{} {
+				for _, block := range blocks {
+					if (args["device"] != nil && block["device"] == args["device"]) ||
+						(args["id"] != nil && block["qdev"] == args["id"]) {
+						return block
+					}
+				}
+				qerr = map[string]interface{}{"class": "DeviceNotFound", "desc": "Device not found"}
+				return nil
+			}
+
+			switch cmd["execute"] {
+			case "query-status":
+				rv = map[string]interface{}{"status": status, "running": status == "running"}
+			case "system_powerdown":
+				event("SHUTDOWN", map[string]interface{}{"guest": true, "reason": "guest-shutdown"})
+				exit = true
+			case "system_reset":
+				event("RESET", map[string]interface{}{"guest": false, "reason": "host-qmp-system-reset"})
+			case "stop":
+				status = "paused"
+				event("STOP", nil)
+			case "cont":
+				status = "running"
+				event("RESUME", nil)
+			case "query-block":
+				rv = blocks
+			case "query-blockstats":
+				list := []map[string]interface{}{}
+				for _, block := range blocks {
+					list = append(list, map[string]interface{}{
+						"device": block["device"],
+						"qdev":   block["qdev"],
+						"stats":  map[string]interface{}{"rd_bytes": 4096, "wr_bytes": 512, "rd_operations": 8, "wr_operations": 1},
+					})
+				}
+				rv = list
+			case "block_set_io_throttle":
+				if block := findBlock(); block != nil {
+					inserted := block["inserted"].(map[string]interface{})
+					for _, k := range []string{"iops", "iops_rd", "iops_wr", "bps", "bps_rd", "bps_wr"} {
+						inserted[k] = args[k]
+					}
+				}
+			case "blockdev-change-medium":
+				if block := findBlock(); block != nil {
+					block["inserted"] = map[string]interface{}{"file": args["filename"], "node-name": "#media"}
+				}
+			case "eject":
+				if block := findBlock(); block != nil {
+					delete(block, "inserted")
+				}
+			case "blockdev-add":
+				name := args["node-name"].(string)
+				if filename, ok := args["filename"].(string); ok {
+					nodes[name] = filename
+				} else {
+					nodes[name] = nodes[args["file"].(string)]
+				}
+				drivers[name] = args["driver"].(string)
+			case "query-named-block-nodes":
+				list := []map[string]interface{}{}
+				for name, file := range nodes {
+					list = append(list, map[string]interface{}{"node-name": name, "file": file, "drv": drivers[name]})
+				}
+				rv = list
+			case "object-add":
+				if args["qom-type"] == "throttle-group" {
+					props := map[string]string{}
+					for k, v := range args {
+						props[k] = fmt.Sprintf("%v", v)
+					}
+					groups[args["id"].(string)] = fakeQEMULimits(props)
+				}
+			case "object-del":
+				delete(groups, args["id"].(string))
+			case "qom-get", "qom-set":
+				id := strings.TrimPrefix(args["path"].(string), "/objects/")
+				if _, ok := groups[id]; !ok || args["property"] != "limits" {
+					qerr = map[string]interface{}{"class": "GenericError", "desc": "Device '" + id + "' not found"}
+					break
+				}
+				if cmd["execute"] == "qom-set" {
+					groups[id] = args["value"].(map[string]interface{})
+				} else {
+					rv = groups[id]
+				}
+			case "blockdev-del":
+				name := args["node-name"].(string)
+				if _, ok := nodes[name]; !ok {
+					qerr = map[string]interface{}{"class": "GenericError", "desc": "Failed to find node with node-name='" + name + "'"}
+				}
+				delete(nodes, name)
+			case "query-hotpluggable-cpus":
+				rv = vcpus
+			case "query-cpus-fast":
+				list := []map[string]interface{}{}
+				for _, cpu := range vcpus {
+					if cpu["qom-path"] != nil {
+						for j := 0; j < cpu["vcpus-count"].(int); j++ {
+							list = append(list, map[string]interface{}{"cpu-index": cpu["props"].(map[string]interface{})["socket-id"].(int)*cpu["vcpus-count"].(int) + j, "qom-path": cpu["qom-path"], "thread-id": cpu["thread-id"], "props": cpu["props"]})
+						}
+					}
+				}
+				rv = list
+			case "device_add":
+				id := args["id"].(string)
+				if strings.HasSuffix(args["driver"].(string), "-cpu") {
+					for _, cpu := range vcpus {
+						props := cpu["props"].(map[string]interface{})
+						if float64(props["socket-id"].(int)) == args["socket-id"] {
+							if cpu["qom-path"] != nil {
+								qerr = map[string]interface{}{"class": "GenericError", "desc": "CPU is already plugged"}
+							}
+							cpu["qom-path"] = "/machine/peripheral/" + id
+							cpu["thread-id"] = fakeQEMUThread()
+						}
+					}
+				}
+				devices[id] = true
+				if drive, ok := args["drive"].(string); ok {
+					blocks = append(blocks, fakeQEMUBlock(id, drive, nodes[drive]))
+				}
+			case "device_del":
+				id := args["id"].(string)
+				delete(devices, id)
+				for j, block := range blocks {
+					if block["qdev"] == id {
+						blocks = append(blocks[:j], blocks[j+1:]...)
+						break
+					}
+				}
+				// guests may ignore the unplug request
+				if !strings.HasPrefix(id, "stuck") {
+					event("DEVICE_DELETED", map[string]interface{}{"device": id, "path": "/machine/peripheral/" + id})
+				}
+			case "transaction":
+				actions, _ := args["actions"].([]interface{})
+				for _, a := range actions {
+					action := a.(map[string]interface{})
+					data := action["data"].(map[string]interface{})
+					switch action["type"] {
+					case "blockdev-snapshot-sync":
+						inserted := findNode(data["node-name"])
+						if inserted == nil {
+							qerr = map[string]interface{}{"class": "GenericError", "desc": "Cannot find device"}
+							break
+						}
+						ioutil.WriteFile(data["snapshot-file"].(string), []byte("QFI\xfb"), 0644)
+						nodeCount++
+						inserted["file"] = data["snapshot-file"]
+						inserted["node-name"] = fmt.Sprintf("#snap%d", nodeCount)
+					case "block-dirty-bitmap-add":
+						bitmaps[data["node"].(string)+"/"+data["name"].(string)] = true
+					case "drive-backup":
+						if data["sync"] == "incremental" {
+							if !bitmaps[data["device"].(string)+"/"+data["bitmap"].(string)] {
+								qerr = map[string]interface{}{"class": "GenericError", "desc": "Bitmap not found"}
+								break
+							}
+							if _, err := os.Stat(data["target"].(string)); err != nil {
+								qerr = map[string]interface{}{"class": "GenericError", "desc": "Could not open target"}
+								break
+							}
+						} else {
+							ioutil.WriteFile(data["target"].(string), []byte("QFI\xfb"), 0644)
+						}
+						jobs = append(jobs, map[string]interface{}{"id": data["job-id"], "type": "backup", "status": "concluded"})
+					}
+				}
+			case "block-dirty-bitmap-remove":
+				key := args["node"].(string) + "/" + args["name"].(string)
+				if !bitmaps[key] {
+					qerr = map[string]interface{}{"class": "GenericError", "desc": "Dirty bitmap not found"}
+				}
+				delete(bitmaps, key)
+			case "block-commit":
+				inserted := findNode(args["device"])
+				if inserted == nil {
+					qerr = map[string]interface{}{"class": "GenericError", "desc": "Cannot find device"}
+					break
+				}
+				job := map[string]interface{}{"id": args["job-id"], "type": "commit", "status": "concluded"}
+				if args["top"] == nil {
+					job["status"] = "ready"
+					jobBlocks[args["job-id"].(string)] = inserted
+					inserted["base"] = args["base"]
+				}
+				jobs = append(jobs, job)
+			case "migrate":
+				uri := args["uri"].(string)
+				var err error
+				if strings.HasPrefix(uri, "tcp:") {
+					var conn net.Conn
+					if conn, err = net.Dial("tcp", strings.TrimPrefix(uri, "tcp:")); err == nil {
+						_, err = conn.Write([]byte("QEVM"))
+						conn.Close()
+					}
+				} else {
+					file := strings.Trim(strings.TrimPrefix(uri, "exec:cat > "), "'")
+					err = ioutil.WriteFile(file, []byte("QEVM"), 0600)
+				}
+				if err != nil {
+					qerr = map[string]interface{}{"class": "GenericError", "desc": err.Error()}
+					break
+				}
+				// completed by the first query after a while, unless
+				// cancelled
+				migrationMutex.Lock()
+				migration["status"] = "active"
+				migration["ram"] = map[string]interface{}{"transferred": 0, "remaining": 1024, "total": 1024}
+				migrationMutex.Unlock()
+				migrationDone = time.Now().Add(100 * time.Millisecond)
+			case "migrate_cancel":
+				migrationMutex.Lock()
+				if migration["status"] == "active" {
+					migration["status"] = "cancelled"
+				}
+				migrationMutex.Unlock()
+			case "query-migrate":
+				migrationMutex.Lock()
+				if migration["status"] == "active" && time.Now().After(migrationDone) {
+					migration["status"] = "completed"
+					migration["ram"] = map[string]interface{}{"transferred": 1024, "remaining": 0, "total": 1024}
+					status = "postmigrate"
+				}
+				info := map[string]interface{}{}
+				for k, v := range migration {
+					info[k] = v
+				}
+				migrationMutex.Unlock()
+				rv = info
+			case "quit":
+				event("SHUTDOWN", map[string]interface{}{"guest": false, "reason": "host-qmp-quit"})
+				exit = true
+			case "balloon", "query-balloon":
+				if !devices["balloon0"] {
+					qerr = map[string]interface{}{"class": "DeviceNotActive", "desc": "No balloon device has been activated"}
+					break
+				}
+				if cmd["execute"] == "balloon" {
+					balloon = int64(args["value"].(float64))
+				} else {
+					rv = map[string]interface{}{"actual": balloon}
+				}
+			case "query-jobs":
+				rv = jobs
+			case "job-complete":
+				if j := findJob(args["id"]); j >= 0 {
+					jobs[j]["status"] = "concluded"
+					inserted := jobBlocks[args["id"].(string)]
+					inserted["file"] = inserted["base"]
+				}
+			case "job-dismiss":
+				if j := findJob(args["id"]); j >= 0 {
+					jobs = append(jobs[:j], jobs[j+1:]...)
+				}
+			}
+
+			if qerr != nil {
+				enc.Encode(map[string]interface{}{"error": qerr, "id": cmd["id"]})
+			} else {
+				enc.Encode(map[string]interface{}{"return": rv, "id": cmd["id"]})
+			}
+
+			if exit {
+				conn.Close()
+				return 0
+			}
+		}
+		conn.Close()
+	}
+}
+
+type testEnv struct {
+	configDir  string
+	runtimeDir string
+	stateDir   string
+
+	cgroupParent  string
+	saveOnCleanup bool
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "monitor")
+	AssertNonError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	env := &testEnv{
+		configDir:  filepath.Join(dir, "config"),
+		runtimeDir: filepath.Join(dir, "run"),
+		stateDir:   filepath.Join(dir, "state"),
+	}
+
+	bin := filepath.Join(dir, "bin")
+	for _, d := range []string{env.configDir, env.runtimeDir, bin} {
+		AssertNonError(t, os.Mkdir(d, 0755))
+	}
+
+	exe, err := os.Executable()
+	AssertNonError(t, err)
+	AssertNonError(t, os.Symlink(exe, filepath.Join(bin, "qemu-system-fake")))
+	AssertNonError(t, os.Symlink(exe, filepath.Join(bin, "qemu-img")))
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	os.Setenv(fakeQEMUEnv, "parent")
+	t.Cleanup(func() {
+		os.Setenv("PATH", path)
+		os.Unsetenv(fakeQEMUEnv)
+	})
+
+	return env
+}
+
+func (e *testEnv) addVM(t *testing.T, name string, extra string) {
+	t.Helper()
+
+	config := fmt.Sprintf(`system_target: fake
+shutdown_timeout: 5
+drives:
+  - file: /dev/null
+nics:
+  - mac_address: 52:54:00:fc:70:3b
+%s`, extra)
+
+	AssertNonError(t, ioutil.WriteFile(filepath.Join(e.configDir, name+".yml"), []byte(config), 0644))
+}
+
+func (e *testEnv) newMonitor(t *testing.T) *Monitor {
+	t.Helper()
+
+	mon, err := NewMonitor(e.configDir, e.runtimeDir, e.stateDir, e.cgroupParent, e.saveOnCleanup)
+	AssertNonError(t, err)
+	t.Cleanup(mon.Cleanup)
+
+	return mon
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	t.Helper()
+
+	for j := 0; j < 500; j++ {
+		if f() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func call(t *testing.T, f func(chan error) error) error {
+	t.Helper()
+
+	result := make(chan error)
+	if err := f(result); err != nil {
+		return err
+	}
+	return <-result
+}
+
+func TestMonitorStartShutdown(t *testing.T) {
+	env := newTestEnv(t)
+	env.addVM(t, "foo", "")
+	mon := env.newMonitor(t)
+
+	AssertEqual(t, mon.Status("foo"), "stopped")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+	AssertEqual(t, mon.Status("foo"), "running")
+	AssertEqual(t, mon.Running("foo"), true)
+
+	err := mon.Start("foo", nil)
+	AssertError(t, err, "monitor: foo: already running")
+
+	pid := mon.Get("foo").pid
+
+	info, err := mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, info.Name, "foo")
+	AssertEqual(t, info.Status, "running")
+	AssertEqual(t, info.PID, pid)
+	AssertEqual(t, info.Retries, 0)
+	AssertEqual(t, info.ConfigFile, filepath.Join(env.configDir, "foo.yml"))
+	AssertEqual(t, info.VNC, "")
+	AssertEqual(t, info.NICs, []*NICInfo{})
+	AssertEqual(t, info.StartedAt.IsZero(), false)
+	AssertEqual(t, info.CommandLine[1:5], []string{"-name", "foo", "-qmp",
+		"unix:" + filepath.Join(env.runtimeDir, "foo.sock") + ",server,nowait"})
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Reset("foo", r) }))
+	AssertEqual(t, mon.Status("foo"), "running")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Pause("foo", r) }))
+	AssertEqual(t, mon.Status("foo"), "paused")
+	AssertEqual(t, mon.Running("foo"), true)
+
+	err = mon.Start("foo", nil)
+	AssertError(t, err, "monitor: foo: already running")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Pause("foo", r) }))
+	AssertEqual(t, mon.Status("foo"), "paused")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Resume("foo", r) }))
+	AssertEqual(t, mon.Status("foo"), "running")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Resume("foo", r) }))
+	AssertEqual(t, mon.Status("foo"), "running")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Pause("foo", r) }))
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Shutdown("foo", r) }))
+	AssertEqual(t, mon.Get("foo") == nil, true)
+	AssertEqual(t, mon.Status("foo"), "stopped")
+	AssertEqual(t, processAlive(pid), false)
+
+	info, err = mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, info, &Info{
+		Name:       "foo",
+		Status:     "stopped",
+		PID:        -1,
+		NICs:       []*NICInfo{},
+		ConfigFile: filepath.Join(env.configDir, "foo.yml"),
+	})
+
+	_, err = mon.Info("bar")
+	AssertError(t, err, "monitor: virtual machine not found: bar")
+
+	err = mon.Shutdown("foo", nil)
+	AssertError(t, err, "monitor: \"foo\" not running")
+
+	err = mon.Pause("foo", nil)
+	AssertError(t, err, "monitor: \"foo\" not running")
+}
+
+func TestMonitorRestartOnExit(t *testing.T) {
+	env := newTestEnv(t)
+	env.addVM(t, "foo", "auto_start: true\n")
+	mon := env.newMonitor(t)
+
+	waitFor(t, "start", func() bool { return mon.Status("foo") == "running" })
+
+	instance := mon.Get("foo")
+	instance.mutex.RLock()
+	pid := instance.pid
+	instance.mutex.RUnlock()
+
+	AssertNonError(t, syscall.Kill(pid, syscall.SIGKILL))
+
+	waitFor(t, "restart", func() bool {
+		instance.mutex.RLock()
+		defer instance.mutex.RUnlock()
+		return instance.pid != pid && processAlive(instance.pid)
+	})
+	AssertEqual(t, mon.Get("foo"), instance)
+}
+
+func TestMonitorAdopt(t *testing.T) {
+	env := newTestEnv(t)
+	env.addVM(t, "foo", "auto_start: true\n")
+	env.addVM(t, "bar", "")
+
+	mon := env.newMonitor(t)
+	waitFor(t, "start", func() bool { return mon.Status("foo") == "running" })
+
+	instance := mon.Get("foo")
+	instance.mutex.RLock()
+	pid := instance.pid
+	instance.mutex.RUnlock()
+
+	mon.Detach()
+	AssertEqual(t, mon.Get("foo") == nil, true)
+	AssertEqual(t, processAlive(pid), true)
+
+	_, err := os.Stat(filepath.Join(env.runtimeDir, "foo.json"))
+	AssertNonError(t, err)
+
+	// stale state file, whose process is gone
+	AssertNonError(t, ioutil.WriteFile(filepath.Join(env.runtimeDir, "bar.json"),
+		[]byte(`{"name": "bar", "pid": 999999999, "config": {}, "nics": []}`), 0600))
+
+	mon2 := env.newMonitor(t)
+	instance2 := mon2.Get("foo")
+	AssertEqual(t, instance2 != nil, true)
+	AssertEqual(t, instance2.pid, pid)
+	AssertEqual(t, mon2.Status("foo"), "running")
+	AssertEqual(t, mon2.Get("bar") == nil, true)
+
+	_, err = os.Stat(filepath.Join(env.runtimeDir, "bar.json"))
+	AssertEqual(t, os.IsNotExist(err), true)
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon2.Shutdown("foo", r) }))
+	AssertEqual(t, processAlive(pid), false)
+
+	_, err = os.Stat(filepath.Join(env.runtimeDir, "foo.json"))
+	AssertEqual(t, os.IsNotExist(err), true)
+}
+
+func TestMonitorRestartPolicy(t *testing.T) {
+	env := newTestEnv(t)
+	env.addVM(t, "foo", `auto_start: true
+restart_policy: on-failure
+restart_backoff:
+  initial_delay: 0
+`)
+	mon := env.newMonitor(t)
+
+	waitFor(t, "start", func() bool { return mon.Status("foo") == "running" })
+	instance := mon.Get("foo")
+
+	instance.mutex.RLock()
+	pid := instance.pid
+	instance.mutex.RUnlock()
+
+	// crash is restarted
+	AssertNonError(t, syscall.Kill(pid, syscall.SIGKILL))
+	waitFor(t, "restart", func() bool {
+		instance.mutex.RLock()
+		defer instance.mutex.RUnlock()
+		return instance.pid != pid && processAlive(instance.pid)
+	})
+	waitFor(t, "qmp", func() bool { return mon.Status("foo") == "running" })
+
+	instance.mutex.RLock()
+	AssertEqual(t, instance.retries, 1)
+	instance.mutex.RUnlock()
+
+	// clean guest poweroff is not
+	ctx, cancel := qmpContext()
+	defer cancel()
+	AssertNonError(t, instance.qmp.Powerdown(ctx))
+
+	waitFor(t, "removal", func() bool { return mon.Get("foo") == nil })
+	AssertEqual(t, mon.Status("foo"), "stopped")
+}
+
+func TestMonitorDefineUndefine(t *testing.T) {
+	env := newTestEnv(t)
+	mon := env.newMonitor(t)
+
+	config := `system_target: fake
+shutdown_timeout: 5
+drives:
+  - file: /dev/null
+nics:
+  - mac_address: 52:54:00:fc:70:3b
+`
+
+	err := mon.Define("../foo", []byte(config))
+	AssertError(t, err, "qemu: invalid virtual machine name: \"../foo\"")
+
+	err = mon.Define("foo", []byte("drives: [\n"))
+	AssertNotEqual(t, err, nil)
+
+	err = mon.Define("foo", []byte("drives:\n  - file: foo.img\n"))
+	AssertError(t, err, "qemu: line 2: drive[1].file: path must be absolute\n"+
+		"qemu: nic: at least one NIC must be defined")
+
+	_, err = os.Stat(filepath.Join(env.configDir, "foo.yml"))
+	AssertEqual(t, os.IsNotExist(err), true)
+
+	AssertNonError(t, mon.Define("foo", []byte(config)))
+	data, err := ioutil.ReadFile(filepath.Join(env.configDir, "foo.yml"))
+	AssertNonError(t, err)
+	AssertEqual(t, string(data), config)
+
+	list, err := mon.List()
+	AssertNonError(t, err)
+	AssertEqual(t, list, []string{"foo"})
+
+	AssertNonError(t, mon.Validate("foo"))
+	err = mon.Validate("bar")
+	AssertError(t, err, "qemu: config: failed to find configuration file for virtual machine: bar")
+
+	cmdline, err := mon.CommandLine("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, cmdline, []string{
+		"qemu-system-fake",
+		"-name", "foo",
+		"-qmp", "unix:" + filepath.Join(env.runtimeDir, "foo.sock") + ",server,nowait",
+		"-daemonize",
+		"-pidfile", filepath.Join(env.runtimeDir, "foo.pid"),
+		"-enable-kvm",
+		"-runas", "nobody",
+		"-display", "none",
+		"-drive", "file=/dev/null,if=virtio,media=disk,cache=none",
+		"-nic", "user,mac=52:54:00:fc:70:3b,model=virtio",
+	})
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+
+	err = mon.Undefine("foo")
+	AssertError(t, err, "monitor: foo: virtual machine is running")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Shutdown("foo", r) }))
+	AssertNonError(t, mon.Undefine("foo"))
+
+	list, err = mon.List()
+	AssertNonError(t, err)
+	AssertEqual(t, list, []string{})
+
+	err = mon.Undefine("foo")
+	AssertError(t, err, "monitor: virtual machine not found: foo")
+}
+
+func TestMonitorDriveThrottle(t *testing.T) {
+	env := newTestEnv(t)
+	AssertNonError(t, ioutil.WriteFile(filepath.Join(env.configDir, "foo.yml"), []byte(`system_target: fake
+shutdown_timeout: 5
+drives:
+  - file: /dev/null
+  - file: /dev/zero
+    id: zero
+  - file: /dev/full
+    device: virtio-blk-pci
+    format: raw
+    throttle:
+      iops: 100
+      bps_rd: 1000
+nics:
+  - mac_address: 52:54:00:fc:70:3b
+`), 0644))
+	mon := env.newMonitor(t)
+
+	throttles := func() map[string]*qmp.BlockDeviceInfo {
+		ctx, cancel := qmpContext()
+		defer cancel()
+
+		blocks, err := mon.Get("foo").qmp.QueryBlock(ctx)
+		AssertNonError(t, err)
+
+		rv := map[string]*qmp.BlockDeviceInfo{}
+		for _, block := range blocks {
+			rv[block.Device+block.QDev] = block.Inserted
+		}
+		return rv
+	}
+	group := func() *qmp.ThrottleLimits {
+		ctx, cancel := qmpContext()
+		defer cancel()
+
+		rv := &qmp.ThrottleLimits{}
+		args := map[string]string{"path": "/objects/drive3-throttle-group", "property": "limits"}
+		AssertNonError(t, mon.Get("foo").qmp.Execute(ctx, "qom-get", args, rv))
+		return rv
+	}
+
+	err := mon.SetDriveThrottle("foo", "drive1", &qemu.DriveThrottle{IOPS: 10})
+	AssertError(t, err, "monitor: \"foo\" not running")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+
+	// blockdev drives are limited by their throttle group from the start,
+	// legacy drives without id are named by qemu
+	blocks := throttles()
+	AssertEqual(t, blocks["virtio0"].IOPS, int64(0))
+	AssertEqual(t, blocks["drive3"].NodeName, "drive3-throttle")
+	AssertEqual(t, blocks["drive3"].IOPS, int64(0))
+	limits := group()
+	AssertEqual(t, limits.IOPSTotal, int64(100))
+	AssertEqual(t, limits.BPSRead, int64(1000))
+
+	// the image is below the throttle filter
+	node, err := mon.Get("foo").queryBlockNode(3, mon.Get("foo").Config.Drives[2])
+	AssertNonError(t, err)
+	AssertEqual(t, node, "drive3-format")
+
+	AssertNonError(t, mon.SetDriveThrottle("foo", "drive1", &qemu.DriveThrottle{IOPS: 10}))
+	AssertNonError(t, mon.SetDriveThrottle("foo", "zero", &qemu.DriveThrottle{BPS: 20}))
+	AssertNonError(t, mon.SetDriveThrottle("foo", "drive3", &qemu.DriveThrottle{}))
+
+	blocks = throttles()
+	AssertEqual(t, blocks["virtio0"].IOPS, int64(10))
+	AssertEqual(t, blocks["zero"].BPS, int64(20))
+	AssertEqual(t, *group(), qmp.ThrottleLimits{
+		IOPSTotalMaxLength: 1,
+		IOPSReadMaxLength:  1,
+		IOPSWriteMaxLength: 1,
+		BPSTotalMaxLength:  1,
+		BPSReadMaxLength:   1,
+		BPSWriteMaxLength:  1,
+	})
+
+	err = mon.SetDriveThrottle("foo", "bola", &qemu.DriveThrottle{IOPS: 10})
+	AssertError(t, err, "monitor: foo: drive not found: bola")
+
+	err = mon.SetDriveThrottle("foo", "drive1", &qemu.DriveThrottle{IOPS: 10, IOPSRead: 10})
+	AssertError(t, err, "qemu: throttle.iops: can't be used with iops_rd or iops_wr")
+}
+
+func TestMonitorMediaDisk(t *testing.T) {
+	env := newTestEnv(t)
+	config := filepath.Join(env.configDir, "foo.yml")
+	AssertNonError(t, ioutil.WriteFile(config, []byte(`system_target: fake
+shutdown_timeout: 5
+drives:
+  - file: /dev/null
+  - id: cd
+    media: cdrom
+    device: scsi-hd
+    format: raw
+  - file: /dev/full
+    device: virtio-blk-pci
+    format: raw
+nics:
+  - mac_address: 52:54:00:fc:70:3b
+`), 0644))
+	mon := env.newMonitor(t)
+
+	files := func() map[string]string {
+		ctx, cancel := qmpContext()
+		defer cancel()
+
+		blocks, err := mon.Get("foo").qmp.QueryBlock(ctx)
+		AssertNonError(t, err)
+
+		rv := map[string]string{}
+		for _, block := range blocks {
+			rv[block.Device+block.QDev] = ""
+			if block.Inserted != nil {
+				rv[block.Device+block.QDev] = block.Inserted.File
+			}
+		}
+		return rv
+	}
+
+	saved := func() []*qemu.Drive {
+		data, err := ioutil.ReadFile(config)
+		AssertNonError(t, err)
+		cfg, err := qemu.LoadConfig(data)
+		AssertNonError(t, err)
+		return cfg.Drives
+	}
+
+	err := mon.ChangeMedia("foo", "cd", "/dev/zero", false)
+	AssertError(t, err, "monitor: \"foo\" not running")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+	AssertEqual(t, files()["cd"], "")
+
+	// media
+	AssertNonError(t, mon.ChangeMedia("foo", "cd", "/dev/zero", true))
+	AssertEqual(t, files()["cd"], "/dev/zero")
+	AssertEqual(t, mon.Get("foo").Config.Drives[1].File, "/dev/zero")
+	AssertEqual(t, saved()[1].File, "/dev/zero")
+	AssertEqual(t, saved()[1].ID, "cd")
+
+	AssertNonError(t, mon.EjectMedia("foo", "cd", false, false))
+	AssertEqual(t, files()["cd"], "")
+	AssertEqual(t, mon.Get("foo").Config.Drives[1].File, "")
+	AssertEqual(t, saved()[1].File, "/dev/zero")
+
+	err = mon.ChangeMedia("foo", "drive1", "/dev/zero", false)
+	AssertError(t, err, "monitor: foo: drive1: not a cdrom drive")
+
+	err = mon.ChangeMedia("foo", "bola", "/dev/zero", false)
+	AssertError(t, err, "monitor: foo: drive not found: bola")
+
+	// attach
+	AssertNonError(t, mon.AttachDisk("foo", &qemu.Drive{
+		File:     "/dev/zero",
+		Device:   "virtio-blk-pci",
+		Format:   "raw",
+		IOThread: true,
+	}, true))
+	AssertEqual(t, files()["drive4"], "/dev/zero")
+	AssertEqual(t, len(saved()), 4)
+	AssertEqual(t, saved()[3].ID, "drive4")
+	AssertEqual(t, saved()[3].IOThread, true)
+
+	AssertNonError(t, mon.AttachDisk("foo", &qemu.Drive{
+		File:     "/dev/null",
+		ID:       "scratch",
+		Device:   "scsi-hd",
+		Format:   "raw",
+		Throttle: qemu.DriveThrottle{IOPS: 50},
+	}, false))
+	AssertEqual(t, files()["scratch"], "/dev/null")
+	AssertEqual(t, len(saved()), 4)
+
+	limits := func() (*qmp.ThrottleLimits, error) {
+		ctx, cancel := qmpContext()
+		defer cancel()
+
+		rv := &qmp.ThrottleLimits{}
+		args := map[string]string{"path": "/objects/scratch-throttle-group", "property": "limits"}
+		return rv, mon.Get("foo").qmp.Execute(ctx, "qom-get", args, rv)
+	}
+	l, err := limits()
+	AssertNonError(t, err)
+	AssertEqual(t, l.IOPSTotal, int64(50))
+
+	err = mon.AttachDisk("foo", &qemu.Drive{File: "/dev/null", ID: "cd", Device: "nvme", Format: "raw"}, false)
+	AssertError(t, err, "qemu: drive[6].id: duplicated value (cd)")
+
+	err = mon.AttachDisk("foo", &qemu.Drive{File: "/dev/null"}, false)
+	AssertError(t, err, "qemu: drive[6].device: parameter is required for hotplug")
+
+	// detach
+	AssertNonError(t, mon.DetachDisk("foo", "cd", true))
+	_, found := files()["cd"]
+	AssertEqual(t, found, false)
+	AssertEqual(t, len(saved()), 3)
+	AssertEqual(t, saved()[0].ID, "")
+	AssertEqual(t, saved()[1].ID, "drive3")
+	AssertEqual(t, saved()[2].ID, "drive4")
+
+	// the drives after the removed one keep their names
+	drives := mon.Get("foo").Config.Drives
+	AssertEqual(t, len(drives), 4)
+	AssertEqual(t, drives[1].DeviceID(2), "drive3")
+	AssertEqual(t, drives[2].DeviceID(3), "drive4")
+	AssertEqual(t, drives[3].DeviceID(4), "scratch")
+
+	err = mon.DetachDisk("foo", "drive1", false)
+	AssertError(t, err, "monitor: foo: drive1: only drives with device can be detached")
+
+	err = mon.DetachDisk("foo", "scratch", true)
+	AssertError(t, err, "monitor: foo: virtual machine changed, but configuration not saved: monitor: foo: drive not found in configuration file: scratch")
+	AssertEqual(t, len(mon.Get("foo").Config.Drives), 3)
+	_, err = limits()
+	AssertNotEqual(t, err, nil)
+
+	// the instance goroutine is not blocked while the guest doesn't release
+	// the device
+	timeout := unplugTimeout
+	unplugTimeout = 500 * time.Millisecond
+	defer func() { unplugTimeout = timeout }()
+
+	AssertNonError(t, mon.AttachDisk("foo", &qemu.Drive{
+		File:   "/dev/null",
+		ID:     "stuck",
+		Device: "virtio-blk-pci",
+		Format: "raw",
+	}, false))
+
+	instance := mon.Get("foo")
+	detached := make(chan error)
+	go func() { detached <- mon.DetachDisk("foo", "stuck", false) }()
+	waitFor(t, "detach", func() bool {
+		found := false
+		AssertNonError(t, instance.call(func() error {
+			_, found = instance.unplugs["stuck"]
+			return nil
+		}))
+		return found
+	})
+
+	err = mon.DetachDisk("foo", "stuck", false)
+	AssertError(t, err, "monitor: foo: stuck: detach in progress")
+	AssertError(t, <-detached, "monitor: foo: stuck: device removal not completed by the guest")
+
+	AssertNonError(t, instance.call(func() error {
+		AssertEqual(t, len(instance.Config.Drives), 4)
+		AssertEqual(t, len(instance.unplugs), 0)
+		return nil
+	}))
+}
+
+func TestMonitorSnapshots(t *testing.T) {
+	env := newTestEnv(t)
+
+	images := filepath.Join(filepath.Dir(env.configDir), "images")
+	AssertNonError(t, os.Mkdir(images, 0755))
+	disk := filepath.Join(images, "disk.img")
+	data := filepath.Join(images, "data.img")
+	AssertNonError(t, ioutil.WriteFile(disk, make([]byte, 1024), 0644))
+	AssertNonError(t, ioutil.WriteFile(data, make([]byte, 1024), 0644))
+
+	config := filepath.Join(env.configDir, "foo.yml")
+	AssertNonError(t, ioutil.WriteFile(config, []byte(fmt.Sprintf(`system_target: fake
+shutdown_timeout: 5
+drives:
+  - file: %s
+  - file: %s
+    device: virtio-blk-pci
+    format: raw
+  - media: cdrom
+nics:
+  - mac_address: 52:54:00:fc:70:3b
+`, disk, data)), 0644))
+	mon := env.newMonitor(t)
+
+	overlay := func(drive string, snapshot string) string {
+		return filepath.Join(images, fmt.Sprintf("foo-%s.%s.qcow2", drive, snapshot))
+	}
+
+	saved := func() []*qemu.Drive {
+		d, err := ioutil.ReadFile(config)
+		AssertNonError(t, err)
+		cfg, err := qemu.LoadConfig(d)
+		AssertNonError(t, err)
+		return cfg.Drives
+	}
+
+	exists := func(file string) bool {
+		_, err := os.Stat(file)
+		return err == nil
+	}
+
+	err := mon.CreateSnapshot("foo", "a/b")
+	AssertError(t, err, "monitor: invalid snapshot name: \"a/b\"")
+
+	// offline
+	AssertNonError(t, mon.CreateSnapshot("foo", "s1"))
+	AssertEqual(t, exists(overlay("drive1", "s1")), true)
+	AssertEqual(t, exists(overlay("drive2", "s1")), true)
+	AssertEqual(t, saved()[0].File, overlay("drive1", "s1"))
+	AssertEqual(t, saved()[0].Format, "qcow2")
+	AssertEqual(t, saved()[1].File, overlay("drive2", "s1"))
+	AssertEqual(t, saved()[2].File, "")
+
+	snapshots, err := mon.Snapshots("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, len(snapshots), 1)
+	AssertEqual(t, snapshots[0].Name, "s1")
+	AssertEqual(t, snapshots[0].Drives, []*SnapshotDrive{
+		{Drive: "drive1", Image: disk, Format: "raw", Overlay: overlay("drive1", "s1")},
+		{Drive: "drive2", Image: data, Format: "raw", Overlay: overlay("drive2", "s1")},
+	})
+
+	err = mon.CreateSnapshot("foo", "s1")
+	AssertError(t, err, "monitor: foo: snapshot already exists: s1")
+
+	err = mon.DeleteSnapshot("foo", "s1")
+	AssertError(t, err, "monitor: \"foo\" not running")
+
+	// online
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+
+	AssertNonError(t, mon.CreateSnapshot("foo", "s2"))
+	AssertEqual(t, exists(overlay("drive1", "s2")), true)
+	AssertEqual(t, saved()[0].File, overlay("drive1", "s2"))
+	AssertEqual(t, mon.Get("foo").Config.Drives[1].File, overlay("drive2", "s2"))
+
+	snapshots, err = mon.Snapshots("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, len(snapshots), 2)
+	AssertEqual(t, snapshots[1].Drives[0].Image, overlay("drive1", "s1"))
+	AssertEqual(t, snapshots[1].Drives[0].Format, "qcow2")
+
+	err = mon.RevertSnapshot("foo", "s1")
+	AssertError(t, err, "monitor: foo: virtual machine is running")
+
+	// the overlay of s1 is committed into the original images, and s2 is
+	// now backed by them
+	AssertNonError(t, mon.DeleteSnapshot("foo", "s1"))
+	AssertEqual(t, exists(overlay("drive1", "s1")), false)
+	snapshots, err = mon.Snapshots("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, len(snapshots), 1)
+	AssertEqual(t, snapshots[0].Drives[0].Image, disk)
+	AssertEqual(t, snapshots[0].Drives[0].Format, "raw")
+
+	// the active overlay is committed, and the original images are active
+	// again
+	AssertNonError(t, mon.DeleteSnapshot("foo", "s2"))
+	AssertEqual(t, exists(overlay("drive1", "s2")), false)
+	AssertEqual(t, saved()[0].File, disk)
+	AssertEqual(t, saved()[0].Format, "raw")
+	AssertEqual(t, mon.Get("foo").Config.Drives[1].File, data)
+	snapshots, err = mon.Snapshots("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, len(snapshots), 0)
+	AssertEqual(t, exists(mon.snapshotsFile("foo")), false)
+
+	err = mon.DeleteSnapshot("foo", "s2")
+	AssertError(t, err, "monitor: foo: snapshot not found: s2")
+
+	// revert
+	AssertNonError(t, mon.CreateSnapshot("foo", "s3"))
+	AssertNonError(t, mon.CreateSnapshot("foo", "s4"))
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Shutdown("foo", r) }))
+
+	AssertNonError(t, mon.RevertSnapshot("foo", "s3"))
+	AssertEqual(t, exists(overlay("drive1", "s3")), true)
+	AssertEqual(t, exists(overlay("drive1", "s4")), false)
+	AssertEqual(t, saved()[0].File, overlay("drive1", "s3"))
+	AssertEqual(t, saved()[1].File, overlay("drive2", "s3"))
+	snapshots, err = mon.Snapshots("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, len(snapshots), 1)
+	AssertEqual(t, snapshots[0].Name, "s3")
+
+	AssertNonError(t, mon.Undefine("foo"))
+	AssertEqual(t, exists(mon.snapshotsFile("foo")), false)
+}
+
+func TestMonitorSaveRestore(t *testing.T) {
+	env := newTestEnv(t)
+	env.saveOnCleanup = true
+	env.addVM(t, "foo", "")
+	mon := env.newMonitor(t)
+
+	stateFile := filepath.Join(env.stateDir, "foo.state")
+	metaFile := filepath.Join(env.stateDir, "foo.json")
+
+	err := mon.Save("foo", nil)
+	AssertError(t, err, "monitor: \"foo\" not running")
+
+	err = mon.Restore("foo", nil)
+	AssertError(t, err, "monitor: foo: no saved state")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+	pid := mon.Get("foo").pid
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Save("foo", r) }))
+	AssertEqual(t, mon.Status("foo"), "saved")
+	AssertEqual(t, processAlive(pid), false)
+	_, err = os.Stat(stateFile)
+	AssertNonError(t, err)
+	_, err = os.Stat(metaFile)
+	AssertNonError(t, err)
+
+	// the saved configuration is used, even if the file changed
+	env.addVM(t, "foo", "vnc_display: 127.0.0.1:1\n")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Restore("foo", r) }))
+	AssertEqual(t, mon.Status("foo"), "running")
+	AssertEqual(t, mon.Get("foo").Config.VNCDisplay, "")
+	_, err = os.Stat(metaFile)
+	AssertEqual(t, os.IsNotExist(err), true)
+
+	// paused virtual machines are restored paused
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Pause("foo", r) }))
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Save("foo", r) }))
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+	AssertEqual(t, mon.Status("foo"), "paused")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Save("foo", r) }))
+	err = mon.DiscardSaved("bar")
+	AssertError(t, err, "monitor: bar: no saved state")
+	AssertNonError(t, mon.DiscardSaved("foo"))
+	AssertEqual(t, mon.Status("foo"), "stopped")
+	_, err = os.Stat(stateFile)
+	AssertEqual(t, os.IsNotExist(err), true)
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+	AssertEqual(t, mon.Get("foo").Config.VNCDisplay, "127.0.0.1:1")
+
+	err = mon.DiscardSaved("foo")
+	AssertError(t, err, "monitor: foo: virtual machine is running")
+
+	mon.Cleanup()
+	AssertEqual(t, mon.Status("foo"), "saved")
+}
+
+func TestMonitorMigration(t *testing.T) {
+	source := newTestEnv(t)
+	source.addVM(t, "foo", "")
+	target := newTestEnv(t)
+	src := source.newMonitor(t)
+	dst := target.newMonitor(t)
+
+	_, err := src.RunningConfig("foo")
+	AssertError(t, err, "monitor: \"foo\" not running")
+
+	AssertNonError(t, call(t, func(r chan error) error { return src.Start("foo", r) }))
+	pid := src.Get("foo").pid
+
+	config, err := src.RunningConfig("foo")
+	AssertNonError(t, err)
+
+	_, err = dst.PrepareMigration("foo", config, "")
+	AssertError(t, err, "monitor: foo: migration address required")
+
+	port, err := dst.PrepareMigration("foo", config, "127.0.0.1")
+	AssertNonError(t, err)
+	AssertEqual(t, dst.Status("foo"), "paused")
+	AssertEqual(t, dst.Get("foo").incoming, "tcp:127.0.0.1:0")
+
+	_, err = dst.PrepareMigration("foo", config, "127.0.0.1")
+	AssertError(t, err, "monitor: foo: already running")
+
+	err = src.AbortMigration("foo", nil)
+	AssertError(t, err, "monitor: foo: not waiting for an incoming migration")
+
+	AssertNonError(t, call(t, func(r chan error) error { return dst.AbortMigration("foo", r) }))
+	AssertEqual(t, dst.Status("foo"), "stopped")
+
+	// nobody listens on the port anymore, and the virtual machine keeps
+	// running on the source
+	err = call(t, func(r chan error) error {
+		return src.Migrate("foo", fmt.Sprintf("tcp:127.0.0.1:%d", port), r)
+	})
+	AssertNotEqual(t, err, nil)
+	AssertEqual(t, src.Status("foo"), "running")
+
+	// a shutdown cancels the migration
+	port, err = dst.PrepareMigration("foo", config, "127.0.0.1")
+	AssertNonError(t, err)
+	result := make(chan error, 1)
+	AssertNonError(t, src.Migrate("foo", fmt.Sprintf("tcp:127.0.0.1:%d", port), result))
+	err = src.Migrate("foo", fmt.Sprintf("tcp:127.0.0.1:%d", port), nil)
+	AssertError(t, err, "monitor: foo: migration in progress")
+	AssertNonError(t, call(t, func(r chan error) error { return src.Shutdown("foo", r) }))
+	AssertNotEqual(t, <-result, nil)
+	AssertNonError(t, call(t, func(r chan error) error { return dst.AbortMigration("foo", r) }))
+
+	AssertNonError(t, call(t, func(r chan error) error { return src.Start("foo", r) }))
+	pid = src.Get("foo").pid
+
+	port, err = dst.PrepareMigration("foo", config, "127.0.0.1")
+	AssertNonError(t, err)
+
+	AssertNonError(t, call(t, func(r chan error) error {
+		return src.Migrate("foo", fmt.Sprintf("tcp:127.0.0.1:%d", port), r)
+	}))
+	AssertEqual(t, src.Status("foo"), "stopped")
+	AssertEqual(t, processAlive(pid), false)
+
+	status, err := dst.MigrationStatus("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, status.Status, "completed")
+
+	AssertNonError(t, dst.FinishMigration("foo", false))
+	AssertEqual(t, dst.Status("foo"), "running")
+	AssertEqual(t, dst.Get("foo").incoming, "")
+
+	err = dst.FinishMigration("foo", false)
+	AssertError(t, err, "monitor: foo: not waiting for an incoming migration")
+}
+
+func TestMonitorMemory(t *testing.T) {
+	env := newTestEnv(t)
+	env.addVM(t, "foo", "ram: 1G\nballoon: true\n")
+	env.addVM(t, "bar", "ram: 1G\n")
+	mon := env.newMonitor(t)
+
+	err := mon.SetMemory("foo", "512M")
+	AssertError(t, err, "monitor: \"foo\" not running")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("bar", r) }))
+
+	info, err := mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, info.Memory, int64(1<<30))
+
+	AssertNonError(t, mon.SetMemory("foo", "512M"))
+	info, err = mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, info.Memory, int64(512<<20))
+
+	AssertNonError(t, mon.SetMemory("foo", "1G"))
+	info, err = mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, info.Memory, int64(1<<30))
+
+	err = mon.SetMemory("foo", "2G")
+	AssertError(t, err, "monitor: foo: memory size larger than ram: 2G")
+
+	err = mon.SetMemory("foo", "0")
+	AssertError(t, err, "monitor: foo: invalid memory size: 0")
+
+	err = mon.SetMemory("foo", "1T")
+	AssertError(t, err, "qemu: invalid RAM size (1T)")
+
+	err = mon.SetMemory("bar", "512M")
+	AssertError(t, err, "monitor: bar: balloon not enabled")
+
+	info, err = mon.Info("bar")
+	AssertNonError(t, err)
+	AssertEqual(t, info.Memory, int64(1<<30))
+}
+
+func TestMonitorVCPUs(t *testing.T) {
+	env := newTestEnv(t)
+	env.addVM(t, "foo", "cpus: 2\ncpu_topology:\n  maxcpus: 4\n")
+	env.addVM(t, "bar", "cpus: 2\n")
+	mon := env.newMonitor(t)
+
+	err := mon.SetVCPUs("foo", 3)
+	AssertError(t, err, "monitor: \"foo\" not running")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("bar", r) }))
+
+	info, err := mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, info.VCPUs, 2)
+
+	AssertNonError(t, mon.SetVCPUs("foo", 3))
+	info, err = mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, info.VCPUs, 3)
+	AssertEqual(t, mon.Get("foo").Config.CPUs, 3)
+
+	AssertNonError(t, mon.SetVCPUs("foo", 3))
+
+	err = mon.SetVCPUs("foo", 2)
+	AssertError(t, err, "monitor: foo: vcpus can't be removed (3 running)")
+
+	err = mon.SetVCPUs("foo", 5)
+	AssertError(t, err, "monitor: foo: invalid number of vcpus (5). must be between 1 and 4")
+
+	AssertNonError(t, mon.SetVCPUs("foo", 4))
+	info, err = mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, info.VCPUs, 4)
+
+	err = mon.SetVCPUs("bar", 3)
+	AssertError(t, err, "monitor: bar: invalid number of vcpus (3). must be between 1 and 2")
+}
+
+func TestMonitorVCPUsThreads(t *testing.T) {
+	env := newTestEnv(t)
+	env.addVM(t, "foo", "cpus: 2\ncpu_topology:\n  threads: 2\n  maxcpus: 6\n")
+	mon := env.newMonitor(t)
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+
+	info, err := mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, info.VCPUs, 2)
+
+	err = mon.SetVCPUs("foo", 3)
+	AssertError(t, err, "monitor: foo: invalid number of vcpus (3). vcpus are hotplugged 2 at a time (2 running)")
+	info, err = mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, info.VCPUs, 2)
+	AssertEqual(t, mon.Get("foo").Config.CPUs, 2)
+
+	AssertNonError(t, mon.SetVCPUs("foo", 4))
+	info, err = mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, info.VCPUs, 4)
+	AssertEqual(t, mon.Get("foo").Config.CPUs, 4)
+
+	err = mon.SetVCPUs("foo", 5)
+	AssertError(t, err, "monitor: foo: invalid number of vcpus (5). vcpus are hotplugged 2 at a time (4 running)")
+
+	AssertNonError(t, mon.SetVCPUs("foo", 6))
+	info, err = mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, info.VCPUs, 6)
+}
+
+func TestMonitorPinning(t *testing.T) {
+	cpus, err := threadCPUs(os.Getpid(), os.Getpid())
+	AssertNonError(t, err)
+	list, err := qemu.ParseCPUSet(cpus)
+	AssertNonError(t, err)
+	first, last := list[0], list[len(list)-1]
+
+	env := newTestEnv(t)
+	env.addVM(t, "foo", fmt.Sprintf(`cpus: 2
+cpu_topology:
+  maxcpus: 3
+cpu_pinning:
+  0: "%d"
+  2: "%d"
+emulator_cpuset: "%d"
+`, first, first, last))
+	mon := env.newMonitor(t)
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+
+	info, err := mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, len(info.Pinning), 3)
+	AssertEqual(t, info.Pinning[0].Thread, "vcpu0")
+	AssertEqual(t, info.Pinning[0].CPUs, strconv.Itoa(first))
+	AssertEqual(t, info.Pinning[1].Thread, "vcpu1")
+	AssertEqual(t, info.Pinning[1].CPUs, cpus)
+	AssertEqual(t, info.Pinning[2].Thread, "emulator")
+	AssertEqual(t, info.Pinning[2].ThreadID, info.PID)
+	AssertEqual(t, info.Pinning[2].CPUs, strconv.Itoa(last))
+
+	AssertNonError(t, mon.SetVCPUs("foo", 3))
+	info, err = mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, len(info.Pinning), 4)
+	AssertEqual(t, info.Pinning[2].Thread, "vcpu2")
+	AssertEqual(t, info.Pinning[2].CPUs, strconv.Itoa(first))
+}
+
+func TestMonitorCgroup(t *testing.T) {
+	env := newTestEnv(t)
+	env.addVM(t, "foo", "cgroup:\n  cpu_weight: 200\n  memory_max: 1G\n  pids_max: 64\n")
+	env.cgroupParent = filepath.Join(filepath.Dir(env.configDir), "cgroup")
+	mon := env.newMonitor(t)
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(mon.CgroupParent, name))
+		AssertNonError(t, err)
+		return string(data)
+	}
+
+	AssertEqual(t, read("cgroup.subtree_control"), "+cpu +io +memory +pids")
+	AssertEqual(t, read("foo/cpu.max"), "max")
+	AssertEqual(t, read("foo/cpu.weight"), "200")
+	AssertEqual(t, read("foo/memory.max"), "1073741824")
+	AssertEqual(t, read("foo/pids.max"), "64")
+
+	info, err := mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, read("foo/cgroup.procs"), strconv.Itoa(info.PID))
+
+	// the usage files are provided by the kernel
+	for name, value := range map[string]string{
+		"cpu.stat":       "usage_usec 1500000\nuser_usec 1000000\nsystem_usec 500000\n",
+		"memory.current": "268435456\n",
+		"pids.current":   "12\n",
+		"io.stat":        "8:0 rbytes=1024 wbytes=2048 rios=1 wios=2\n8:16 rbytes=1024 wbytes=0 rios=1 wios=0\n",
+	} {
+		AssertNonError(t, ioutil.WriteFile(filepath.Join(mon.CgroupParent, "foo", name), []byte(value), 0644))
+	}
+
+	info, err = mon.Info("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, *info.Cgroup, CgroupUsage{
+		CPUTime:    1500000,
+		Memory:     268435456,
+		PIDs:       12,
+		ReadBytes:  2048,
+		WriteBytes: 2048,
+	})
+}
+
+func TestStatsRing(t *testing.T) {
+	r := &statsRing{size: 3}
+	AssertEqual(t, len(r.list()), 0)
+
+	for j := int64(1); j <= 5; j++ {
+		r.add(&Stats{CPUTime: j})
+		if j == 2 {
+			l := r.list()
+			AssertEqual(t, len(l), 2)
+			AssertEqual(t, l[0].CPUTime, int64(1))
+			AssertEqual(t, l[1].CPUTime, int64(2))
+		}
+	}
+
+	l := r.list()
+	AssertEqual(t, len(l), 3)
+	AssertEqual(t, l[0].CPUTime, int64(3))
+	AssertEqual(t, l[1].CPUTime, int64(4))
+	AssertEqual(t, l[2].CPUTime, int64(5))
+
+	r.reset(42)
+	AssertEqual(t, len(r.list()), 0)
+	AssertEqual(t, r.pid, 42)
+}
+
+func TestNICStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monitor")
+	AssertNonError(t, err)
+	defer os.RemoveAll(dir)
+
+	sys := sysClassNet
+	sysClassNet = dir
+	defer func() { sysClassNet = sys }()
+
+	stats := filepath.Join(dir, "qtap0", "statistics")
+	AssertNonError(t, os.MkdirAll(stats, 0755))
+	for name, value := range map[string]string{"rx_bytes": "1024\n", "tx_bytes": "2048\n", "rx_packets": "3\n", "tx_packets": "4\n"} {
+		AssertNonError(t, ioutil.WriteFile(filepath.Join(stats, name), []byte(value), 0644))
+	}
+
+	s, err := nicStats("qtap0")
+	AssertNonError(t, err)
+	AssertEqual(t, *s, NICStats{Device: "qtap0", RxBytes: 1024, TxBytes: 2048, RxPackets: 3, TxPackets: 4})
+
+	_, err = nicStats("qtap1")
+	AssertNotEqual(t, err, nil)
+}
+
+func TestMonitorStats(t *testing.T) {
+	interval, samples := statsInterval, statsSamples
+	statsInterval, statsSamples = 20*time.Millisecond, 3
+	defer func() { statsInterval, statsSamples = interval, samples }()
+
+	env := newTestEnv(t)
+	env.addVM(t, "foo", `restart_policy: on-failure
+restart_backoff:
+  initial_delay: 0
+`)
+	mon := env.newMonitor(t)
+
+	_, err := mon.Stats("foo")
+	AssertError(t, err, "monitor: \"foo\" not running")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+
+	var stats []*Stats
+	waitFor(t, "stats samples", func() bool {
+		stats, err = mon.Stats("foo")
+		AssertNonError(t, err)
+		return len(stats) == statsSamples+1
+	})
+
+	for j, s := range stats {
+		if j > 0 {
+			AssertEqual(t, s.Time.After(stats[j-1].Time), true)
+			AssertEqual(t, s.CPUTime >= stats[j-1].CPUTime, true)
+		}
+		AssertEqual(t, s.RSS > 0, true)
+		AssertEqual(t, len(s.NICs), 0)
+		AssertEqual(t, s.Drives, []*DriveStats{
+			{Device: "virtio0", ReadBytes: 4096, WriteBytes: 512, ReadOps: 8, WriteOps: 1},
+		})
+	}
+
+	// the samples of the previous process are dropped on restart
+	instance := mon.Get("foo")
+	instance.mutex.RLock()
+	pid := instance.pid
+	instance.mutex.RUnlock()
+
+	AssertNonError(t, syscall.Kill(pid, syscall.SIGKILL))
+	waitFor(t, "restart", func() bool {
+		instance.mutex.RLock()
+		defer instance.mutex.RUnlock()
+		return instance.stats.pid != 0 && instance.stats.pid != pid
+	})
+
+	instance.mutex.RLock()
+	startedAt := instance.startedAt
+	instance.mutex.RUnlock()
+
+	waitFor(t, "stats samples", func() bool {
+		stats, err = mon.Stats("foo")
+		AssertNonError(t, err)
+		return len(stats) == statsSamples+1
+	})
+	for _, s := range stats {
+		AssertEqual(t, s.Time.Before(startedAt), false)
+	}
+
+	// a nic that can't be read is left out of the sample
+	instance.mutex.RLock()
+	partial := &Instance{
+		Name:  instance.Name,
+		NICs:  []*NIC{{ID: "qtap-missing"}},
+		qmp:   instance.qmp,
+		pid:   instance.pid,
+		mutex: &sync.RWMutex{},
+	}
+	instance.mutex.RUnlock()
+
+	s, err := partial.sampleStats(partial.pid)
+	AssertNotEqual(t, err, nil)
+	AssertEqual(t, len(s.NICs), 0)
+	AssertEqual(t, len(s.Drives), 1)
+}
+
+func TestMonitorBackup(t *testing.T) {
+	env := newTestEnv(t)
+
+	images := filepath.Join(filepath.Dir(env.configDir), "images")
+	backups := filepath.Join(filepath.Dir(env.configDir), "backups")
+	AssertNonError(t, os.Mkdir(images, 0755))
+	disk := filepath.Join(images, "disk.img")
+	AssertNonError(t, ioutil.WriteFile(disk, make([]byte, 1024), 0644))
+
+	AssertNonError(t, ioutil.WriteFile(filepath.Join(env.configDir, "foo.yml"), []byte(fmt.Sprintf(`system_target: fake
+shutdown_timeout: 5
+run_as: ""
+backup_dir: %s
+drives:
+  - file: %s
+    format: raw
+  - file: /dev/null
+    device: virtio-blk-pci
+    format: raw
+  - media: cdrom
+nics:
+  - mac_address: 52:54:00:fc:70:3b
+`, backups, disk)), 0644))
+	env.addVM(t, "bar", "")
+	mon := env.newMonitor(t)
+
+	err := mon.Backup("foo", false)
+	AssertError(t, err, "monitor: \"foo\" not running")
+
+	list, err := mon.Backups("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, len(list), 0)
+
+	_, err = mon.Backups("bar")
+	AssertError(t, err, "monitor: bar: backup_dir not configured")
+
+	AssertNonError(t, call(t, func(r chan error) error { return mon.Start("foo", r) }))
+
+	err = mon.Backup("foo", true)
+	AssertError(t, err, "monitor: foo: no previous backup, a full backup is required")
+
+	AssertNonError(t, mon.Backup("foo", false))
+	list, err = mon.Backups("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, len(list), 1)
+	AssertEqual(t, list[0].Incremental, false)
+	AssertEqual(t, len(list[0].Drives), 2)
+	AssertEqual(t, list[0].Drives[0].Drive, "drive1")
+	AssertEqual(t, list[0].Drives[0].Parent, "")
+	AssertEqual(t, list[0].Drives[1].Drive, "drive2")
+	for _, bd := range list[0].Drives {
+		AssertEqual(t, filepath.Dir(bd.File), filepath.Join(backups, "foo"))
+		_, err := os.Stat(bd.File)
+		AssertNonError(t, err)
+	}
+
+	mon.backupsRunning["foo"] = true
+	err = mon.Backup("foo", true)
+	AssertError(t, err, "monitor: foo: backup in progress")
+	delete(mon.backupsRunning, "foo")
+
+	AssertNonError(t, mon.Backup("foo", true))
+	list, err = mon.Backups("foo")
+	AssertNonError(t, err)
+	AssertEqual(t, len(list), 2)
+	AssertNotEqual(t, list[1].Name, list[0].Name)
+	AssertEqual(t, list[1].Incremental, true)
+	AssertEqual(t, list[1].Drives[0].Parent, list[0].Drives[0].File)
+	AssertEqual(t, list[1].Drives[1].Parent, list[0].Drives[1].File)
+	_, err = os.Stat(list[1].Drives[0].File)
+	AssertNonError(t, err)
+}
+
+func TestBlockNode(t *testing.T) {
+	blocks := []*qmp.BlockInfo{
+		{Device: "virtio0", Inserted: &qmp.BlockDeviceInfo{NodeName: "#block123"}},
+		{Device: "virtio1"},
+		{QDev: "/machine/peripheral/data/virtio-backend", Inserted: &qmp.BlockDeviceInfo{NodeName: "data-format"}},
+		{QDev: "scratch", Inserted: &qmp.BlockDeviceInfo{NodeName: "#snap1"}},
+		{Device: "cd", Inserted: &qmp.BlockDeviceInfo{NodeName: "#block456"}},
+		{Device: "virtio2", Inserted: &qmp.BlockDeviceInfo{NodeName: "#block789"}},
+		{Device: "ide1-cd0"},
+	}
+	drives := []*qemu.Drive{
+		{},
+		{},
+		{ID: "data", Device: "virtio-blk-pci"},
+		{ID: "scratch", Device: "scsi-hd"},
+		{ID: "dat", Device: "virtio-blk-pci"},
+		{ID: "cd", Media: "cdrom"},
+		{},
+		{},
+	}
+
+	AssertEqual(t, blockNode(blocks, drives, 1), "#block123")
+	AssertEqual(t, blockNode(blocks, drives, 2), "")
+	AssertEqual(t, blockNode(blocks, drives, 3), "data-format")
+	AssertEqual(t, blockNode(blocks, drives, 4), "#snap1")
+	AssertEqual(t, blockNode(blocks, drives, 5), "")
+	AssertEqual(t, blockNode(blocks, drives, 6), "#block456")
+	AssertEqual(t, blockNode(blocks, drives, 7), "#block789")
+
+	// legacy drives without id are named by qemu, in command line order
+	AssertEqual(t, backendName(blocks, drives, 2), "virtio1")
+	AssertEqual(t, backendName(blocks, drives, 6), "cd")
+	AssertEqual(t, backendName(blocks, drives, 7), "virtio2")
+	AssertEqual(t, backendName(blocks[:1], drives, 8), "")
+}
+
+func TestShouldRestart(t *testing.T) {
+	for _, reason := range []ExitReason{ExitGuestShutdown, ExitHostShutdown, ExitCrash} {
+		AssertEqual(t, shouldRestart("always", reason), true)
+		AssertEqual(t, shouldRestart("never", reason), false)
+	}
+
+	AssertEqual(t, shouldRestart("on-failure", ExitGuestShutdown), false)
+	AssertEqual(t, shouldRestart("on-failure", ExitHostShutdown), true)
+	AssertEqual(t, shouldRestart("on-failure", ExitCrash), true)
+
+	AssertEqual(t, shouldRestart("on-crash", ExitGuestShutdown), false)
+	AssertEqual(t, shouldRestart("on-crash", ExitHostShutdown), false)
+	AssertEqual(t, shouldRestart("on-crash", ExitCrash), true)
+}
+
+func TestRetryDelay(t *testing.T) {
+	i := &Instance{
+		Config: &qemu.VirtualMachine{
+			RestartBackoff: qemu.RestartBackoff{
+				InitialDelay: 2,
+				Multiplier:   3,
+				MaximumDelay: 60,
+			},
+		},
+	}
+
+	for _, d := range []struct {
+		retries int
+		delay   time.Duration
+	}{
+		{0, 2 * time.Second},
+		{1, 2 * time.Second},
+		{2, 6 * time.Second},
+		{3, 18 * time.Second},
+		{4, 54 * time.Second},
+		{5, 60 * time.Second},
+		{50, 60 * time.Second},
+	} {
+		i.retries = d.retries
+		AssertEqual(t, i.retryDelay(), d.delay)
+	}
+
+	i.Config.RestartBackoff.Multiplier = 0
+	i.retries = 10
+	AssertEqual(t, i.retryDelay(), 2*time.Second)
+}
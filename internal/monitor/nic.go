@@ -60,7 +60,36 @@ func newNICs(vm string, config *qemu.VirtualMachine) ([]*NIC, error) {
 	return nics, nil
 }
 
+func (n *NIC) restore() error {
+	iface, err := net.InterfaceByName(n.ID)
+	if err != nil {
+		return fmt.Errorf("monitor: %s: %s: %s", n.Bridge, n.ID, err)
+	}
+	n.iface = iface
+	return nil
+}
+
+func restoreNICDevices(config *qemu.VirtualMachine, nics []*NIC) error {
+	j := 0
+	for i, nic := range config.NICs {
+		if nic.Bridge == "" {
+			continue
+		}
+		if j >= len(nics) || nics[j].Bridge != nic.Bridge {
+			return fmt.Errorf("monitor: nic[%d]: no qtap found for bridge %s", i+1, nic.Bridge)
+		}
+		config.NICs[i].SetDevice(nics[j].ID)
+		j++
+	}
+	return nil
+}
+
 func (n *NIC) Cleanup(vm string) error {
+	if n.iface == nil {
+		// device is already gone
+		return nil
+	}
+
 	logutils.Notice.Printf("monitor: %s: %s: %s: cleanup", vm, n.Bridge, n.ID)
 
 	errs := []string{}
@@ -0,0 +1,200 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+)
+
+// same size as the cpu_set_t from glibc
+const cpuSetSize = 1024
+
+// PinningInfo is the set of host cpus a qemu thread can run on, as reported
+// by the kernel. Thread is vcpuN or emulator.
+type PinningInfo struct {
+	Thread   string `json:"thread" yaml:"thread"`
+	ThreadID int    `json:"thread_id" yaml:"thread_id"`
+	CPUs     string `json:"cpus" yaml:"cpus"`
+}
+
+func setAffinity(tid int, cpuset string) error {
+	cpus, err := qemu.ParseCPUSet(cpuset)
+	if err != nil {
+		return err
+	}
+
+	var mask [cpuSetSize / 64]uint64
+	for _, cpu := range cpus {
+		if cpu >= cpuSetSize {
+			return fmt.Errorf("monitor: cpu out of range (%d)", cpu)
+		}
+		mask[cpu/64] |= 1 << uint(cpu%64)
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid),
+		unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask))); errno != 0 {
+		return os.NewSyscallError(fmt.Sprintf("monitor: failed sched_setaffinity (thread %d)", tid), errno)
+	}
+	return nil
+}
+
+// threadCPUs returns the cpus a thread of a process is allowed to run on.
+func threadCPUs(pid int, tid int) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/task/%d/status", pid, tid))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v := strings.TrimPrefix(scanner.Text(), "Cpus_allowed_list:"); v != scanner.Text() {
+			return strings.TrimSpace(v), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("monitor: cpus not found for thread %d", tid)
+}
+
+func processThreads(pid int) ([]int, error) {
+	entries, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []int{}
+	for _, entry := range entries {
+		if tid, err := strconv.Atoi(entry.Name()); err == nil {
+			rv = append(rv, tid)
+		}
+	}
+	sort.Ints(rv)
+	return rv, nil
+}
+
+// vcpuThreads returns the thread ids of the vcpus, by vcpu index.
+func (i *Instance) vcpuThreads() (map[int]int, error) {
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	cpus, err := i.qmp.QueryCPUsFast(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[int]int{}
+	for _, cpu := range cpus {
+		rv[cpu.CPUIndex] = cpu.ThreadID
+	}
+	return rv, nil
+}
+
+// applyPinning pins the vcpu threads to their cpu_pinning cpusets, and the
+// other threads to emulator_cpuset. threads created later by qemu inherit
+// the cpuset of the emulator, so it must be applied again after hotplugging
+// vcpus.
+func (i *Instance) applyPinning() error {
+	if len(i.Config.CPUPinning) == 0 && i.Config.EmulatorCPUSet == "" {
+		return nil
+	}
+
+	vcpus, err := i.vcpuThreads()
+	if err != nil {
+		return err
+	}
+
+	i.mutex.RLock()
+	pid := i.pid
+	i.mutex.RUnlock()
+
+	if i.Config.EmulatorCPUSet != "" {
+		threads, err := processThreads(pid)
+		if err != nil {
+			return err
+		}
+
+		vcpuTIDs := map[int]bool{}
+		for _, tid := range vcpus {
+			vcpuTIDs[tid] = true
+		}
+
+		for _, tid := range threads {
+			if vcpuTIDs[tid] {
+				continue
+			}
+			if err := setAffinity(tid, i.Config.EmulatorCPUSet); err != nil {
+				return err
+			}
+		}
+	}
+
+	for vcpu, cpuset := range i.Config.CPUPinning {
+		// not plugged yet
+		tid, ok := vcpus[vcpu]
+		if !ok {
+			continue
+		}
+		if err := setAffinity(tid, cpuset); err != nil {
+			return err
+		}
+	}
+
+	logutils.Notice.Printf("monitor: %s: cpu pinning applied", i.Name)
+
+	return nil
+}
+
+// pinning returns the effective pinning of the vcpu threads and of the
+// main qemu thread.
+func (i *Instance) pinning() ([]*PinningInfo, error) {
+	vcpus, err := i.vcpuThreads()
+	if err != nil {
+		return nil, err
+	}
+
+	i.mutex.RLock()
+	pid := i.pid
+	i.mutex.RUnlock()
+
+	indexes := []int{}
+	for vcpu := range vcpus {
+		indexes = append(indexes, vcpu)
+	}
+	sort.Ints(indexes)
+
+	rv := []*PinningInfo{}
+	for _, vcpu := range indexes {
+		cpus, err := threadCPUs(pid, vcpus[vcpu])
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, &PinningInfo{
+			Thread:   fmt.Sprintf("vcpu%d", vcpu),
+			ThreadID: vcpus[vcpu],
+			CPUs:     cpus,
+		})
+	}
+
+	cpus, err := threadCPUs(pid, pid)
+	if err != nil {
+		return nil, err
+	}
+	rv = append(rv, &PinningInfo{
+		Thread:   "emulator",
+		ThreadID: pid,
+		CPUs:     cpus,
+	})
+
+	return rv, nil
+}
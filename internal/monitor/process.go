@@ -0,0 +1,115 @@
+package monitor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	sysPidfdOpen = 434
+)
+
+var (
+	processPollInterval = 500 * time.Millisecond
+)
+
+func processAlive(pid int) bool {
+	if pid <= 0 || syscall.Kill(pid, syscall.Signal(0)) != nil {
+		return false
+	}
+
+	// zombies can still be signaled, but they are gone for our purposes.
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	s := string(stat)
+	if idx := strings.LastIndex(s, ")"); idx > 0 && idx+2 < len(s) {
+		return s[idx+2] != 'Z'
+	}
+	return true
+}
+
+func pollProcess(pid int, exited chan struct{}, stop chan struct{}) {
+	ticker := time.NewTicker(processPollInterval)
+	defer ticker.Stop()
+
+	for processAlive(pid) {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+
+	close(exited)
+}
+
+// watchProcess returns a channel that is closed as soon as the process
+// exits, and a function that releases the watcher. The processes we watch
+// are daemonized, and therefore not our children, so we can't wait(2) on
+// them. a pidfd is used when supported by the kernel, otherwise the process
+// is polled.
+func watchProcess(pid int) (<-chan struct{}, func()) {
+	exited := make(chan struct{})
+	stop := make(chan struct{})
+
+	once := &sync.Once{}
+	var file *os.File
+	unwatch := func() {
+		once.Do(func() {
+			close(stop)
+			if file != nil {
+				file.Close()
+			}
+		})
+	}
+
+	fd, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(pid), 0, 0)
+	if errno == syscall.ESRCH {
+		close(exited)
+		return exited, unwatch
+	}
+	if errno != 0 {
+		go pollProcess(pid, exited, stop)
+		return exited, unwatch
+	}
+
+	if err := syscall.SetNonblock(int(fd), true); err != nil {
+		syscall.Close(int(fd))
+		go pollProcess(pid, exited, stop)
+		return exited, unwatch
+	}
+
+	// non-blocking files are registered with the runtime poller, and a pidfd
+	// becomes readable when the process exits.
+	file = os.NewFile(fd, fmt.Sprintf("pidfd:%d", pid))
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		file = nil
+		go pollProcess(pid, exited, stop)
+		return exited, unwatch
+	}
+
+	go func() {
+		first := true
+		err := conn.Read(func(uintptr) bool {
+			if first {
+				first = false
+				return false
+			}
+			return true
+		})
+		if err == nil {
+			close(exited)
+		}
+	}()
+
+	return exited, unwatch
+}
@@ -0,0 +1,67 @@
+package monitor
+
+import (
+	"math"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+)
+
+type ExitReason string
+
+const (
+	// the guest powered itself off cleanly
+	ExitGuestShutdown ExitReason = "guest-shutdown"
+
+	// qemu was asked to quit by someone else than the monitor (e.g. a signal
+	// or a QMP quit command)
+	ExitHostShutdown ExitReason = "host-shutdown"
+
+	// the guest panicked, or qemu died without a SHUTDOWN event
+	ExitCrash ExitReason = "crash"
+)
+
+func (i *Instance) exitReason() ExitReason {
+	if i.panicked || i.lastShutdown == nil {
+		return ExitCrash
+	}
+
+	if i.lastShutdown.Guest && i.lastShutdown.Reason == "guest-shutdown" {
+		return ExitGuestShutdown
+	}
+
+	return ExitHostShutdown
+}
+
+func shouldRestart(policy string, reason ExitReason) bool {
+	switch policy {
+	case qemu.RestartNever:
+		return false
+	case qemu.RestartOnFailure:
+		return reason != ExitGuestShutdown
+	case qemu.RestartOnCrash:
+		return reason == ExitCrash
+	}
+	return true
+}
+
+func (i *Instance) retryDelay() time.Duration {
+	b := i.Config.RestartBackoff
+
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	retries := i.retries
+	if retries < 1 {
+		retries = 1
+	}
+
+	delay := float64(b.InitialDelay) * math.Pow(multiplier, float64(retries-1))
+	if b.MaximumDelay > 0 && delay > float64(b.MaximumDelay) {
+		delay = float64(b.MaximumDelay)
+	}
+
+	return time.Duration(delay * float64(time.Second))
+}
@@ -0,0 +1,279 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+)
+
+var (
+	migratePoll    = 100 * time.Millisecond
+	saveTimeout    = 30 * time.Minute
+	restoreTimeout = 30 * time.Minute
+)
+
+// savedState describes the memory state of a virtual machine saved to the
+// state directory. the configuration is the one the virtual machine was
+// running with, that must be used to restore it.
+type savedState struct {
+	Name   string               `json:"name"`
+	Config *qemu.VirtualMachine `json:"config"`
+	Paused bool                 `json:"paused"`
+	Saved  time.Time            `json:"saved"`
+}
+
+func (m *Monitor) savedFiles(name string) (string, string) {
+	base := filepath.Join(m.StateDir, name)
+	return base + ".state", base + ".json"
+}
+
+// readSaved returns the saved state of a virtual machine, or nil if there is
+// none.
+func (m *Monitor) readSaved(name string) (*savedState, error) {
+	_, metaFile := m.savedFiles(name)
+
+	data, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	rv := &savedState{}
+	if err := json.Unmarshal(data, rv); err != nil {
+		return nil, fmt.Errorf("monitor: %s: invalid saved state file: %s", metaFile, err)
+	}
+	if rv.Config == nil {
+		return nil, fmt.Errorf("monitor: %s: invalid saved state file", metaFile)
+	}
+	return rv, nil
+}
+
+func (m *Monitor) removeSaved(name string) error {
+	// metadata first, a state file alone is ignored
+	stateFile, metaFile := m.savedFiles(name)
+	for _, file := range []string{metaFile, stateFile} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func (i *Instance) waitMigration(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		ctx, cancel := qmpContext()
+		info, err := i.qmp.QueryMigrate(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		switch info.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			if info.ErrorDesc != "" {
+				return fmt.Errorf("monitor: %s: migration %s: %s", i.Name, info.Status, info.ErrorDesc)
+			}
+			return fmt.Errorf("monitor: %s: migration %s", i.Name, info.Status)
+		}
+
+		if time.Now().After(deadline) {
+			ctx, cancel = qmpContext()
+			logutils.LogError(i.qmp.MigrateCancel(ctx))
+			cancel()
+			return fmt.Errorf("monitor: %s: migration timed out", i.Name)
+		}
+		time.Sleep(migratePoll)
+	}
+}
+
+// save writes the memory state of the virtual machine to the state directory
+// and stops it. the virtual machine keeps running if anything fails.
+func (i *Instance) save() error {
+	if ok := i.ProcessRunning(); !ok {
+		return fmt.Errorf("monitor: %q not running", i.Name)
+	}
+	if i.migrating {
+		return fmt.Errorf("monitor: %s: migration in progress", i.Name)
+	}
+	if i.exited == nil {
+		i.watch()
+	}
+
+	logutils.Warning.Printf("monitor: %s: save", i.Name)
+
+	stateFile, metaFile := i.monitor.savedFiles(i.Name)
+	if err := os.MkdirAll(i.monitor.StateDir, 0755); err != nil {
+		return err
+	}
+
+	// qemu writes the state file as the user it runs as
+	f, err := os.OpenFile(stateFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := chownRunAs(stateFile, i.Config.RunAs); err != nil {
+		os.Remove(stateFile)
+		return err
+	}
+
+	paused := i.Paused()
+
+	rollback := func(err error) error {
+		logutils.LogError(i.monitor.removeSaved(i.Name))
+		if !paused {
+			ctx, cancel := qmpContext()
+			logutils.LogError(i.qmp.Cont(ctx))
+			cancel()
+		}
+		return err
+	}
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	if !paused {
+		if err := i.qmp.Stop(ctx); err != nil {
+			return rollback(err)
+		}
+	}
+
+	if err := i.qmp.Migrate(ctx, "exec:cat > "+shellQuote(stateFile)); err != nil {
+		return rollback(err)
+	}
+	if err := i.waitMigration(saveTimeout); err != nil {
+		return rollback(err)
+	}
+
+	data, err := json.MarshalIndent(&savedState{
+		Name:   i.Name,
+		Config: i.Config,
+		Paused: paused,
+		Saved:  time.Now(),
+	}, "", "    ")
+	if err != nil {
+		return rollback(err)
+	}
+	if err := writeFileAtomic(metaFile, data, 0600); err != nil {
+		return rollback(err)
+	}
+
+	ctx, cancel = qmpContext()
+	defer cancel()
+
+	if err := i.qmp.Quit(ctx); err != nil {
+		logutils.LogError(err)
+	}
+	if err := i.waitExit(); err != nil {
+		return err
+	}
+
+	i.unwatchProcess()
+	i.removeCgroup()
+
+	if err := CleanupNICs(i.Name, i.NICs); err != nil {
+		return err
+	}
+
+	logutils.Warning.Printf("monitor: %s: save: done", i.Name)
+
+	return nil
+}
+
+// restore waits for the process started with the saved state to load it, and
+// resumes the virtual machine, unless it was paused when saved.
+func (i *Instance) restore(saved *savedState) error {
+	logutils.Warning.Printf("monitor: %s: restore", i.Name)
+
+	if err := i.waitMigration(restoreTimeout); err != nil {
+		return err
+	}
+
+	if !saved.Paused {
+		ctx, cancel := qmpContext()
+		defer cancel()
+
+		if err := i.qmp.Cont(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := i.monitor.removeSaved(i.Name); err != nil {
+		logutils.LogError(err)
+	}
+
+	logutils.Warning.Printf("monitor: %s: restore: done", i.Name)
+
+	return nil
+}
+
+// Save writes the memory state of a running virtual machine to the state
+// directory, and stops it. the next start restores it.
+func (m *Monitor) Save(name string, result chan error) error {
+	logutils.Notice.Printf("monitor: requesting save: %s", name)
+
+	instance := m.Get(name)
+	if instance == nil {
+		return fmt.Errorf("monitor: %q not running", name)
+	}
+
+	return instance.request(Save, result)
+}
+
+// Restore starts a virtual machine from its saved state.
+func (m *Monitor) Restore(name string, result chan error) error {
+	logutils.Notice.Printf("monitor: requesting restore: %s", name)
+
+	saved, err := m.readSaved(name)
+	if err != nil {
+		return err
+	}
+	if saved == nil {
+		return fmt.Errorf("monitor: %s: no saved state", name)
+	}
+
+	return m.Start(name, result)
+}
+
+// DiscardSaved removes the saved state of a virtual machine, so that the next
+// start boots it from scratch.
+func (m *Monitor) DiscardSaved(name string) error {
+	logutils.Notice.Printf("monitor: requesting saved state discard: %s", name)
+
+	if err := qemu.CheckName(name); err != nil {
+		return err
+	}
+
+	// hold the lock, so that the virtual machine can't be started meanwhile
+	m.instancesMutex.Lock()
+	defer m.instancesMutex.Unlock()
+
+	if _, ok := m.instances[name]; ok {
+		return fmt.Errorf("monitor: %s: virtual machine is running", name)
+	}
+
+	// an invalid saved state must be discarded as well
+	_, metaFile := m.savedFiles(name)
+	if _, err := os.Stat(metaFile); os.IsNotExist(err) {
+		return fmt.Errorf("monitor: %s: no saved state", name)
+	}
+
+	return m.removeSaved(name)
+}
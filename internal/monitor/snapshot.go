@@ -0,0 +1,559 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+	"github.com/rafaelmartins/simplevirt/internal/qmp"
+)
+
+var (
+	reSnapshotName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+	blockJobPoll    = 100 * time.Millisecond
+	blockJobTimeout = 30 * time.Minute
+)
+
+// SnapshotDrive is a drive included in a snapshot. Image holds the state of
+// the drive when the snapshot was created, and is not written anymore.
+// Overlay is the image created on top of it by the snapshot.
+type SnapshotDrive struct {
+	Drive   string `json:"drive"`
+	Image   string `json:"image"`
+	Format  string `json:"format"`
+	Overlay string `json:"overlay"`
+}
+
+// Snapshot is an external snapshot of the drives of a virtual machine. the
+// snapshots of a virtual machine are stored next to its configuration file,
+// in creation order.
+type Snapshot struct {
+	Name    string           `json:"name"`
+	Created time.Time        `json:"created"`
+	Drives  []*SnapshotDrive `json:"drives"`
+}
+
+func (m *Monitor) snapshotsFile(name string) string {
+	return filepath.Join(m.ConfigDir, fmt.Sprintf("%s.snapshots.json", name))
+}
+
+func (m *Monitor) readSnapshots(name string) ([]*Snapshot, error) {
+	data, err := ioutil.ReadFile(m.snapshotsFile(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Snapshot{}, nil
+		}
+		return nil, err
+	}
+
+	rv := []*Snapshot{}
+	if err := json.Unmarshal(data, &rv); err != nil {
+		return nil, fmt.Errorf("monitor: %s: invalid snapshots file: %s", name, err)
+	}
+	return rv, nil
+}
+
+func (m *Monitor) writeSnapshots(name string, snapshots []*Snapshot) error {
+	if len(snapshots) == 0 {
+		if err := os.Remove(m.snapshotsFile(name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(snapshots, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(m.snapshotsFile(name), data, 0644)
+}
+
+func findSnapshot(snapshots []*Snapshot, snapshot string) int {
+	for i, snap := range snapshots {
+		if snap.Name == snapshot {
+			return i
+		}
+	}
+	return -1
+}
+
+// setDriveImage returns an edit for editConfig, that replaces the image of
+// a drive.
+func setDriveImage(file string, format string) func(data []byte, idx int) ([]byte, error) {
+	return func(data []byte, idx int) ([]byte, error) {
+		data, err := qemu.SetConfigDriveKey(data, idx, "file", file)
+		if err != nil {
+			return nil, err
+		}
+		return qemu.SetConfigDriveKey(data, idx, "format", format)
+	}
+}
+
+// dataDrives returns the indexes (starting from 1) of the drives included in
+// snapshots and backups: all the drives with an image, but cdroms and
+// temporary drives.
+func dataDrives(config *qemu.VirtualMachine) []int {
+	rv := []int{}
+	for idx, drv := range config.Drives {
+		if drv == nil || drv.File == "" || drv.Media == "cdrom" || drv.Snapshot {
+			continue
+		}
+		rv = append(rv, idx+1)
+	}
+	return rv
+}
+
+func newSnapshot(name string, snapshot string, config *qemu.VirtualMachine) (*Snapshot, error) {
+	rv := &Snapshot{
+		Name:    snapshot,
+		Created: time.Now(),
+		Drives:  []*SnapshotDrive{},
+	}
+
+	for _, idx := range dataDrives(config) {
+		drv := config.Drives[idx-1]
+		drive := drv.DeviceID(idx)
+		if strings.HasPrefix(drv.File, "/dev/") {
+			return nil, fmt.Errorf("monitor: %s: %s: snapshots of block devices are not supported", name, drive)
+		}
+
+		format := drv.Format
+		if format == "" {
+			var err error
+			format, err = qemu.ImageFormat(drv.File)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		overlay := filepath.Join(filepath.Dir(drv.File), fmt.Sprintf("%s-%s.%s.qcow2", name, drive, snapshot))
+		if _, err := os.Stat(overlay); err == nil {
+			return nil, fmt.Errorf("monitor: %s: %s: file already exists: %s", name, drive, overlay)
+		}
+
+		rv.Drives = append(rv.Drives, &SnapshotDrive{
+			Drive:   drive,
+			Image:   drv.File,
+			Format:  format,
+			Overlay: overlay,
+		})
+	}
+
+	if len(rv.Drives) == 0 {
+		return nil, fmt.Errorf("monitor: %s: no drives to snapshot", name)
+	}
+
+	return rv, nil
+}
+
+// blockNode returns the name of the active block node of drive number idx.
+func blockNode(blocks []*qmp.BlockInfo, drives []*qemu.Drive, idx int) string {
+	device, id := driveTarget(blocks, drives, idx)
+	for _, block := range blocks {
+		if block.Inserted == nil {
+			continue
+		}
+		if device != "" && block.Device == device {
+			return block.Inserted.NodeName
+		}
+		// virtio devices report the path of their backend
+		if id != "" && (block.QDev == id || strings.HasPrefix(block.QDev, "/machine/peripheral/"+id+"/")) {
+			return block.Inserted.NodeName
+		}
+	}
+	return ""
+}
+
+func (i *Instance) queryBlockNode(idx int, drv *qemu.Drive) (string, error) {
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	blocks, err := i.qmp.QueryBlock(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	node := blockNode(blocks, i.Config.Drives, idx)
+	if node == "" {
+		return "", fmt.Errorf("monitor: %s: drive not found by qemu: %s", i.Name, drv.DeviceID(idx))
+	}
+
+	// the image is below the throttle filter
+	if qemu.DriveThrottleGroup(idx, drv) == "" || node != qemu.DriveNodeNames(idx, drv)[0] {
+		return node, nil
+	}
+
+	nodes, err := i.qmp.QueryNamedBlockNodes(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, n := range nodes {
+		if n.File == drv.File && n.Driver == drv.Format {
+			return n.NodeName, nil
+		}
+	}
+	return "", fmt.Errorf("monitor: %s: image node not found by qemu: %s", i.Name, drv.DeviceID(idx))
+}
+
+func (i *Instance) createSnapshot(snap *Snapshot) error {
+	actions := []*qmp.TransactionAction{}
+	drives := []*qemu.Drive{}
+	for _, sd := range snap.Drives {
+		idx, drv, err := i.findDrive(sd.Drive)
+		if err != nil {
+			return err
+		}
+
+		node, err := i.queryBlockNode(idx, drv)
+		if err != nil {
+			return err
+		}
+
+		actions = append(actions, &qmp.TransactionAction{
+			Type: "blockdev-snapshot-sync",
+			Data: &qmp.BlockdevSnapshotSync{
+				NodeName:     node,
+				SnapshotFile: sd.Overlay,
+				Format:       "qcow2",
+				Mode:         "absolute-paths",
+			},
+		})
+		drives = append(drives, drv)
+	}
+
+	// all the drives are snapshotted at the same point in time
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	if err := i.qmp.Transaction(ctx, actions); err != nil {
+		return err
+	}
+
+	for j, drv := range drives {
+		drv.File = snap.Drives[j].Overlay
+		drv.Format = "qcow2"
+	}
+
+	logutils.LogError(i.writeState())
+	return nil
+}
+
+func createSnapshotOffline(snap *Snapshot) error {
+	for j, sd := range snap.Drives {
+		if err := qemu.CreateOverlay(sd.Overlay, sd.Image, sd.Format); err != nil {
+			for _, created := range snap.Drives[:j] {
+				logutils.LogError(os.Remove(created.Overlay))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// waitJob waits for a job created with auto-dismiss disabled to conclude,
+// completing it when ready. it may be called outside of the instance
+// goroutine.
+func (i *Instance) waitJob(id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	completed := false
+
+	for {
+		ctx, cancel := qmpContext()
+		jobs, err := i.qmp.QueryJobs(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		var job *qmp.JobInfo
+		for _, j := range jobs {
+			if j.ID == id {
+				job = j
+				break
+			}
+		}
+		if job == nil {
+			return fmt.Errorf("monitor: %s: job not found: %s", i.Name, id)
+		}
+
+		ctx, cancel = qmpContext()
+		switch job.Status {
+		case "ready":
+			if !completed {
+				err = i.qmp.JobComplete(ctx, id)
+				completed = true
+			}
+
+		case "concluded":
+			err = i.qmp.JobDismiss(ctx, id)
+			cancel()
+			if job.Error != "" {
+				return fmt.Errorf("monitor: %s: %s: %s", i.Name, id, job.Error)
+			}
+			return err
+		}
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			ctx, cancel = qmpContext()
+			logutils.LogError(i.qmp.JobCancel(ctx, id))
+			cancel()
+			return fmt.Errorf("monitor: %s: %s: timeout", i.Name, id)
+		}
+
+		time.Sleep(blockJobPoll)
+	}
+}
+
+// deleteSnapshot commits the overlays created by snapshot number k into
+// their backing images. the drives are removed from the snapshot as they
+// are committed, so that the snapshots can be saved even after a failure.
+func (i *Instance) deleteSnapshot(snapshots []*Snapshot, k int) error {
+	snap := snapshots[k]
+
+	for len(snap.Drives) > 0 {
+		sd := snap.Drives[0]
+
+		idx, drv, err := i.findDrive(sd.Drive)
+		if err != nil {
+			return err
+		}
+
+		node, err := i.queryBlockNode(idx, drv)
+		if err != nil {
+			return err
+		}
+
+		autoDismiss := false
+		args := &qmp.BlockCommit{
+			JobID:       "commit-" + sd.Drive,
+			Device:      node,
+			Base:        sd.Image,
+			AutoDismiss: &autoDismiss,
+		}
+
+		// committing the active layer makes the backing image active again
+		active := drv.File == sd.Overlay
+		if !active {
+			args.Top = sd.Overlay
+		}
+
+		logutils.Notice.Printf("monitor: %s: %s: committing %s", i.Name, sd.Drive, sd.Overlay)
+
+		ctx, cancel := qmpContext()
+		err = i.qmp.BlockCommit(ctx, args)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		if err := i.waitJob(args.JobID, blockJobTimeout); err != nil {
+			return err
+		}
+
+		if active {
+			drv.File = sd.Image
+			drv.Format = sd.Format
+			logutils.LogError(i.writeState())
+			if err := i.monitor.editConfig(i.Name, sd.Drive, setDriveImage(sd.Image, sd.Format)); err != nil {
+				return err
+			}
+		} else if k+1 < len(snapshots) {
+			// the next snapshot of the drive was stacked on the overlay
+			for _, next := range snapshots[k+1].Drives {
+				if next.Drive == sd.Drive {
+					next.Image = sd.Image
+					next.Format = sd.Format
+				}
+			}
+		}
+
+		logutils.LogError(os.Remove(sd.Overlay))
+		snap.Drives = snap.Drives[1:]
+	}
+
+	return nil
+}
+
+// revertSnapshotOffline discards the changes made after snapshot number k,
+// by replacing its overlays with empty ones. the later snapshots are
+// removed.
+func (m *Monitor) revertSnapshotOffline(name string, snapshots []*Snapshot, k int) error {
+	for _, later := range snapshots[k+1:] {
+		for _, sd := range later.Drives {
+			if err := os.Remove(sd.Overlay); err != nil && !os.IsNotExist(err) {
+				logutils.LogError(err)
+			}
+		}
+	}
+
+	for _, sd := range snapshots[k].Drives {
+		if err := os.Remove(sd.Overlay); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := qemu.CreateOverlay(sd.Overlay, sd.Image, sd.Format); err != nil {
+			return err
+		}
+		if err := m.editConfig(name, sd.Drive, setDriveImage(sd.Overlay, "qcow2")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CreateSnapshot creates an external snapshot of the drives of a virtual
+// machine. the current images are kept as they are, and the virtual
+// machine is switched to new qcow2 images backed by them. running virtual
+// machines are switched atomically, without interruption.
+func (m *Monitor) CreateSnapshot(name string, snapshot string) error {
+	logutils.Notice.Printf("monitor: requesting snapshot create: %s: %s", name, snapshot)
+
+	if err := qemu.CheckName(name); err != nil {
+		return err
+	}
+	if !reSnapshotName.MatchString(snapshot) {
+		return fmt.Errorf("monitor: invalid snapshot name: %q", snapshot)
+	}
+
+	m.snapshotsMutex.Lock()
+	defer m.snapshotsMutex.Unlock()
+
+	snapshots, err := m.readSnapshots(name)
+	if err != nil {
+		return err
+	}
+	if findSnapshot(snapshots, snapshot) >= 0 {
+		return fmt.Errorf("monitor: %s: snapshot already exists: %s", name, snapshot)
+	}
+
+	var snap *Snapshot
+	if err := m.withInstance(name,
+		func(i *Instance) error {
+			var err error
+			snap, err = newSnapshot(name, snapshot, i.Config)
+			if err != nil {
+				return err
+			}
+			return i.createSnapshot(snap)
+		},
+		func() error {
+			config, err := qemu.ParseConfig(m.ConfigDir, name)
+			if err != nil {
+				return err
+			}
+			snap, err = newSnapshot(name, snapshot, config)
+			if err != nil {
+				return err
+			}
+			return createSnapshotOffline(snap)
+		},
+	); err != nil {
+		return err
+	}
+
+	if err := m.writeSnapshots(name, append(snapshots, snap)); err != nil {
+		return err
+	}
+
+	// the configuration must follow the images, or the snapshot would be
+	// written when the virtual machine is restarted
+	for _, sd := range snap.Drives {
+		if err := m.editConfig(name, sd.Drive, setDriveImage(sd.Overlay, "qcow2")); err != nil {
+			return fmt.Errorf("monitor: %s: snapshot created, but configuration not saved: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Monitor) Snapshots(name string) ([]*Snapshot, error) {
+	if err := qemu.CheckName(name); err != nil {
+		return nil, err
+	}
+
+	m.snapshotsMutex.Lock()
+	defer m.snapshotsMutex.Unlock()
+
+	return m.readSnapshots(name)
+}
+
+// DeleteSnapshot removes a snapshot of a running virtual machine, merging
+// the changes made after it into its images.
+func (m *Monitor) DeleteSnapshot(name string, snapshot string) error {
+	logutils.Notice.Printf("monitor: requesting snapshot delete: %s: %s", name, snapshot)
+
+	if err := qemu.CheckName(name); err != nil {
+		return err
+	}
+
+	m.snapshotsMutex.Lock()
+	defer m.snapshotsMutex.Unlock()
+
+	snapshots, err := m.readSnapshots(name)
+	if err != nil {
+		return err
+	}
+
+	k := findSnapshot(snapshots, snapshot)
+	if k < 0 {
+		return fmt.Errorf("monitor: %s: snapshot not found: %s", name, snapshot)
+	}
+
+	err = m.withInstance(name,
+		func(i *Instance) error {
+			return i.deleteSnapshot(snapshots, k)
+		},
+		nil,
+	)
+
+	if len(snapshots[k].Drives) == 0 {
+		snapshots = append(snapshots[:k], snapshots[k+1:]...)
+	}
+	logutils.LogError(m.writeSnapshots(name, snapshots))
+
+	return err
+}
+
+// RevertSnapshot discards all the changes made to the drives of a virtual
+// machine after a snapshot, including the snapshots created after it. the
+// virtual machine must not be running.
+func (m *Monitor) RevertSnapshot(name string, snapshot string) error {
+	logutils.Notice.Printf("monitor: requesting snapshot revert: %s: %s", name, snapshot)
+
+	if err := qemu.CheckName(name); err != nil {
+		return err
+	}
+
+	m.snapshotsMutex.Lock()
+	defer m.snapshotsMutex.Unlock()
+
+	snapshots, err := m.readSnapshots(name)
+	if err != nil {
+		return err
+	}
+
+	k := findSnapshot(snapshots, snapshot)
+	if k < 0 {
+		return fmt.Errorf("monitor: %s: snapshot not found: %s", name, snapshot)
+	}
+
+	return m.withInstance(name, nil, func() error {
+		if err := m.writeSnapshots(name, snapshots[:k+1]); err != nil {
+			return err
+		}
+		return m.revertSnapshotOffline(name, snapshots, k)
+	})
+}
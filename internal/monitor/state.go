@@ -0,0 +1,225 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+)
+
+var (
+	adoptTimeout = 5 * time.Second
+)
+
+// instanceState is persisted to the runtime directory while a virtual
+// machine is running, so that a restarted daemon can resume supervising it.
+type instanceState struct {
+	Name    string               `json:"name"`
+	PID     int                  `json:"pid"`
+	Config  *qemu.VirtualMachine `json:"config"`
+	NICs    []*NIC               `json:"nics"`
+	Retries int                  `json:"retries"`
+	Started time.Time            `json:"started"`
+}
+
+func (i *Instance) StateFile() string {
+	if i.Name == "" {
+		return ""
+	}
+
+	return filepath.Join(i.monitor.RuntimeDir, fmt.Sprintf("%s.json", i.Name))
+}
+
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+func (i *Instance) writeState() error {
+	i.mutex.RLock()
+	state := instanceState{
+		Name:    i.Name,
+		PID:     i.pid,
+		Config:  i.Config,
+		NICs:    i.NICs,
+		Retries: i.retries,
+		Started: i.startedAt,
+	}
+	i.mutex.RUnlock()
+
+	data, err := json.MarshalIndent(&state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(i.StateFile(), data, 0600)
+}
+
+func (i *Instance) removeState() error {
+	if err := os.Remove(i.StateFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func listStates(runtimeDir string) ([]*instanceState, error) {
+	files, err := filepath.Glob(filepath.Join(runtimeDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []*instanceState{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			logutils.LogError(err)
+			continue
+		}
+
+		state := &instanceState{}
+		if err := json.Unmarshal(data, state); err != nil {
+			logutils.Error.Printf("monitor: %s: invalid state file: %s", file, err)
+			continue
+		}
+
+		if state.Name == "" || state.Config == nil ||
+			state.Name != strings.TrimSuffix(filepath.Base(file), ".json") {
+			logutils.Error.Printf("monitor: %s: invalid state file", file)
+			continue
+		}
+
+		rv = append(rv, state)
+	}
+
+	return rv, nil
+}
+
+// verifyProcess checks that pid still points to the qemu process started for
+// the instance, and not to some unrelated process that reused the pid.
+func (i *Instance) verifyProcess(pid int) error {
+	if !processAlive(pid) {
+		return fmt.Errorf("monitor: %s: process %d not running", i.Name, pid)
+	}
+
+	filePID, err := i.PID()
+	if err != nil {
+		return err
+	}
+	if filePID != pid {
+		return fmt.Errorf("monitor: %s: pid file mismatch (%d != %d)", i.Name, filePID, pid)
+	}
+
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(cmdline, []byte("\x00-pidfile\x00"+i.PIDFile()+"\x00")) {
+		return fmt.Errorf("monitor: %s: process %d is not a virtual machine", i.Name, pid)
+	}
+
+	return nil
+}
+
+func (m *Monitor) adopt(state *instanceState) error {
+	logutils.Notice.Printf("monitor: %s: adopting running virtual machine", state.Name)
+
+	nics := []*NIC{}
+	for _, nic := range state.NICs {
+		if nic == nil {
+			continue
+		}
+		if err := nic.restore(); err != nil {
+			logutils.LogError(err)
+		}
+		nics = append(nics, nic)
+	}
+
+	instance, err := newInstanceFromConfig(m, state.Name, state.Config, nics)
+	if err != nil {
+		return err
+	}
+	instance.pid = state.PID
+	instance.retries = state.Retries
+	instance.startedAt = state.Started
+
+	if err := restoreNICDevices(state.Config, nics); err != nil {
+		logutils.LogError(err)
+	}
+
+	if err := instance.verifyProcess(state.PID); err != nil {
+		logutils.LogError(CleanupNICs(state.Name, nics))
+		logutils.LogError(instance.qmp.Close())
+		logutils.LogError(instance.removeState())
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), adoptTimeout)
+	defer cancel()
+
+	if _, err := instance.qmp.QueryStatus(ctx); err != nil {
+		logutils.Warning.Printf("monitor: %s: QMP socket not responding, adopting anyway: %s",
+			state.Name, err)
+	}
+
+	m.instancesMutex.Lock()
+	if _, ok := m.instances[state.Name]; ok {
+		m.instancesMutex.Unlock()
+		instance.qmp.Close()
+		return fmt.Errorf("monitor: %s: already running", state.Name)
+	}
+	m.instances[state.Name] = instance
+	m.instancesMutex.Unlock()
+
+	go instance.run()
+
+	// the process is already running, so this will just start watching it
+	if err := instance.request(Start, nil); err != nil {
+		return err
+	}
+
+	logutils.Warning.Printf("monitor: %s: adopted (pid %d)", state.Name, state.PID)
+
+	return nil
+}
+
+func (m *Monitor) adoptAll() error {
+	states, err := listStates(m.RuntimeDir)
+	if err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		logutils.LogError(m.adopt(state))
+	}
+
+	return nil
+}
@@ -0,0 +1,320 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+)
+
+const (
+	// USER_HZ, the unit of the cpu times in /proc, is 100 on all the
+	// architectures supported by linux
+	clockTicks = 100
+)
+
+var (
+	statsInterval = 5 * time.Second
+	statsSamples  = 60
+
+	// sampling must not take long, it runs every statsInterval
+	statsTimeout = 2 * time.Second
+
+	sysClassNet = "/sys/class/net"
+)
+
+// NICStats are the counters of the tap device of a nic, from the host side:
+// received bytes were sent by the guest.
+type NICStats struct {
+	Device    string `json:"device" yaml:"device"`
+	RxBytes   int64  `json:"rx_bytes" yaml:"rx_bytes"`
+	TxBytes   int64  `json:"tx_bytes" yaml:"tx_bytes"`
+	RxPackets int64  `json:"rx_packets" yaml:"rx_packets"`
+	TxPackets int64  `json:"tx_packets" yaml:"tx_packets"`
+}
+
+type DriveStats struct {
+	Device     string `json:"device" yaml:"device"`
+	ReadBytes  int64  `json:"read_bytes" yaml:"read_bytes"`
+	WriteBytes int64  `json:"write_bytes" yaml:"write_bytes"`
+	ReadOps    int64  `json:"read_ops" yaml:"read_ops"`
+	WriteOps   int64  `json:"write_ops" yaml:"write_ops"`
+}
+
+// Stats is a sample of the resource usage of a virtual machine. counters are
+// cumulative since the qemu process started. cpu time is in microseconds,
+// sizes in bytes.
+type Stats struct {
+	Time    time.Time     `json:"time" yaml:"time"`
+	CPUTime int64         `json:"cpu_time" yaml:"cpu_time"`
+	RSS     int64         `json:"rss" yaml:"rss"`
+	NICs    []*NICStats   `json:"nics" yaml:"nics"`
+	Drives  []*DriveStats `json:"drives" yaml:"drives"`
+}
+
+// statsRing keeps the last size samples of the qemu process pid. pid is zero
+// while no process is running, and nothing is sampled then.
+type statsRing struct {
+	pid     int
+	size    int
+	samples []*Stats
+	next    int
+}
+
+func (r *statsRing) add(s *Stats) {
+	if len(r.samples) < r.size {
+		r.samples = append(r.samples, s)
+	} else {
+		r.samples[r.next] = s
+	}
+	r.next = (r.next + 1) % r.size
+}
+
+// list returns the samples, oldest first.
+func (r *statsRing) list() []*Stats {
+	if len(r.samples) < r.size {
+		return append([]*Stats{}, r.samples...)
+	}
+	return append(append([]*Stats{}, r.samples[r.next:]...), r.samples[:r.next]...)
+}
+
+// reset must be called from the instance goroutine, that reads the settings.
+func (r *statsRing) reset(pid int) {
+	r.pid = pid
+	r.size = statsSamples
+	r.samples = nil
+	r.next = 0
+}
+
+// processCPUTime returns the user and system cpu time of a process, from
+// /proc/<pid>/stat, in microseconds.
+func processCPUTime(pid int) (int64, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return -1, err
+	}
+
+	// the process name may contain spaces and parenthesis
+	idx := bytes.LastIndexByte(data, ')')
+	if idx < 0 {
+		return -1, fmt.Errorf("monitor: invalid stat file for process %d", pid)
+	}
+
+	// fields after the name start from the 3rd, utime and stime are 14th
+	// and 15th
+	fields := strings.Fields(string(data[idx+1:]))
+	if len(fields) < 13 {
+		return -1, fmt.Errorf("monitor: invalid stat file for process %d", pid)
+	}
+
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return -1, err
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return -1, err
+	}
+
+	return (utime + stime) * (1000000 / clockTicks), nil
+}
+
+// processRSS returns the resident memory of a process, from
+// /proc/<pid>/status, in bytes.
+func processRSS(pid int) (int64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return -1, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "VmRSS:" && fields[2] == "kB" {
+			rss, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return -1, err
+			}
+			return rss * 1024, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return -1, err
+	}
+	return -1, fmt.Errorf("monitor: rss not found for process %d", pid)
+}
+
+func nicStats(device string) (*NICStats, error) {
+	rv := &NICStats{Device: device}
+	for _, c := range []struct {
+		name  string
+		value *int64
+	}{
+		{"rx_bytes", &rv.RxBytes},
+		{"tx_bytes", &rv.TxBytes},
+		{"rx_packets", &rv.RxPackets},
+		{"tx_packets", &rv.TxPackets},
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(sysClassNet, device, "statistics", c.name))
+		if err != nil {
+			return nil, err
+		}
+		if *c.value, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// sampleStats returns a sample of the resource usage of the qemu process. the
+// nics and drives that can't be read are left out of the sample, and the
+// first error is returned with it.
+func (i *Instance) sampleStats(pid int) (*Stats, error) {
+	rv := &Stats{
+		Time:   time.Now(),
+		NICs:   []*NICStats{},
+		Drives: []*DriveStats{},
+	}
+
+	var err error
+	if rv.CPUTime, err = processCPUTime(pid); err != nil {
+		return nil, err
+	}
+	if rv.RSS, err = processRSS(pid); err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	for _, nic := range i.NICs {
+		s, err := nicStats(nic.ID)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		rv.NICs = append(rv.NICs, s)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statsTimeout)
+	defer cancel()
+
+	blocks, err := i.qmp.QueryBlockStats(ctx)
+	if err != nil {
+		if firstErr == nil {
+			firstErr = err
+		}
+		return rv, firstErr
+	}
+	for _, b := range blocks {
+		device := b.Device
+		if device == "" {
+			device = b.QDev
+		}
+		rv.Drives = append(rv.Drives, &DriveStats{
+			Device:     device,
+			ReadBytes:  b.Stats.ReadBytes,
+			WriteBytes: b.Stats.WriteBytes,
+			ReadOps:    b.Stats.ReadOperations,
+			WriteOps:   b.Stats.WriteOperations,
+		})
+	}
+
+	return rv, firstErr
+}
+
+func (i *Instance) collectStats() error {
+	i.mutex.RLock()
+	pid := i.stats.pid
+	i.mutex.RUnlock()
+
+	if pid == 0 {
+		return nil
+	}
+
+	s, err := i.sampleStats(pid)
+	if s != nil {
+		// the process may have been restarted while sampling
+		i.mutex.Lock()
+		if i.stats.pid == pid {
+			i.stats.add(s)
+		}
+		i.mutex.Unlock()
+	}
+
+	return err
+}
+
+// runStats samples the resource usage every interval, until the instance
+// goroutine returns. it runs apart from the instance goroutine, so that a
+// slow sample doesn't delay the operations. an error is only logged when it
+// differs from the previous one.
+func (i *Instance) runStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastErr := ""
+	for {
+		select {
+		case <-ticker.C:
+			err := i.collectStats()
+			if err == nil {
+				lastErr = ""
+				continue
+			}
+			if err.Error() != lastErr {
+				lastErr = err.Error()
+				logutils.LogError(fmt.Errorf("monitor: %s: stats: %s", i.Name, err))
+			}
+
+		case <-i.done:
+			return
+		}
+	}
+}
+
+// Stats returns the resource usage samples of a running virtual machine,
+// oldest first, taken every few seconds, followed by a sample taken now.
+func (m *Monitor) Stats(name string) ([]*Stats, error) {
+	instance, err := m.runningInstance(name)
+	if err != nil {
+		return nil, err
+	}
+
+	instance.mutex.RLock()
+	pid := instance.stats.pid
+	instance.mutex.RUnlock()
+
+	if pid == 0 {
+		return nil, fmt.Errorf("monitor: %q not running", name)
+	}
+
+	s, err := instance.sampleStats(pid)
+	if s == nil {
+		return nil, err
+	}
+	logutils.LogError(err)
+
+	// the collector may have added samples while this one was taken
+	instance.mutex.RLock()
+	rv := []*Stats{}
+	if instance.stats.pid == pid {
+		for _, r := range instance.stats.list() {
+			if r.Time.Before(s.Time) {
+				rv = append(rv, r)
+			}
+		}
+	}
+	instance.mutex.RUnlock()
+
+	return append(rv, s), nil
+}
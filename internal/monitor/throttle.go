@@ -0,0 +1,132 @@
+package monitor
+
+import (
+	"fmt"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+	"github.com/rafaelmartins/simplevirt/internal/qmp"
+)
+
+func newBlockIOThrottle(t *qemu.DriveThrottle) *qmp.BlockIOThrottle {
+	rv := &qmp.BlockIOThrottle{
+		IOPS:         t.IOPS,
+		IOPSRead:     t.IOPSRead,
+		IOPSWrite:    t.IOPSWrite,
+		BPS:          t.BPS,
+		BPSRead:      t.BPSRead,
+		BPSWrite:     t.BPSWrite,
+		IOPSMax:      t.IOPSMax,
+		IOPSReadMax:  t.IOPSReadMax,
+		IOPSWriteMax: t.IOPSWriteMax,
+		BPSMax:       t.BPSMax,
+		BPSReadMax:   t.BPSReadMax,
+		BPSWriteMax:  t.BPSWriteMax,
+	}
+
+	// qemu rejects burst lengths for limits without a burst value
+	if t.BurstLength != 0 {
+		lengths := []struct {
+			max    int64
+			length *int64
+		}{
+			{t.IOPSMax, &rv.IOPSMaxLength},
+			{t.IOPSReadMax, &rv.IOPSReadMaxLength},
+			{t.IOPSWriteMax, &rv.IOPSWriteMaxLength},
+			{t.BPSMax, &rv.BPSMaxLength},
+			{t.BPSReadMax, &rv.BPSReadMaxLength},
+			{t.BPSWriteMax, &rv.BPSWriteMaxLength},
+		}
+		for _, l := range lengths {
+			if l.max != 0 {
+				*l.length = t.BurstLength
+			}
+		}
+	}
+
+	return rv
+}
+
+func newThrottleLimits(t *qemu.DriveThrottle) *qmp.ThrottleLimits {
+	rv := &qmp.ThrottleLimits{
+		IOPSTotal:    t.IOPS,
+		IOPSTotalMax: t.IOPSMax,
+		IOPSRead:     t.IOPSRead,
+		IOPSReadMax:  t.IOPSReadMax,
+		IOPSWrite:    t.IOPSWrite,
+		IOPSWriteMax: t.IOPSWriteMax,
+		BPSTotal:     t.BPS,
+		BPSTotalMax:  t.BPSMax,
+		BPSRead:      t.BPSRead,
+		BPSReadMax:   t.BPSReadMax,
+		BPSWrite:     t.BPSWrite,
+		BPSWriteMax:  t.BPSWriteMax,
+	}
+
+	// 1 is the default burst length of qemu, and the previous one must be
+	// replaced
+	lengths := []struct {
+		max    int64
+		length *int64
+	}{
+		{t.IOPSMax, &rv.IOPSTotalMaxLength},
+		{t.IOPSReadMax, &rv.IOPSReadMaxLength},
+		{t.IOPSWriteMax, &rv.IOPSWriteMaxLength},
+		{t.BPSMax, &rv.BPSTotalMaxLength},
+		{t.BPSReadMax, &rv.BPSReadMaxLength},
+		{t.BPSWriteMax, &rv.BPSWriteMaxLength},
+	}
+	for _, l := range lengths {
+		*l.length = 1
+		if l.max != 0 && t.BurstLength != 0 {
+			*l.length = t.BurstLength
+		}
+	}
+
+	return rv
+}
+
+// setDriveThrottle changes the limits of a drive. -blockdev drives started
+// with limits have a throttle group, the other drives are limited by their
+// block backend.
+func (i *Instance) setDriveThrottle(drive string, throttle *qemu.DriveThrottle) error {
+	idx, drv, err := i.findDrive(drive)
+	if err != nil {
+		return err
+	}
+
+	if group := qemu.DriveThrottleGroup(idx, drv); group != "" {
+		ctx, cancel := qmpContext()
+		defer cancel()
+
+		return i.qmp.QOMSet(ctx, "/objects/"+group, "limits", newThrottleLimits(throttle))
+	}
+
+	args := newBlockIOThrottle(throttle)
+	args.Device, args.ID, err = i.queryDriveTarget(idx, drv)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := qmpContext()
+	defer cancel()
+
+	return i.qmp.BlockSetIOThrottle(ctx, args)
+}
+
+func (m *Monitor) SetDriveThrottle(name string, drive string, throttle *qemu.DriveThrottle) error {
+	logutils.Notice.Printf("monitor: requesting drive throttle: %s: %s", name, drive)
+
+	if err := throttle.Check(); err != nil {
+		return err
+	}
+
+	instance := m.Get(name)
+	if instance == nil || !instance.ProcessRunning() {
+		return fmt.Errorf("monitor: %q not running", name)
+	}
+
+	return instance.call(func() error {
+		return instance.setDriveThrottle(drive, throttle)
+	})
+}
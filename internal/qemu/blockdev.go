@@ -0,0 +1,417 @@
+package qemu
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	scsiController = "scsi0"
+)
+
+var (
+	driveDeviceChoices       = []string{"virtio-blk-pci", "scsi-hd", "ide-hd", "nvme"}
+	driveDiscardChoices      = []string{"ignore", "unmap"}
+	driveDetectZeroesChoices = []string{"off", "on", "unmap"}
+
+	reDriveID = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+)
+
+// DeviceID returns the identifier of the drive, used to name its QEMU
+// device and block nodes. legacy drives without ID are named by QEMU itself.
+func (d *Drive) DeviceID(idx int) string {
+	if d.ID != "" {
+		return d.ID
+	}
+	return fmt.Sprintf("drive%d", idx)
+}
+
+func escapeParam(value string) string {
+	return strings.Replace(value, ",", ",,", -1)
+}
+
+func onOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
+
+// blockCache maps the legacy cache modes to the blockdev cache options and
+// the write-cache property of the device.
+func blockCache(mode string) (direct bool, noFlush bool, writeCache bool) {
+	switch mode {
+	case "writeback":
+		return false, false, true
+	case "unsafe":
+		return false, true, true
+	case "directsync":
+		return true, false, false
+	case "writethrough":
+		return false, false, false
+	}
+	return true, false, true
+}
+
+func validateBlockSize(idx int, name string, size int) error {
+	if size == 0 {
+		return nil
+	}
+	if size < 512 || size > 2*1024*1024 || size&(size-1) != 0 {
+		return fmt.Errorf("qemu: drive[%d].%s: invalid value (%d). must be a power of 2 between 512 and 2097152", idx, name, size)
+	}
+	return nil
+}
+
+func validateDriveCommon(idx int, drv *Drive) error {
+	if drv.ID != "" && !reDriveID.MatchString(drv.ID) {
+		return fmt.Errorf("qemu: drive[%d].id: invalid value (%s)", idx, drv.ID)
+	}
+
+	if _, err := appendParam("discard", drv.Discard, "", driveDiscardChoices, fmt.Sprintf("drive[%d].discard", idx)); err != nil {
+		return err
+	}
+
+	if _, err := appendParam("detect-zeroes", drv.DetectZeroes, "", driveDetectZeroesChoices, fmt.Sprintf("drive[%d].detect_zeroes", idx)); err != nil {
+		return err
+	}
+
+	if drv.DetectZeroes == "unmap" && drv.Discard != "unmap" {
+		return fmt.Errorf("qemu: drive[%d].detect_zeroes: 'unmap' requires discard: unmap", idx)
+	}
+
+	return nil
+}
+
+// validateDriveLegacy rejects the options that can only be expressed with
+// the -blockdev/-device syntax.
+func validateDriveLegacy(idx int, drv *Drive) error {
+	if drv.IOThread {
+		return fmt.Errorf("qemu: drive[%d].iothread: requires device", idx)
+	}
+	if drv.Serial != "" {
+		return fmt.Errorf("qemu: drive[%d].serial: requires device", idx)
+	}
+	if drv.BootIndex != nil {
+		return fmt.Errorf("qemu: drive[%d].bootindex: requires device", idx)
+	}
+	if drv.LogicalBlockSize != 0 {
+		return fmt.Errorf("qemu: drive[%d].logical_block_size: requires device", idx)
+	}
+	if drv.PhysicalBlockSize != 0 {
+		return fmt.Errorf("qemu: drive[%d].physical_block_size: requires device", idx)
+	}
+	return nil
+}
+
+// blockdevGraph is the -blockdev nodes and the -device frontend of a drive.
+type blockdevGraph struct {
+	nodes         []params
+	iothread      string
+	throttleGroup params
+	device        params
+}
+
+func newBlockdevGraph(idx int, drv *Drive) (*blockdevGraph, error) {
+	if _, err := appendParam("device", drv.Device, "", driveDeviceChoices, fmt.Sprintf("drive[%d].device", idx)); err != nil {
+		return nil, err
+	}
+
+	if drv.Interface != "" {
+		return nil, fmt.Errorf("qemu: drive[%d].interface: can't be used with device", idx)
+	}
+	if drv.Snapshot {
+		return nil, fmt.Errorf("qemu: drive[%d].snapshot: can't be used with device", idx)
+	}
+
+	// blockdev never probes the image format
+	if drv.Format == "" {
+		return nil, fmt.Errorf("qemu: drive[%d].format: parameter is required with device", idx)
+	}
+	if _, err := appendParam("format", drv.Format, "", driveFormatChoices, fmt.Sprintf("drive[%d].format", idx)); err != nil {
+		return nil, err
+	}
+	if _, err := appendParam("media", drv.Media, "", driveMediaChoices, fmt.Sprintf("drive[%d].media", idx)); err != nil {
+		return nil, err
+	}
+	if _, err := appendParam("cache", drv.Cache, "", driveCacheChoices, fmt.Sprintf("drive[%d].cache", idx)); err != nil {
+		return nil, err
+	}
+
+	if err := validateBlockSize(idx, "logical_block_size", drv.LogicalBlockSize); err != nil {
+		return nil, err
+	}
+	if err := validateBlockSize(idx, "physical_block_size", drv.PhysicalBlockSize); err != nil {
+		return nil, err
+	}
+	if drv.LogicalBlockSize != 0 && drv.PhysicalBlockSize != 0 && drv.PhysicalBlockSize < drv.LogicalBlockSize {
+		return nil, fmt.Errorf("qemu: drive[%d].physical_block_size: must not be smaller than logical_block_size", idx)
+	}
+
+	device := drv.Device
+	cdrom := drv.Media == "cdrom"
+	if cdrom {
+		switch device {
+		case "scsi-hd":
+			device = "scsi-cd"
+		case "ide-hd":
+			device = "ide-cd"
+		default:
+			return nil, fmt.Errorf("qemu: drive[%d].media: 'cdrom' is not supported by %s", idx, device)
+		}
+	}
+
+	if drv.IOThread && device != "virtio-blk-pci" && device != "scsi-hd" && device != "scsi-cd" {
+		return nil, fmt.Errorf("qemu: drive[%d].iothread: not supported by %s", idx, device)
+	}
+
+	// changing the media replaces the nodes, including the throttle filter
+	if cdrom && drv.Throttle.Enabled() {
+		return nil, fmt.Errorf("qemu: drive[%d].throttle: not supported by cdrom drives with device", idx)
+	}
+
+	id := drv.DeviceID(idx)
+	direct, noFlush, writeCache := blockCache(drv.Cache)
+
+	rv := &blockdevGraph{}
+
+	// empty cdrom drives have no nodes, until media is inserted
+	if drv.File != "" {
+		// protocol node
+		driver := "file"
+		if strings.HasPrefix(drv.File, "/dev/") {
+			driver = "host_device"
+			if cdrom {
+				driver = "host_cdrom"
+			}
+		}
+		node := params{
+			{"driver", driver},
+			{"node-name", id + "-file"},
+			{"filename", drv.File},
+			{"cache.direct", direct},
+			{"cache.no-flush", noFlush},
+		}
+		if drv.Discard != "" {
+			node = append(node, &param{"discard", drv.Discard})
+		}
+		if cdrom {
+			node = append(node, &param{"read-only", true})
+		}
+		rv.nodes = append(rv.nodes, node)
+
+		// format node
+		node = params{
+			{"driver", drv.Format},
+			{"node-name", id + "-format"},
+			{"file", id + "-file"},
+			{"cache.direct", direct},
+			{"cache.no-flush", noFlush},
+		}
+		if drv.Discard != "" {
+			node = append(node, &param{"discard", drv.Discard})
+		}
+		if drv.DetectZeroes != "" {
+			node = append(node, &param{"detect-zeroes", drv.DetectZeroes})
+		}
+		if cdrom {
+			node = append(node, &param{"read-only", true})
+		}
+		rv.nodes = append(rv.nodes, node)
+
+		// throttle filter node
+		if group := DriveThrottleGroup(idx, drv); group != "" {
+			rv.throttleGroup = throttleGroupParams(group, &drv.Throttle)
+			rv.nodes = append(rv.nodes, params{
+				{"driver", "throttle"},
+				{"node-name", id + "-throttle"},
+				{"throttle-group", group},
+				{"file", id + "-format"},
+			})
+		}
+	}
+
+	// frontend
+	rv.iothread = DriveIOThread(idx, drv)
+
+	rv.device = params{
+		{"driver", device},
+		{"id", id},
+	}
+	if drv.File != "" {
+		rv.device = append(rv.device, &param{"drive", DriveNodeNames(idx, drv)[0]})
+	}
+	if device == "scsi-hd" || device == "scsi-cd" {
+		rv.device = append(rv.device, &param{"bus", scsiController + ".0"})
+	}
+	if rv.iothread != "" {
+		rv.device = append(rv.device, &param{"iothread", rv.iothread})
+	}
+	if !cdrom {
+		// write-cache is an on/off/auto property, not a boolean
+		rv.device = append(rv.device, &param{"write-cache", onOff(writeCache)})
+	}
+
+	serial := drv.Serial
+	if serial == "" && device == "nvme" {
+		serial = id
+	}
+	if serial != "" {
+		rv.device = append(rv.device, &param{"serial", serial})
+	}
+
+	if drv.BootIndex != nil {
+		rv.device = append(rv.device, &param{"bootindex", *drv.BootIndex})
+	}
+	if drv.LogicalBlockSize != 0 {
+		rv.device = append(rv.device, &param{"logical_block_size", drv.LogicalBlockSize})
+	}
+	if drv.PhysicalBlockSize != 0 {
+		rv.device = append(rv.device, &param{"physical_block_size", drv.PhysicalBlockSize})
+	}
+
+	return rv, nil
+}
+
+func buildCmdBlockdev(idx int, drv *Drive) ([]string, error) {
+	graph, err := newBlockdevGraph(idx, drv)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []string{}
+	if graph.throttleGroup != nil {
+		rv = append(rv, "-object", graph.throttleGroup.String())
+	}
+	for _, node := range graph.nodes {
+		rv = append(rv, "-blockdev", node.String())
+	}
+	if graph.iothread != "" {
+		rv = append(rv, "-object", fmt.Sprintf("iothread,id=%s", graph.iothread))
+	}
+	rv = append(rv, "-device", graph.device.String())
+
+	return rv, nil
+}
+
+// DriveHotplug holds the arguments of the QMP commands that attach a drive
+// to a running virtual machine: object-add for the iothread and the throttle
+// group, if any, blockdev-add for each node, and device_add.
+type DriveHotplug struct {
+	IOThread      string
+	ThrottleGroup map[string]interface{}
+	Blockdevs     []map[string]interface{}
+	Device        map[string]interface{}
+}
+
+// NewDriveHotplug validates a drive to be attached as drive number idx of
+// a virtual machine that already has drives.
+func NewDriveHotplug(idx int, drv *Drive, drives []*Drive) (*DriveHotplug, error) {
+	if drv.Device == "" {
+		return nil, fmt.Errorf("qemu: drive[%d].device: parameter is required for hotplug", idx)
+	}
+	if drv.Device == "ide-hd" {
+		return nil, fmt.Errorf("qemu: drive[%d].device: ide-hd does not support hotplug", idx)
+	}
+
+	if drv.Device == "scsi-hd" {
+		if len(buildCmdSCSIController(drives)) == 0 {
+			return nil, fmt.Errorf("qemu: drive[%d].device: virtual machine has no scsi controller", idx)
+		}
+		if drv.IOThread {
+			return nil, fmt.Errorf("qemu: drive[%d].iothread: scsi drives use the iothread of the controller", idx)
+		}
+	}
+
+	for i, d := range drives {
+		if d != nil && d.DeviceID(i+1) == drv.DeviceID(idx) {
+			return nil, fmt.Errorf("qemu: drive[%d].id: duplicated value (%s)", idx, drv.DeviceID(idx))
+		}
+	}
+
+	// same validation as when starting
+	if _, err := buildCmdDrive(idx, drv); err != nil {
+		return nil, err
+	}
+	if err := checkDriveImage(idx, drv); err != nil {
+		return nil, err
+	}
+
+	graph, err := newBlockdevGraph(idx, drv)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &DriveHotplug{
+		IOThread:  graph.iothread,
+		Blockdevs: []map[string]interface{}{},
+		Device:    graph.device.Map(),
+	}
+	for _, node := range graph.nodes {
+		rv.Blockdevs = append(rv.Blockdevs, node.Map())
+	}
+	if graph.throttleGroup != nil {
+		// object-add takes the type of the object as qom-type
+		rv.ThrottleGroup = graph.throttleGroup.Map()
+		rv.ThrottleGroup["qom-type"] = rv.ThrottleGroup["driver"]
+		delete(rv.ThrottleGroup, "driver")
+	}
+
+	return rv, nil
+}
+
+// DriveNodeNames returns the names of the block nodes of a -blockdev drive,
+// from top to bottom, as they must be removed.
+func DriveNodeNames(idx int, drv *Drive) []string {
+	id := drv.DeviceID(idx)
+	if DriveThrottleGroup(idx, drv) != "" {
+		return []string{id + "-throttle", id + "-format", id + "-file"}
+	}
+	return []string{id + "-format", id + "-file"}
+}
+
+// DriveThrottleGroup returns the id of the throttle-group object of a
+// -blockdev drive with I/O limits, if any. its throttle filter node is the
+// top node of the drive.
+func DriveThrottleGroup(idx int, drv *Drive) string {
+	if drv.Device != "" && drv.File != "" && drv.Throttle.Enabled() {
+		return drv.DeviceID(idx) + "-throttle-group"
+	}
+	return ""
+}
+
+// DriveIOThread returns the id of the iothread object dedicated to a
+// -blockdev drive, if any. scsi drives share the iothread of the controller.
+func DriveIOThread(idx int, drv *Drive) string {
+	if drv.IOThread && drv.Device == "virtio-blk-pci" {
+		return drv.DeviceID(idx) + "-iothread"
+	}
+	return ""
+}
+
+// buildCmdSCSIController returns the virtio-scsi controller shared by all
+// the scsi drives, if any.
+func buildCmdSCSIController(drvs []*Drive) []string {
+	found := false
+	iothread := false
+	for _, drv := range drvs {
+		if drv != nil && drv.Device == "scsi-hd" {
+			found = true
+			iothread = iothread || drv.IOThread
+		}
+	}
+
+	if !found {
+		return []string{}
+	}
+
+	if iothread {
+		return []string{
+			"-object", fmt.Sprintf("iothread,id=%s-iothread", scsiController),
+			"-device", fmt.Sprintf("virtio-scsi-pci,id=%s,iothread=%s-iothread", scsiController, scsiController),
+		}
+	}
+
+	return []string{"-device", fmt.Sprintf("virtio-scsi-pci,id=%s", scsiController)}
+}
@@ -0,0 +1,259 @@
+package qemu
+
+import (
+	"testing"
+
+	. "github.com/rafaelmartins/simplevirt/internal/testutils"
+)
+
+func TestBuildCmdDriveLegacyOptions(t *testing.T) {
+	val, err := buildCmdDrive(1, &Drive{
+		File:         "/foo.img",
+		ID:           "root",
+		Discard:      "unmap",
+		DetectZeroes: "unmap",
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-drive", "file=/foo.img,if=virtio,media=disk,cache=none,id=root,discard=unmap,detect-zeroes=unmap",
+	})
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.img", ID: "1root"})
+	AssertError(t, err, "qemu: drive[1].id: invalid value (1root)")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.img", Discard: "bola"})
+	AssertError(t, err, "qemu: drive[1].discard: invalid value (bola). valid choices are: 'ignore', 'unmap'")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.img", DetectZeroes: "unmap"})
+	AssertError(t, err, "qemu: drive[1].detect_zeroes: 'unmap' requires discard: unmap")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.img", Serial: "bola"})
+	AssertError(t, err, "qemu: drive[1].serial: requires device")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.img", IOThread: true})
+	AssertError(t, err, "qemu: drive[1].iothread: requires device")
+	AssertEqual(t, val, n)
+}
+
+func TestBuildCmdBlockdev(t *testing.T) {
+	val, err := buildCmdDrive(1, &Drive{File: "/foo.img", Device: "bola"})
+	AssertError(t, err, "qemu: drive[1].device: invalid value (bola). valid choices are: 'virtio-blk-pci', 'scsi-hd', 'ide-hd', 'nvme'")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.img", Device: "virtio-blk-pci"})
+	AssertError(t, err, "qemu: drive[1].format: parameter is required with device")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.img", Device: "virtio-blk-pci", Format: "raw", Interface: "ide"})
+	AssertError(t, err, "qemu: drive[1].interface: can't be used with device")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.img", Device: "virtio-blk-pci", Format: "raw", Snapshot: true})
+	AssertError(t, err, "qemu: drive[1].snapshot: can't be used with device")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.img", Device: "nvme", Format: "raw", IOThread: true})
+	AssertError(t, err, "qemu: drive[1].iothread: not supported by nvme")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.iso", Device: "virtio-blk-pci", Format: "raw", Media: "cdrom"})
+	AssertError(t, err, "qemu: drive[1].media: 'cdrom' is not supported by virtio-blk-pci")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.img", Device: "virtio-blk-pci", Format: "raw", LogicalBlockSize: 1000})
+	AssertError(t, err, "qemu: drive[1].logical_block_size: invalid value (1000). must be a power of 2 between 512 and 2097152")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.img", Device: "virtio-blk-pci", Format: "raw", LogicalBlockSize: 4096, PhysicalBlockSize: 512})
+	AssertError(t, err, "qemu: drive[1].physical_block_size: must not be smaller than logical_block_size")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo,img", Device: "virtio-blk-pci", Format: "qcow2"})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-blockdev", "driver=file,node-name=drive1-file,filename=/foo,,img,cache.direct=on,cache.no-flush=off",
+		"-blockdev", "driver=qcow2,node-name=drive1-format,file=drive1-file,cache.direct=on,cache.no-flush=off",
+		"-device", "virtio-blk-pci,id=drive1,drive=drive1-format,write-cache=on",
+	})
+
+	bootIndex := 0
+	val, err = buildCmdDrive(2, &Drive{
+		File:              "/dev/vg0/root",
+		ID:                "root",
+		Device:            "virtio-blk-pci",
+		Format:            "raw",
+		Cache:             "writethrough",
+		Discard:           "unmap",
+		DetectZeroes:      "unmap",
+		IOThread:          true,
+		Serial:            "ROOT,1",
+		BootIndex:         &bootIndex,
+		LogicalBlockSize:  512,
+		PhysicalBlockSize: 4096,
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-blockdev", "driver=host_device,node-name=root-file,filename=/dev/vg0/root,cache.direct=off,cache.no-flush=off,discard=unmap",
+		"-blockdev", "driver=raw,node-name=root-format,file=root-file,cache.direct=off,cache.no-flush=off,discard=unmap,detect-zeroes=unmap",
+		"-object", "iothread,id=root-iothread",
+		"-device", "virtio-blk-pci,id=root,drive=root-format,iothread=root-iothread,write-cache=off,serial=ROOT,,1,bootindex=0,logical_block_size=512,physical_block_size=4096",
+	})
+
+	val, err = buildCmdDrive(3, &Drive{File: "/foo.iso", Device: "scsi-hd", Format: "raw", Media: "cdrom"})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-blockdev", "driver=file,node-name=drive3-file,filename=/foo.iso,cache.direct=on,cache.no-flush=off,read-only=on",
+		"-blockdev", "driver=raw,node-name=drive3-format,file=drive3-file,cache.direct=on,cache.no-flush=off,read-only=on",
+		"-device", "scsi-cd,id=drive3,drive=drive3-format,bus=scsi0.0",
+	})
+
+	val, err = buildCmdDrive(1, &Drive{File: "/foo.img", Device: "nvme", Format: "raw", Cache: "unsafe"})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-blockdev", "driver=file,node-name=drive1-file,filename=/foo.img,cache.direct=off,cache.no-flush=on",
+		"-blockdev", "driver=raw,node-name=drive1-format,file=drive1-file,cache.direct=off,cache.no-flush=on",
+		"-device", "nvme,id=drive1,drive=drive1-format,write-cache=on,serial=drive1",
+	})
+}
+
+func TestBuildCmdDrivesBlockdev(t *testing.T) {
+	val, err := buildCmdDrives([]*Drive{
+		&Drive{File: "/foo.img"},
+		&Drive{File: "/bar.img", Device: "scsi-hd", Format: "raw", IOThread: true},
+		&Drive{File: "/baz.img", Device: "ide-hd", Format: "raw"},
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-object", "iothread,id=scsi0-iothread",
+		"-device", "virtio-scsi-pci,id=scsi0,iothread=scsi0-iothread",
+		"-drive", "file=/foo.img,if=virtio,media=disk,cache=none",
+		"-blockdev", "driver=file,node-name=drive2-file,filename=/bar.img,cache.direct=on,cache.no-flush=off",
+		"-blockdev", "driver=raw,node-name=drive2-format,file=drive2-file,cache.direct=on,cache.no-flush=off",
+		"-device", "scsi-hd,id=drive2,drive=drive2-format,bus=scsi0.0,write-cache=on",
+		"-blockdev", "driver=file,node-name=drive3-file,filename=/baz.img,cache.direct=on,cache.no-flush=off",
+		"-blockdev", "driver=raw,node-name=drive3-format,file=drive3-file,cache.direct=on,cache.no-flush=off",
+		"-device", "ide-hd,id=drive3,drive=drive3-format,write-cache=on",
+	})
+
+	val, err = buildCmdDrives([]*Drive{
+		&Drive{File: "/foo.img", Device: "scsi-hd", Format: "raw"},
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val[:2], []string{"-device", "virtio-scsi-pci,id=scsi0"})
+
+	val, err = buildCmdDrives([]*Drive{
+		&Drive{File: "/foo.img", Device: "ide-hd", Format: "raw"},
+		&Drive{File: "/bar.img", Device: "ide-hd", Format: "raw", ID: "drive1"},
+	})
+	AssertError(t, err, "qemu: drive[2].id: duplicated value (drive1)")
+	AssertEqual(t, val, n)
+}
+
+func TestNewDriveHotplug(t *testing.T) {
+	drives := []*Drive{
+		{File: "/dev/null"},
+		{File: "/dev/null", ID: "data", Device: "virtio-blk-pci", Format: "raw"},
+	}
+
+	val, err := NewDriveHotplug(3, &Drive{File: "/dev/zero", Device: "virtio-blk-pci", Format: "raw", IOThread: true, Cache: "writeback"}, drives)
+	AssertNonError(t, err)
+	AssertEqual(t, val, &DriveHotplug{
+		IOThread: "drive3-iothread",
+		Blockdevs: []map[string]interface{}{
+			{
+				"driver":    "host_device",
+				"node-name": "drive3-file",
+				"filename":  "/dev/zero",
+				"cache":     map[string]interface{}{"direct": false, "no-flush": false},
+			},
+			{
+				"driver":    "raw",
+				"node-name": "drive3-format",
+				"file":      "drive3-file",
+				"cache":     map[string]interface{}{"direct": false, "no-flush": false},
+			},
+		},
+		Device: map[string]interface{}{
+			"driver":      "virtio-blk-pci",
+			"id":          "drive3",
+			"drive":       "drive3-format",
+			"iothread":    "drive3-iothread",
+			"write-cache": "on",
+		},
+	})
+	AssertEqual(t, DriveNodeNames(3, &Drive{}), []string{"drive3-format", "drive3-file"})
+
+	val, err = NewDriveHotplug(3, &Drive{File: "/dev/zero", Device: "nvme", Format: "raw", Throttle: DriveThrottle{IOPS: 100}}, drives)
+	AssertNonError(t, err)
+	AssertEqual(t, val.ThrottleGroup, map[string]interface{}{
+		"qom-type":     "throttle-group",
+		"id":           "drive3-throttle-group",
+		"x-iops-total": int64(100),
+	})
+	AssertEqual(t, val.Blockdevs[2], map[string]interface{}{
+		"driver":         "throttle",
+		"node-name":      "drive3-throttle",
+		"throttle-group": "drive3-throttle-group",
+		"file":           "drive3-format",
+	})
+	AssertEqual(t, val.Device["drive"], "drive3-throttle")
+	drv := &Drive{File: "/dev/zero", Device: "nvme", Throttle: DriveThrottle{IOPS: 100}}
+	AssertEqual(t, DriveNodeNames(3, drv), []string{"drive3-throttle", "drive3-format", "drive3-file"})
+	AssertEqual(t, DriveThrottleGroup(3, drv), "drive3-throttle-group")
+	AssertEqual(t, DriveThrottleGroup(3, &Drive{File: "/dev/zero", Throttle: DriveThrottle{IOPS: 100}}), "")
+
+	val, err = NewDriveHotplug(3, &Drive{File: "/dev/zero"}, drives)
+	AssertError(t, err, "qemu: drive[3].device: parameter is required for hotplug")
+	AssertEqual(t, val, (*DriveHotplug)(nil))
+
+	val, err = NewDriveHotplug(3, &Drive{File: "/dev/zero", Device: "ide-hd", Format: "raw"}, drives)
+	AssertError(t, err, "qemu: drive[3].device: ide-hd does not support hotplug")
+	AssertEqual(t, val, (*DriveHotplug)(nil))
+
+	val, err = NewDriveHotplug(3, &Drive{File: "/dev/zero", Device: "scsi-hd", Format: "raw"}, drives)
+	AssertError(t, err, "qemu: drive[3].device: virtual machine has no scsi controller")
+	AssertEqual(t, val, (*DriveHotplug)(nil))
+
+	val, err = NewDriveHotplug(3, &Drive{File: "/dev/zero", ID: "data", Device: "nvme", Format: "raw"}, drives)
+	AssertError(t, err, "qemu: drive[3].id: duplicated value (data)")
+	AssertEqual(t, val, (*DriveHotplug)(nil))
+
+	val, err = NewDriveHotplug(3, &Drive{File: "/bola.img", Device: "nvme", Format: "raw"}, drives)
+	AssertError(t, err, "qemu: drive[3].file: file not found: /bola.img")
+	AssertEqual(t, val, (*DriveHotplug)(nil))
+
+	drives = append(drives, &Drive{File: "/dev/null", Device: "scsi-hd", Format: "raw"})
+	val, err = NewDriveHotplug(4, &Drive{File: "/dev/zero", Device: "scsi-hd", Format: "raw"}, drives)
+	AssertNonError(t, err)
+	AssertEqual(t, val.IOThread, "")
+	AssertEqual(t, val.Device["bus"], "scsi0.0")
+}
+
+func TestParams(t *testing.T) {
+	p := params{
+		{"driver", "file"},
+		{"node-name", "foo"},
+		{"filename", "/foo,bar.img"},
+		{"cache.direct", true},
+		{"cache.no-flush", false},
+	}
+	AssertEqual(t, p.String(), "driver=file,node-name=foo,filename=/foo,,bar.img,cache.direct=on,cache.no-flush=off")
+	AssertEqual(t, p.Map(), map[string]interface{}{
+		"driver":    "file",
+		"node-name": "foo",
+		"filename":  "/foo,bar.img",
+		"cache":     map[string]interface{}{"direct": true, "no-flush": false},
+	})
+
+	p = params{
+		{"driver", "virtio-blk-pci"},
+		{"id", "foo"},
+		{"bootindex", 1},
+	}
+	AssertEqual(t, p.String(), "virtio-blk-pci,id=foo,bootindex=1")
+	AssertEqual(t, p.Map(), map[string]interface{}{"driver": "virtio-blk-pci", "id": "foo", "bootindex": 1})
+}
@@ -0,0 +1,178 @@
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+var (
+	reCgroupCPUMax = regexp.MustCompile(`^(max|[0-9]+)( [0-9]+)?$`)
+	reDeviceNumber = regexp.MustCompile(`^[0-9]+:[0-9]+$`)
+)
+
+// IOLimit limits the bytes and operations per second a virtual machine can
+// read from and write to a host block device, by path or MAJOR:MINOR. zero
+// means unlimited.
+type IOLimit struct {
+	Device    string `yaml:"device" json:"device"`
+	ReadBPS   int64  `yaml:"rbps" json:"rbps"`
+	WriteBPS  int64  `yaml:"wbps" json:"wbps"`
+	ReadIOPS  int64  `yaml:"riops" json:"riops"`
+	WriteIOPS int64  `yaml:"wiops" json:"wiops"`
+}
+
+// CgroupLimits are the resource limits of the cgroup v2 of a virtual machine.
+// cpu_max uses the cgroup syntax ("$MAX $PERIOD", in microseconds), and
+// memory_max the same format as ram. zero values aren't limited, and a zero
+// cpu_weight is unset, keeping the cgroup default (100).
+type CgroupLimits struct {
+	CPUMax    string     `yaml:"cpu_max" json:"cpu_max"`
+	CPUWeight int        `yaml:"cpu_weight" json:"cpu_weight"`
+	MemoryMax string     `yaml:"memory_max" json:"memory_max"`
+	IOMax     []*IOLimit `yaml:"io_max" json:"io_max"`
+	PIDsMax   int        `yaml:"pids_max" json:"pids_max"`
+}
+
+// CgroupFile is a cgroup interface file, and the value to write to it.
+type CgroupFile struct {
+	Name  string
+	Value string
+}
+
+// Enabled returns true if any limit is set.
+func (c *CgroupLimits) Enabled() bool {
+	return c.CPUMax != "" || c.CPUWeight != 0 || c.MemoryMax != "" || len(c.IOMax) > 0 || c.PIDsMax != 0
+}
+
+func validateCgroup(vm *VirtualMachine) error {
+	c := vm.Cgroup
+
+	if c.CPUMax != "" && !reCgroupCPUMax.MatchString(c.CPUMax) {
+		return fmt.Errorf("qemu: cgroup.cpu_max: invalid value (%s)", c.CPUMax)
+	}
+	if c.CPUWeight < 0 || c.CPUWeight > 10000 {
+		return fmt.Errorf("qemu: cgroup.cpu_weight: invalid value (%d). must be between 1 and 10000, or 0 for the default", c.CPUWeight)
+	}
+	if c.MemoryMax != "" && !reRAM.MatchString(c.MemoryMax) {
+		return fmt.Errorf("qemu: cgroup.memory_max: invalid RAM size (%s)", c.MemoryMax)
+	}
+	if c.PIDsMax < 0 {
+		return fmt.Errorf("qemu: cgroup.pids_max: invalid value (%d)", c.PIDsMax)
+	}
+
+	for i, l := range c.IOMax {
+		field := fmt.Sprintf("cgroup.io_max[%d]", i+1)
+		if l == nil {
+			return fmt.Errorf("qemu: %s: not defined", field)
+		}
+		if l.Device == "" {
+			return fmt.Errorf("qemu: %s.device: required", field)
+		}
+		if !strings.HasPrefix(l.Device, "/") && !reDeviceNumber.MatchString(l.Device) {
+			return fmt.Errorf("qemu: %s.device: invalid value (%s). must be an absolute path or MAJOR:MINOR", field, l.Device)
+		}
+		for _, v := range []struct {
+			name  string
+			value int64
+		}{
+			{"rbps", l.ReadBPS},
+			{"wbps", l.WriteBPS},
+			{"riops", l.ReadIOPS},
+			{"wiops", l.WriteIOPS},
+		} {
+			if v.value < 0 {
+				return fmt.Errorf("qemu: %s.%s: invalid value (%d)", field, v.name, v.value)
+			}
+		}
+	}
+
+	return nil
+}
+
+// deviceNumber returns the MAJOR:MINOR of a block device.
+func deviceNumber(device string) (string, error) {
+	if reDeviceNumber.MatchString(device) {
+		return device, nil
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(device, &st); err != nil {
+		return "", &os.PathError{Op: "stat", Path: device, Err: err}
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return "", fmt.Errorf("not a block device (%s)", device)
+	}
+
+	rdev := uint64(st.Rdev)
+	major := ((rdev >> 8) & 0xfff) | ((rdev >> 32) &^ 0xfff)
+	minor := (rdev & 0xff) | ((rdev >> 12) &^ 0xff)
+	return fmt.Sprintf("%d:%d", major, minor), nil
+}
+
+// CgroupFiles returns the cgroup interface files to write to apply the
+// limits of the virtual machine. limits not set are reset to their defaults.
+func (vm *VirtualMachine) CgroupFiles() ([]*CgroupFile, error) {
+	if err := validateCgroup(vm); err != nil {
+		return nil, err
+	}
+
+	c := vm.Cgroup
+
+	cpuMax := "max"
+	if c.CPUMax != "" {
+		cpuMax = c.CPUMax
+	}
+	cpuWeight := "100"
+	if c.CPUWeight != 0 {
+		cpuWeight = fmt.Sprintf("%d", c.CPUWeight)
+	}
+	memoryMax := "max"
+	if c.MemoryMax != "" {
+		size, err := ParseRAM(c.MemoryMax)
+		if err != nil {
+			return nil, err
+		}
+		memoryMax = fmt.Sprintf("%d", size)
+	}
+	pidsMax := "max"
+	if c.PIDsMax != 0 {
+		pidsMax = fmt.Sprintf("%d", c.PIDsMax)
+	}
+
+	rv := []*CgroupFile{
+		{"cpu.max", cpuMax},
+		{"cpu.weight", cpuWeight},
+		{"memory.max", memoryMax},
+		{"pids.max", pidsMax},
+	}
+
+	for i, l := range c.IOMax {
+		dev, err := deviceNumber(l.Device)
+		if err != nil {
+			return nil, fmt.Errorf("qemu: cgroup.io_max[%d].device: %s", i+1, err)
+		}
+
+		value := dev
+		for _, v := range []struct {
+			name  string
+			value int64
+		}{
+			{"rbps", l.ReadBPS},
+			{"wbps", l.WriteBPS},
+			{"riops", l.ReadIOPS},
+			{"wiops", l.WriteIOPS},
+		} {
+			if v.value > 0 {
+				value += fmt.Sprintf(" %s=%d", v.name, v.value)
+			} else {
+				value += fmt.Sprintf(" %s=max", v.name)
+			}
+		}
+		rv = append(rv, &CgroupFile{"io.max", value})
+	}
+
+	return rv, nil
+}
@@ -0,0 +1,75 @@
+package qemu
+
+import (
+	"testing"
+
+	. "github.com/rafaelmartins/simplevirt/internal/testutils"
+)
+
+func TestCgroupFiles(t *testing.T) {
+	vm := &VirtualMachine{}
+	AssertEqual(t, vm.Cgroup.Enabled(), false)
+
+	files, err := vm.CgroupFiles()
+	AssertNonError(t, err)
+	AssertEqual(t, files, []*CgroupFile{
+		{"cpu.max", "max"},
+		{"cpu.weight", "100"},
+		{"memory.max", "max"},
+		{"pids.max", "max"},
+	})
+
+	vm = &VirtualMachine{
+		Cgroup: CgroupLimits{
+			CPUMax:    "150000 100000",
+			CPUWeight: 200,
+			MemoryMax: "1.5G",
+			PIDsMax:   64,
+			IOMax: []*IOLimit{
+				{Device: "8:0", ReadBPS: 1048576, WriteIOPS: 100},
+			},
+		},
+	}
+	AssertEqual(t, vm.Cgroup.Enabled(), true)
+
+	files, err = vm.CgroupFiles()
+	AssertNonError(t, err)
+	AssertEqual(t, files, []*CgroupFile{
+		{"cpu.max", "150000 100000"},
+		{"cpu.weight", "200"},
+		{"memory.max", "1610612736"},
+		{"pids.max", "64"},
+		{"io.max", "8:0 rbps=1048576 wbps=max riops=max wiops=100"},
+	})
+
+	_, err = (&VirtualMachine{Cgroup: CgroupLimits{IOMax: []*IOLimit{{Device: "/dev/null"}}}}).CgroupFiles()
+	AssertError(t, err, "qemu: cgroup.io_max[1].device: not a block device (/dev/null)")
+
+	_, err = (&VirtualMachine{Cgroup: CgroupLimits{IOMax: []*IOLimit{{Device: "/dev/bola"}}}}).CgroupFiles()
+	AssertError(t, err, "qemu: cgroup.io_max[1].device: stat /dev/bola: no such file or directory")
+}
+
+func TestValidateCgroup(t *testing.T) {
+	AssertNonError(t, validateCgroup(&VirtualMachine{Cgroup: CgroupLimits{CPUMax: "max 100000"}}))
+	AssertNonError(t, validateCgroup(&VirtualMachine{Cgroup: CgroupLimits{CPUMax: "50000"}}))
+	AssertNonError(t, validateCgroup(&VirtualMachine{Cgroup: CgroupLimits{CPUWeight: 0}}))
+	AssertNonError(t, validateCgroup(&VirtualMachine{Cgroup: CgroupLimits{CPUWeight: 1}}))
+	AssertNonError(t, validateCgroup(&VirtualMachine{Cgroup: CgroupLimits{CPUWeight: 10000}}))
+
+	for _, tc := range []struct {
+		cgroup CgroupLimits
+		err    string
+	}{
+		{CgroupLimits{CPUMax: "50%"}, "qemu: cgroup.cpu_max: invalid value (50%)"},
+		{CgroupLimits{CPUWeight: -1}, "qemu: cgroup.cpu_weight: invalid value (-1). must be between 1 and 10000, or 0 for the default"},
+		{CgroupLimits{CPUWeight: 10001}, "qemu: cgroup.cpu_weight: invalid value (10001). must be between 1 and 10000, or 0 for the default"},
+		{CgroupLimits{MemoryMax: "1T"}, "qemu: cgroup.memory_max: invalid RAM size (1T)"},
+		{CgroupLimits{PIDsMax: -1}, "qemu: cgroup.pids_max: invalid value (-1)"},
+		{CgroupLimits{IOMax: []*IOLimit{nil}}, "qemu: cgroup.io_max[1]: not defined"},
+		{CgroupLimits{IOMax: []*IOLimit{{}}}, "qemu: cgroup.io_max[1].device: required"},
+		{CgroupLimits{IOMax: []*IOLimit{{Device: "sda"}}}, "qemu: cgroup.io_max[1].device: invalid value (sda). must be an absolute path or MAJOR:MINOR"},
+		{CgroupLimits{IOMax: []*IOLimit{{Device: "8:0", WriteBPS: -1}}}, "qemu: cgroup.io_max[1].wbps: invalid value (-1)"},
+	} {
+		AssertError(t, validateCgroup(&VirtualMachine{Cgroup: tc.cgroup}), tc.err)
+	}
+}
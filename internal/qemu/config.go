@@ -8,14 +8,23 @@ import (
 	"strings"
 )
 
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartOnCrash   = "on-crash"
+	RestartNever     = "never"
+)
+
 var (
+	restartPolicyChoices  = []string{RestartAlways, RestartOnFailure, RestartOnCrash, RestartNever}
 	driveInterfaceChoices = []string{"ide", "scsi", "sd", "mtd", "floppy", "pflash", "virtio", "none"}
 	driveMediaChoices     = []string{"disk", "cdrom"}
 	driveCacheChoices     = []string{"none", "writeback", "unsafe", "directsync", "writethrough"}
-	driveFormatChoices    = []string{"raw"}
+	driveFormatChoices    = []string{"raw", "qcow2", "vmdk", "vdi", "vpc", "luks", "qed"}
 
 	reRAM    = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[MG]?$`)
 	reConfig = regexp.MustCompile(`^([^\.].*)\.ya?ml$`)
+	reName   = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
 )
 
 type Drive struct {
@@ -25,6 +34,19 @@ type Drive struct {
 	Snapshot  bool   `yaml:"snapshot" json:"snapshot"`
 	Cache     string `yaml:"cache" json:"cache"`
 	Format    string `yaml:"format" json:"format"`
+
+	// setting a device switches the drive to the -blockdev/-device syntax
+	ID                string `yaml:"id" json:"id"`
+	Device            string `yaml:"device" json:"device"`
+	Discard           string `yaml:"discard" json:"discard"`
+	DetectZeroes      string `yaml:"detect_zeroes" json:"detect_zeroes"`
+	IOThread          bool   `yaml:"iothread" json:"iothread"`
+	Serial            string `yaml:"serial" json:"serial"`
+	BootIndex         *int   `yaml:"bootindex" json:"bootindex"`
+	LogicalBlockSize  int    `yaml:"logical_block_size" json:"logical_block_size"`
+	PhysicalBlockSize int    `yaml:"physical_block_size" json:"physical_block_size"`
+
+	Throttle DriveThrottle `yaml:"throttle" json:"throttle"`
 }
 
 type NIC struct {
@@ -35,10 +57,21 @@ type NIC struct {
 	device      string
 }
 
+// RestartBackoff configures the delays between restarts of a virtual
+// machine. all the durations are in seconds.
+type RestartBackoff struct {
+	InitialDelay  int     `yaml:"initial_delay" json:"initial_delay"`
+	Multiplier    float64 `yaml:"multiplier" json:"multiplier"`
+	MaximumDelay  int     `yaml:"maximum_delay" json:"maximum_delay"`
+	SuccessWindow int     `yaml:"success_window" json:"success_window"`
+}
+
 type VirtualMachine struct {
-	name    string
-	qmp     string
-	pidfile string
+	name     string
+	qmp      string
+	pidfile  string
+	console  string
+	incoming string
 
 	AutoStart bool `yaml:"auto_start" json:"auto_start"`
 
@@ -56,10 +89,35 @@ type VirtualMachine struct {
 	RAM        string `yaml:"ram" json:"ram"`
 	VNCDisplay string `yaml:"vnc_display" json:"vnc_display"`
 
+	// vcpus can be hotplugged up to cpu_topology.maxcpus
+	CPUTopology CPUTopology `yaml:"cpu_topology" json:"cpu_topology"`
+
+	// vcpu threads are pinned to host cpusets (e.g. 0-3,8) by vcpu index,
+	// and the other qemu threads to emulator_cpuset
+	CPUPinning     map[int]string `yaml:"cpu_pinning" json:"cpu_pinning"`
+	EmulatorCPUSet string         `yaml:"emulator_cpuset" json:"emulator_cpuset"`
+
+	// adds a virtio-balloon device, to change the memory of the guest
+	// while it runs, and to return the memory it frees to the host
+	Balloon bool `yaml:"balloon" json:"balloon"`
+
+	MemoryBackend MemoryBackend `yaml:"memory_backend" json:"memory_backend"`
+	NUMANodes     []*NUMANode   `yaml:"numa_nodes" json:"numa_nodes"`
+
+	// applied when the daemon runs with a cgroup parent
+	Cgroup CgroupLimits `yaml:"cgroup" json:"cgroup"`
+
+	SerialConsole bool `yaml:"serial_console" json:"serial_console"`
+
+	// backups are written to a subdirectory named after the virtual machine
+	BackupDir string `yaml:"backup_dir" json:"backup_dir"`
+
 	AdditionalArgs []string `yaml:"additional_args" json:"additional_args"`
 
-	ShutdownTimeout int `yaml:"shutdown_timeout" json:"shutdown_timeout"`
-	MaximumRetries  int `yaml:"maximum_retries" json:"maximum_retries"`
+	ShutdownTimeout int            `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	MaximumRetries  int            `yaml:"maximum_retries" json:"maximum_retries"`
+	RestartPolicy   string         `yaml:"restart_policy" json:"restart_policy"`
+	RestartBackoff  RestartBackoff `yaml:"restart_backoff" json:"restart_backoff"`
 }
 
 func (n *NIC) SetDevice(device string) {
@@ -78,6 +136,16 @@ func (vm *VirtualMachine) SetPIDFile(pidfile string) {
 	vm.pidfile = pidfile
 }
 
+func (vm *VirtualMachine) SetConsole(console string) {
+	vm.console = console
+}
+
+// SetIncoming makes qemu wait for the state of the virtual machine to be
+// received from uri, paused.
+func (vm *VirtualMachine) SetIncoming(incoming string) {
+	vm.incoming = incoming
+}
+
 func appendParam(name string, param string, deft string, choices []string, error_name string) (string, error) {
 	if param == "" {
 		if deft == "" {
@@ -101,15 +169,64 @@ func appendParam(name string, param string, deft string, choices []string, error
 	return fmt.Sprintf(",%s=%s", name, param), nil
 }
 
+func validateRestart(vm *VirtualMachine) error {
+	if _, err := appendParam("restart_policy", vm.RestartPolicy, "", restartPolicyChoices, "restart_policy"); err != nil {
+		return err
+	}
+
+	b := vm.RestartBackoff
+	if b.InitialDelay < 0 {
+		return fmt.Errorf("qemu: restart_backoff.initial_delay: invalid value (%d)", b.InitialDelay)
+	}
+	if b.Multiplier != 0 && b.Multiplier < 1 {
+		return fmt.Errorf("qemu: restart_backoff.multiplier: invalid value (%g). must be greater or equal to 1", b.Multiplier)
+	}
+	if b.MaximumDelay < 0 {
+		return fmt.Errorf("qemu: restart_backoff.maximum_delay: invalid value (%d)", b.MaximumDelay)
+	}
+	if b.SuccessWindow < 0 {
+		return fmt.Errorf("qemu: restart_backoff.success_window: invalid value (%d)", b.SuccessWindow)
+	}
+
+	return nil
+}
+
+func validateBackupDir(vm *VirtualMachine) error {
+	if vm.BackupDir != "" && !filepath.IsAbs(vm.BackupDir) {
+		return fmt.Errorf("qemu: backup_dir: path must be absolute")
+	}
+	return nil
+}
+
 func buildCmdDrive(idx int, drv *Drive) ([]string, error) {
-	if drv.File == "" {
+	// cdrom drives can start empty, and get media inserted later
+	if drv.File == "" && drv.Media != "cdrom" {
 		return nil, fmt.Errorf("qemu: drive[%d].file: parameter is required", idx)
 	}
-	if !filepath.IsAbs(drv.File) {
+	if drv.File != "" && !filepath.IsAbs(drv.File) {
 		return nil, fmt.Errorf("qemu: drive[%d].file: path must be absolute", idx)
 	}
 
-	arg := fmt.Sprintf("file=%s", strings.Replace(drv.File, ",", ",,", -1))
+	if err := validateDriveCommon(idx, drv); err != nil {
+		return nil, err
+	}
+
+	if err := validateThrottle(fmt.Sprintf("drive[%d].throttle", idx), &drv.Throttle); err != nil {
+		return nil, err
+	}
+
+	if drv.Device != "" {
+		return buildCmdBlockdev(idx, drv)
+	}
+
+	if err := validateDriveLegacy(idx, drv); err != nil {
+		return nil, err
+	}
+
+	arg := ""
+	if drv.File != "" {
+		arg = fmt.Sprintf("file=%s", escapeParam(drv.File))
+	}
 
 	v, err := appendParam("if", drv.Interface, "virtio", driveInterfaceChoices, fmt.Sprintf("drive[%d].interface", idx))
 	if err != nil {
@@ -139,19 +256,44 @@ func buildCmdDrive(idx int, drv *Drive) ([]string, error) {
 		arg += ",snapshot=on"
 	}
 
-	return []string{"-drive", arg}, nil
+	if drv.ID != "" {
+		arg += fmt.Sprintf(",id=%s", drv.ID)
+	}
+
+	if drv.Discard != "" {
+		arg += fmt.Sprintf(",discard=%s", drv.Discard)
+	}
+
+	if drv.DetectZeroes != "" {
+		arg += fmt.Sprintf(",detect-zeroes=%s", drv.DetectZeroes)
+	}
+
+	arg += throttleParams(&drv.Throttle)
+
+	return []string{"-drive", strings.TrimPrefix(arg, ",")}, nil
 }
 
 func buildCmdDrives(drvs []*Drive) ([]string, error) {
 	if len(drvs) == 0 {
 		return nil, fmt.Errorf("qemu: drive: at least one drive must be defined")
 	}
-	rv := []string{}
+	rv := buildCmdSCSIController(drvs)
+	ids := map[string]bool{}
 	for i, drv := range drvs {
+		if drv == nil {
+			return nil, fmt.Errorf("qemu: drive[%d]: not defined", i+1)
+		}
 		v, err := buildCmdDrive(i+1, drv)
 		if err != nil {
 			return nil, err
 		}
+
+		id := drv.DeviceID(i + 1)
+		if ids[id] {
+			return nil, fmt.Errorf("qemu: drive[%d].id: duplicated value (%s)", i+1, id)
+		}
+		ids[id] = true
+
 		rv = append(rv, v...)
 	}
 	return rv, nil
@@ -198,6 +340,9 @@ func buildCmdNICs(nics []*NIC) ([]string, error) {
 	}
 	rv := []string{}
 	for i, nc := range nics {
+		if nc == nil {
+			return nil, fmt.Errorf("qemu: nic[%d]: not defined", i+1)
+		}
 		v, err := buildCmdNIC(i+1, nc)
 		if err != nil {
 			return nil, err
@@ -212,6 +357,19 @@ func buildCmdVirtualMachine(vm *VirtualMachine) ([]string, error) {
 		return nil, fmt.Errorf("qemu: virtualmachine: not defined")
 	}
 
+	if err := validateRestart(vm); err != nil {
+		return nil, err
+	}
+	if err := validateBackupDir(vm); err != nil {
+		return nil, err
+	}
+	if err := validateCPUPinning(vm); err != nil {
+		return nil, err
+	}
+	if err := validateCgroup(vm); err != nil {
+		return nil, err
+	}
+
 	rv := []string{}
 
 	if vm.name != "" {
@@ -226,6 +384,10 @@ func buildCmdVirtualMachine(vm *VirtualMachine) ([]string, error) {
 		rv = append(rv, "-daemonize", "-pidfile", vm.pidfile)
 	}
 
+	if vm.incoming != "" {
+		rv = append(rv, "-incoming", vm.incoming, "-S")
+	}
+
 	if vm.MachineType != "" {
 		rv = append(rv, "-M", vm.MachineType)
 	}
@@ -242,9 +404,11 @@ func buildCmdVirtualMachine(vm *VirtualMachine) ([]string, error) {
 		rv = append(rv, "-cpu", vm.CPUModel)
 	}
 
-	if vm.CPUs > 0 {
-		rv = append(rv, "-smp", fmt.Sprintf("cpus=%d", vm.CPUs))
+	smp, err := buildCmdSMP(vm)
+	if err != nil {
+		return nil, err
 	}
+	rv = append(rv, smp...)
 
 	if vm.RAM != "" {
 		if !reRAM.MatchString(vm.RAM) {
@@ -253,6 +417,16 @@ func buildCmdVirtualMachine(vm *VirtualMachine) ([]string, error) {
 		rv = append(rv, "-m", fmt.Sprintf("size=%s", vm.RAM))
 	}
 
+	numa, err := buildCmdNUMA(vm)
+	if err != nil {
+		return nil, err
+	}
+	rv = append(rv, numa...)
+
+	if vm.Balloon {
+		rv = append(rv, "-device", "virtio-balloon-pci,id=balloon0,free-page-reporting=on")
+	}
+
 	bootArgs := []string{}
 	for k, v := range vm.Boot {
 		bootArgs = append(bootArgs, fmt.Sprintf("%s=%s", k, v))
@@ -268,6 +442,16 @@ func buildCmdVirtualMachine(vm *VirtualMachine) ([]string, error) {
 		rv = append(rv, "none")
 	}
 
+	if vm.SerialConsole {
+		if vm.console == "" {
+			return nil, fmt.Errorf("qemu: serial_console: missing socket")
+		}
+		rv = append(rv,
+			"-chardev", fmt.Sprintf("socket,id=serial0,path=%s,server,nowait", vm.console),
+			"-serial", "chardev:serial0",
+		)
+	}
+
 	drives, err := buildCmdDrives(vm.Drives)
 	if err != nil {
 		return nil, err
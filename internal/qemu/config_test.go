@@ -62,6 +62,15 @@ func TestBuildCmdDrive(t *testing.T) {
 		"-drive", "file=/foo.img,if=virtio,media=cdrom,cache=none",
 	})
 
+	val, err = buildCmdDrive(1, &Drive{
+		ID:    "cd",
+		Media: "cdrom",
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-drive", "if=virtio,media=cdrom,cache=none,id=cd",
+	})
+
 	val, err = buildCmdDrive(1, &Drive{
 		File:  "/foo.img",
 		Media: "bola",
@@ -98,9 +107,18 @@ func TestBuildCmdDrive(t *testing.T) {
 		File:   "/foo.img",
 		Format: "bola",
 	})
-	AssertError(t, err, "qemu: drive[1].format: invalid value (bola). valid choices are: 'raw'")
+	AssertError(t, err, "qemu: drive[1].format: invalid value (bola). valid choices are: 'raw', 'qcow2', 'vmdk', 'vdi', 'vpc', 'luks', 'qed'")
 	AssertEqual(t, val, n)
 
+	val, err = buildCmdDrive(1, &Drive{
+		File:   "/foo.qcow2",
+		Format: "qcow2",
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-drive", "file=/foo.qcow2,if=virtio,media=disk,cache=none,format=qcow2",
+	})
+
 	val, err = buildCmdDrive(1, &Drive{
 		File:     "/foo.img",
 		Snapshot: true,
@@ -148,6 +166,13 @@ func TestBuildCmdDrives(t *testing.T) {
 	AssertError(t, err, "qemu: drive[2].file: parameter is required")
 	AssertEqual(t, val, n)
 
+	val, err = buildCmdDrives([]*Drive{
+		&Drive{File: "/foo.img"},
+		nil,
+	})
+	AssertError(t, err, "qemu: drive[2]: not defined")
+	AssertEqual(t, val, n)
+
 	val, err = buildCmdDrives([]*Drive{
 		&Drive{File: "/foo.img"},
 		&Drive{File: "/bar.img"},
@@ -273,6 +298,45 @@ func TestBuildCmdNICs(t *testing.T) {
 	})
 }
 
+func TestValidateRestart(t *testing.T) {
+	err := validateRestart(&VirtualMachine{})
+	AssertNonError(t, err)
+
+	err = validateRestart(&VirtualMachine{
+		RestartPolicy: "on-failure",
+		RestartBackoff: RestartBackoff{
+			InitialDelay:  1,
+			Multiplier:    1.5,
+			MaximumDelay:  60,
+			SuccessWindow: 600,
+		},
+	})
+	AssertNonError(t, err)
+
+	err = validateRestart(&VirtualMachine{RestartPolicy: "bola"})
+	AssertError(t, err, "qemu: restart_policy: invalid value (bola). valid choices are: 'always', 'on-failure', 'on-crash', 'never'")
+
+	err = validateRestart(&VirtualMachine{RestartBackoff: RestartBackoff{InitialDelay: -1}})
+	AssertError(t, err, "qemu: restart_backoff.initial_delay: invalid value (-1)")
+
+	err = validateRestart(&VirtualMachine{RestartBackoff: RestartBackoff{Multiplier: 0.5}})
+	AssertError(t, err, "qemu: restart_backoff.multiplier: invalid value (0.5). must be greater or equal to 1")
+
+	err = validateRestart(&VirtualMachine{RestartBackoff: RestartBackoff{MaximumDelay: -1}})
+	AssertError(t, err, "qemu: restart_backoff.maximum_delay: invalid value (-1)")
+
+	err = validateRestart(&VirtualMachine{RestartBackoff: RestartBackoff{SuccessWindow: -1}})
+	AssertError(t, err, "qemu: restart_backoff.success_window: invalid value (-1)")
+}
+
+func TestValidateBackupDir(t *testing.T) {
+	AssertNonError(t, validateBackupDir(&VirtualMachine{}))
+	AssertNonError(t, validateBackupDir(&VirtualMachine{BackupDir: "/srv/backups"}))
+
+	err := validateBackupDir(&VirtualMachine{BackupDir: "backups"})
+	AssertError(t, err, "qemu: backup_dir: path must be absolute")
+}
+
 func TestBuildCmdVirtualMachine(t *testing.T) {
 	val, err := buildCmdVirtualMachine(nil)
 	AssertError(t, err, "qemu: virtualmachine: not defined")
@@ -351,6 +415,37 @@ func TestBuildCmdVirtualMachine(t *testing.T) {
 		"-nic", "user,mac=52:54:00:fc:70:3b,model=virtio",
 	})
 
+	val, err = buildCmdVirtualMachine(&VirtualMachine{
+		Drives: []*Drive{
+			&Drive{File: "/foo.img"},
+		},
+		NICs: []*NIC{
+			&NIC{MACAddr: "52:54:00:fc:70:3b"},
+		},
+		SerialConsole: true,
+	})
+	AssertError(t, err, "qemu: serial_console: missing socket")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdVirtualMachine(&VirtualMachine{
+		console: "/run/bola.console",
+		Drives: []*Drive{
+			&Drive{File: "/foo.img"},
+		},
+		NICs: []*NIC{
+			&NIC{MACAddr: "52:54:00:fc:70:3b"},
+		},
+		SerialConsole: true,
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-display", "none",
+		"-chardev", "socket,id=serial0,path=/run/bola.console,server,nowait",
+		"-serial", "chardev:serial0",
+		"-drive", "file=/foo.img,if=virtio,media=disk,cache=none",
+		"-nic", "user,mac=52:54:00:fc:70:3b,model=virtio",
+	})
+
 	val, err = buildCmdVirtualMachine(&VirtualMachine{
 		name:    "bola",
 		qmp:     "/run/bola.sock",
@@ -391,4 +486,31 @@ func TestBuildCmdVirtualMachine(t *testing.T) {
 		"-nic", "user,mac=52:54:00:fc:70:3b,model=virtio",
 		"-asd", "qwe",
 	})
+
+	val, err = buildCmdVirtualMachine(&VirtualMachine{
+		name:     "bola",
+		pidfile:  "/run/bola.pid",
+		incoming: "exec:cat /var/lib/bola.state",
+		RAM:      "1G",
+		Balloon:  true,
+		Drives: []*Drive{
+			&Drive{File: "/foo.img"},
+		},
+		NICs: []*NIC{
+			&NIC{MACAddr: "52:54:00:fc:70:3b"},
+		},
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-name", "bola",
+		"-daemonize",
+		"-pidfile", "/run/bola.pid",
+		"-incoming", "exec:cat /var/lib/bola.state",
+		"-S",
+		"-m", "size=1G",
+		"-device", "virtio-balloon-pci,id=balloon0,free-page-reporting=on",
+		"-display", "none",
+		"-drive", "file=/foo.img,if=virtio,media=disk,cache=none",
+		"-nic", "user,mac=52:54:00:fc:70:3b,model=virtio",
+	})
 }
@@ -0,0 +1,187 @@
+package qemu
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CPUTopology describes how the vcpus are laid out for the guest. values
+// not set are computed as qemu does. maxcpus reserves vcpus that can be
+// hotplugged later, the virtual machine starts with cpus vcpus.
+type CPUTopology struct {
+	Sockets int `yaml:"sockets" json:"sockets"`
+	Dies    int `yaml:"dies" json:"dies"`
+	Cores   int `yaml:"cores" json:"cores"`
+	Threads int `yaml:"threads" json:"threads"`
+	MaxCPUs int `yaml:"maxcpus" json:"maxcpus"`
+}
+
+// resolveCPUTopology returns the number of vcpus the virtual machine starts
+// with, and its topology with all the values set.
+func resolveCPUTopology(vm *VirtualMachine) (int, *CPUTopology, error) {
+	t := vm.CPUTopology
+	cpus := vm.CPUs
+
+	if cpus < 0 {
+		return -1, nil, fmt.Errorf("qemu: cpus: invalid value (%d)", cpus)
+	}
+	for _, v := range []struct {
+		name  string
+		value int
+	}{
+		{"sockets", t.Sockets},
+		{"dies", t.Dies},
+		{"cores", t.Cores},
+		{"threads", t.Threads},
+		{"maxcpus", t.MaxCPUs},
+	} {
+		if v.value < 0 {
+			return -1, nil, fmt.Errorf("qemu: cpu_topology.%s: invalid value (%d)", v.name, v.value)
+		}
+	}
+
+	if t.Dies == 0 {
+		t.Dies = 1
+	}
+	if t.Threads == 0 {
+		t.Threads = 1
+	}
+
+	total := t.MaxCPUs
+	if total == 0 {
+		total = cpus
+	}
+
+	if total == 0 {
+		if t.Sockets == 0 {
+			t.Sockets = 1
+		}
+		if t.Cores == 0 {
+			t.Cores = 1
+		}
+	} else {
+		// like qemu, prefer sockets over cores
+		if t.Sockets == 0 && t.Cores == 0 {
+			t.Cores = 1
+		}
+		if t.Sockets == 0 {
+			t.Sockets = total / (t.Dies * t.Cores * t.Threads)
+		}
+		if t.Cores == 0 {
+			t.Cores = total / (t.Sockets * t.Dies * t.Threads)
+		}
+	}
+
+	product := t.Sockets * t.Dies * t.Cores * t.Threads
+	if t.MaxCPUs == 0 {
+		t.MaxCPUs = product
+		if product == 0 {
+			t.MaxCPUs = total
+		}
+	}
+	if product != t.MaxCPUs {
+		return -1, nil, fmt.Errorf("qemu: cpu_topology: sockets * dies * cores * threads (%d) must be equal to maxcpus (%d)",
+			product, t.MaxCPUs)
+	}
+
+	if cpus == 0 {
+		cpus = t.MaxCPUs
+	}
+	if cpus > t.MaxCPUs {
+		return -1, nil, fmt.Errorf("qemu: cpus: invalid value (%d). must not be greater than maxcpus (%d)",
+			cpus, t.MaxCPUs)
+	}
+
+	return cpus, &t, nil
+}
+
+func validateCPUTopology(vm *VirtualMachine) error {
+	_, _, err := resolveCPUTopology(vm)
+	return err
+}
+
+// ParseCPUSet returns the host cpus of a cpuset, like 0-3,8.
+func ParseCPUSet(cpuset string) ([]int, error) {
+	ranges, err := parseIDList(cpuset)
+	if err != nil {
+		return nil, fmt.Errorf("qemu: invalid cpuset (%s)", cpuset)
+	}
+
+	rv := []int{}
+	for _, r := range ranges {
+		for cpu := r.first; cpu <= r.last; cpu++ {
+			rv = append(rv, cpu)
+		}
+	}
+	return rv, nil
+}
+
+func validateCPUPinning(vm *VirtualMachine) error {
+	_, t, err := resolveCPUTopology(vm)
+	if err != nil {
+		return err
+	}
+
+	vcpus := []int{}
+	for vcpu := range vm.CPUPinning {
+		vcpus = append(vcpus, vcpu)
+	}
+	sort.Ints(vcpus)
+
+	for _, vcpu := range vcpus {
+		if vcpu < 0 || vcpu >= t.MaxCPUs {
+			return fmt.Errorf("qemu: cpu_pinning: vcpu %d out of range. must be lower than maxcpus (%d)",
+				vcpu, t.MaxCPUs)
+		}
+		if _, err := parseIDList(vm.CPUPinning[vcpu]); err != nil {
+			return fmt.Errorf("qemu: cpu_pinning: vcpu %d: invalid cpuset (%s)", vcpu, vm.CPUPinning[vcpu])
+		}
+	}
+
+	if vm.EmulatorCPUSet != "" {
+		if _, err := parseIDList(vm.EmulatorCPUSet); err != nil {
+			return fmt.Errorf("qemu: emulator_cpuset: invalid cpuset (%s)", vm.EmulatorCPUSet)
+		}
+	}
+
+	return nil
+}
+
+// MaxCPUs returns the number of vcpus the virtual machine can have after
+// hotplugging.
+func (vm *VirtualMachine) MaxCPUs() (int, error) {
+	_, t, err := resolveCPUTopology(vm)
+	if err != nil {
+		return -1, err
+	}
+	return t.MaxCPUs, nil
+}
+
+func buildCmdSMP(vm *VirtualMachine) ([]string, error) {
+	if err := validateCPUTopology(vm); err != nil {
+		return nil, err
+	}
+
+	// only the values set by the user, qemu computes the others
+	p := params{}
+	for _, v := range []struct {
+		name  string
+		value int
+	}{
+		{"cpus", vm.CPUs},
+		{"sockets", vm.CPUTopology.Sockets},
+		{"dies", vm.CPUTopology.Dies},
+		{"cores", vm.CPUTopology.Cores},
+		{"threads", vm.CPUTopology.Threads},
+		{"maxcpus", vm.CPUTopology.MaxCPUs},
+	} {
+		if v.value > 0 {
+			p = append(p, &param{v.name, v.value})
+		}
+	}
+
+	if len(p) == 0 {
+		return []string{}, nil
+	}
+	return []string{"-smp", p.String()}, nil
+}
@@ -0,0 +1,105 @@
+package qemu
+
+import (
+	"testing"
+
+	. "github.com/rafaelmartins/simplevirt/internal/testutils"
+)
+
+func TestResolveCPUTopology(t *testing.T) {
+	for _, tc := range []struct {
+		cpus     int
+		topology CPUTopology
+		expCPUs  int
+		expected CPUTopology
+	}{
+		{0, CPUTopology{}, 1, CPUTopology{1, 1, 1, 1, 1}},
+		{4, CPUTopology{}, 4, CPUTopology{4, 1, 1, 1, 4}},
+		{0, CPUTopology{Sockets: 2, Cores: 4}, 8, CPUTopology{2, 1, 4, 1, 8}},
+		{8, CPUTopology{Cores: 4}, 8, CPUTopology{2, 1, 4, 1, 8}},
+		{8, CPUTopology{Sockets: 2, Threads: 2}, 8, CPUTopology{2, 1, 2, 2, 8}},
+		{2, CPUTopology{Sockets: 2, Cores: 2}, 2, CPUTopology{2, 1, 2, 1, 4}},
+		{2, CPUTopology{MaxCPUs: 8}, 2, CPUTopology{8, 1, 1, 1, 8}},
+		{2, CPUTopology{Sockets: 1, Dies: 2, Cores: 2, Threads: 2, MaxCPUs: 8}, 2, CPUTopology{1, 2, 2, 2, 8}},
+	} {
+		cpus, topology, err := resolveCPUTopology(&VirtualMachine{CPUs: tc.cpus, CPUTopology: tc.topology})
+		AssertNonError(t, err)
+		AssertEqual(t, cpus, tc.expCPUs)
+		AssertEqual(t, *topology, tc.expected)
+	}
+
+	for _, tc := range []struct {
+		cpus     int
+		topology CPUTopology
+		err      string
+	}{
+		{-1, CPUTopology{}, "qemu: cpus: invalid value (-1)"},
+		{0, CPUTopology{Cores: -2}, "qemu: cpu_topology.cores: invalid value (-2)"},
+		{8, CPUTopology{Sockets: 2, Cores: 2}, "qemu: cpus: invalid value (8). must not be greater than maxcpus (4)"},
+		{0, CPUTopology{Sockets: 2, Cores: 2, MaxCPUs: 8}, "qemu: cpu_topology: sockets * dies * cores * threads (4) must be equal to maxcpus (8)"},
+		{2, CPUTopology{Cores: 4}, "qemu: cpu_topology: sockets * dies * cores * threads (0) must be equal to maxcpus (2)"},
+		{6, CPUTopology{Cores: 4}, "qemu: cpus: invalid value (6). must not be greater than maxcpus (4)"},
+	} {
+		_, _, err := resolveCPUTopology(&VirtualMachine{CPUs: tc.cpus, CPUTopology: tc.topology})
+		AssertError(t, err, tc.err)
+	}
+
+	max, err := (&VirtualMachine{CPUs: 2, CPUTopology: CPUTopology{MaxCPUs: 4}}).MaxCPUs()
+	AssertNonError(t, err)
+	AssertEqual(t, max, 4)
+}
+
+func TestBuildCmdSMP(t *testing.T) {
+	val, err := buildCmdSMP(&VirtualMachine{})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{})
+
+	val, err = buildCmdSMP(&VirtualMachine{CPUs: 4})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{"-smp", "cpus=4"})
+
+	val, err = buildCmdSMP(&VirtualMachine{
+		CPUs:        2,
+		CPUTopology: CPUTopology{Sockets: 2, Cores: 2, Threads: 2, MaxCPUs: 8},
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{"-smp", "cpus=2,sockets=2,cores=2,threads=2,maxcpus=8"})
+
+	_, err = buildCmdSMP(&VirtualMachine{CPUs: 4, CPUTopology: CPUTopology{MaxCPUs: 2}})
+	AssertError(t, err, "qemu: cpus: invalid value (4). must not be greater than maxcpus (2)")
+}
+
+func TestParseCPUSet(t *testing.T) {
+	val, err := ParseCPUSet("0-2,8")
+	AssertNonError(t, err)
+	AssertEqual(t, val, []int{0, 1, 2, 8})
+
+	_, err = ParseCPUSet("2-0")
+	AssertError(t, err, "qemu: invalid cpuset (2-0)")
+}
+
+func TestValidateCPUPinning(t *testing.T) {
+	AssertNonError(t, validateCPUPinning(&VirtualMachine{}))
+	AssertNonError(t, validateCPUPinning(&VirtualMachine{
+		CPUs:           2,
+		CPUTopology:    CPUTopology{MaxCPUs: 4},
+		CPUPinning:     map[int]string{0: "2", 3: "4-5"},
+		EmulatorCPUSet: "0-1",
+	}))
+
+	for _, tc := range []struct {
+		vm  *VirtualMachine
+		err string
+	}{
+		{&VirtualMachine{CPUs: 2, CPUPinning: map[int]string{0: "1", 2: "3"}},
+			"qemu: cpu_pinning: vcpu 2 out of range. must be lower than maxcpus (2)"},
+		{&VirtualMachine{CPUs: 2, CPUPinning: map[int]string{-1: "1"}},
+			"qemu: cpu_pinning: vcpu -1 out of range. must be lower than maxcpus (2)"},
+		{&VirtualMachine{CPUs: 2, CPUPinning: map[int]string{1: "a", 0: ""}},
+			"qemu: cpu_pinning: vcpu 0: invalid cpuset ()"},
+		{&VirtualMachine{EmulatorCPUSet: "0,"},
+			"qemu: emulator_cpuset: invalid cpuset (0,)"},
+	} {
+		AssertError(t, validateCPUPinning(tc.vm), tc.err)
+	}
+}
@@ -0,0 +1,234 @@
+package qemu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
+)
+
+const (
+	qcow2HeaderV2Length      = 72
+	qcow2ExtensionEnd        = 0x00000000
+	qcow2ExtensionBackingFmt = 0xe2792aca
+
+	// qemu itself refuses longer backing file names
+	qcow2MaxBackingFileSize = 1023
+
+	maxBackingChainDepth = 16
+)
+
+type imageMagic struct {
+	format string
+	offset int64
+	magic  []byte
+}
+
+var (
+	imageMagics = []*imageMagic{
+		{"qcow2", 0, []byte("QFI\xfb")},
+		{"qed", 0, []byte("QED\x00")},
+		{"vmdk", 0, []byte("KDMV")},
+		{"vmdk", 0, []byte("COWD")},
+		{"vmdk", 0, []byte("# Disk DescriptorFile")},
+		{"vdi", 0x40, []byte("\x7f\x10\xda\xbe")},
+		{"vpc", 0, []byte("conectix")},
+		{"luks", 0, []byte("LUKS\xba\xbe")},
+	}
+)
+
+// detectImageFormat detects the format of an image by its magic bytes. images
+// without a known header are assumed to be raw.
+func detectImageFormat(f *os.File) (string, error) {
+	buf := make([]byte, 512)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	buf = buf[:n]
+
+	for _, m := range imageMagics {
+		end := m.offset + int64(len(m.magic))
+		if end <= int64(len(buf)) && bytes.Equal(buf[m.offset:end], m.magic) {
+			return m.format, nil
+		}
+	}
+
+	// fixed size vpc images only have a footer
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().IsRegular() && info.Size() >= 512 {
+		footer := make([]byte, 8)
+		if _, err := f.ReadAt(footer, info.Size()-512); err != nil {
+			return "", err
+		}
+		if bytes.Equal(footer, []byte("conectix")) {
+			return "vpc", nil
+		}
+	}
+
+	return "raw", nil
+}
+
+// qcow2Backing returns the backing file name and format (if recorded) of a
+// qcow2 image. the name is returned as stored in the image.
+func qcow2Backing(f *os.File) (string, string, error) {
+	header := make([]byte, 104)
+	if _, err := f.ReadAt(header, 0); err != nil && err != io.EOF {
+		return "", "", err
+	}
+
+	version := binary.BigEndian.Uint32(header[4:8])
+	backingOffset := binary.BigEndian.Uint64(header[8:16])
+	backingSize := binary.BigEndian.Uint32(header[16:20])
+
+	if backingOffset == 0 || backingSize == 0 {
+		return "", "", nil
+	}
+	if backingSize > qcow2MaxBackingFileSize {
+		return "", "", fmt.Errorf("invalid qcow2 backing file name size (%d)", backingSize)
+	}
+
+	name := make([]byte, backingSize)
+	if _, err := f.ReadAt(name, int64(backingOffset)); err != nil {
+		return "", "", fmt.Errorf("failed to read qcow2 backing file name: %s", err)
+	}
+
+	headerLength := uint64(qcow2HeaderV2Length)
+	if version >= 3 {
+		headerLength = uint64(binary.BigEndian.Uint32(header[100:104]))
+	}
+
+	// header extensions live between the header and the backing file name
+	format := ""
+	for offset := headerLength; offset+8 <= backingOffset; {
+		ext := make([]byte, 8)
+		if _, err := f.ReadAt(ext, int64(offset)); err != nil {
+			break
+		}
+
+		extType := binary.BigEndian.Uint32(ext[0:4])
+		extLength := uint64(binary.BigEndian.Uint32(ext[4:8]))
+		if extType == qcow2ExtensionEnd {
+			break
+		}
+
+		if extType == qcow2ExtensionBackingFmt {
+			data := make([]byte, extLength)
+			if _, err := f.ReadAt(data, int64(offset+8)); err == nil {
+				format = string(data)
+			}
+			break
+		}
+
+		offset += 8 + (extLength+7)/8*8
+	}
+
+	return string(name), format, nil
+}
+
+func checkImage(file string, format string, depth int) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("file not found: %s", file)
+		}
+		return err
+	}
+	defer f.Close()
+
+	detected, err := detectImageFormat(f)
+	if err != nil {
+		return err
+	}
+
+	// a raw image can contain anything, including something that looks like
+	// a header of another format, so it is never rejected
+	if format != "" && format != "raw" && format != detected {
+		return fmt.Errorf("image format mismatch for %s (expected %s, found %s)", file, format, detected)
+	}
+
+	if detected != "qcow2" {
+		return nil
+	}
+
+	backing, backingFormat, err := qcow2Backing(f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	if backing == "" {
+		return nil
+	}
+
+	if depth >= maxBackingChainDepth {
+		return fmt.Errorf("backing chain too deep for %s", file)
+	}
+
+	if !filepath.IsAbs(backing) {
+		backing = filepath.Join(filepath.Dir(file), backing)
+	}
+
+	if _, err := os.Stat(backing); os.IsNotExist(err) {
+		return fmt.Errorf("backing file not found: %s (required by %s)", backing, file)
+	}
+
+	return checkImage(backing, backingFormat, depth+1)
+}
+
+// checkDriveImage validates the image of a drive that declares its format,
+// including the whole backing chain, for qcow2 images.
+func checkDriveImage(idx int, drv *Drive) error {
+	if drv == nil || drv.File == "" || drv.Format == "" {
+		return nil
+	}
+
+	if err := checkImage(drv.File, drv.Format, 0); err != nil {
+		return fmt.Errorf("qemu: drive[%d].file: %s", idx, err)
+	}
+
+	return nil
+}
+
+// CheckImages validates the images of all the drives of a virtual machine.
+func CheckImages(config *VirtualMachine) error {
+	for i, drv := range config.Drives {
+		if err := checkDriveImage(i+1, drv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImageFormat detects the format of an image, see detectImageFormat.
+func ImageFormat(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return detectImageFormat(f)
+}
+
+// CreateOverlay creates a qcow2 image backed by another image, using
+// qemu-img. the backing file name is stored as given.
+func CreateOverlay(file string, backing string, backingFormat string) error {
+	args := []string{"create", "-q", "-f", "qcow2", "-b", backing, "-F", backingFormat, file}
+
+	logutils.Notice.Printf("qemu: calling \"qemu-img\" with arguments: %q", args)
+
+	cmd := exec.Command("qemu-img", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("qemu: qemu-img: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
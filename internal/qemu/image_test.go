@@ -0,0 +1,116 @@
+package qemu
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/rafaelmartins/simplevirt/internal/testutils"
+)
+
+func writeImage(t *testing.T, file string, offset int64, magic string) {
+	t.Helper()
+
+	data := make([]byte, 1024)
+	copy(data[offset:], magic)
+	AssertNonError(t, ioutil.WriteFile(file, data, 0644))
+}
+
+func writeQcow2(t *testing.T, file string, backing string, backingFormat string) {
+	t.Helper()
+
+	data := make([]byte, 1024)
+	copy(data, "QFI\xfb")
+	binary.BigEndian.PutUint32(data[4:], 3)
+	binary.BigEndian.PutUint32(data[100:], 104)
+
+	offset := 104
+	if backingFormat != "" {
+		binary.BigEndian.PutUint32(data[offset:], qcow2ExtensionBackingFmt)
+		binary.BigEndian.PutUint32(data[offset+4:], uint32(len(backingFormat)))
+		copy(data[offset+8:], backingFormat)
+		offset += 8 + (len(backingFormat)+7)/8*8
+	}
+	offset += 8 // end of extensions
+
+	if backing != "" {
+		binary.BigEndian.PutUint64(data[8:], uint64(offset))
+		binary.BigEndian.PutUint32(data[16:], uint32(len(backing)))
+		copy(data[offset:], backing)
+	}
+
+	AssertNonError(t, ioutil.WriteFile(file, data, 0644))
+}
+
+func TestDetectImageFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qemu")
+	AssertNonError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, m := range imageMagics {
+		file := filepath.Join(dir, "image")
+		writeImage(t, file, m.offset, string(m.magic))
+
+		f, err := os.Open(file)
+		AssertNonError(t, err)
+		format, err := detectImageFormat(f)
+		f.Close()
+		AssertNonError(t, err)
+		AssertEqual(t, format, m.format)
+	}
+
+	file := filepath.Join(dir, "fixed.vhd")
+	writeImage(t, file, 512, "conectix")
+	f, err := os.Open(file)
+	AssertNonError(t, err)
+	format, err := detectImageFormat(f)
+	f.Close()
+	AssertNonError(t, err)
+	AssertEqual(t, format, "vpc")
+
+	file = filepath.Join(dir, "raw.img")
+	writeImage(t, file, 0, "")
+	f, err = os.Open(file)
+	AssertNonError(t, err)
+	format, err = detectImageFormat(f)
+	f.Close()
+	AssertNonError(t, err)
+	AssertEqual(t, format, "raw")
+}
+
+func TestCheckDriveImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qemu")
+	AssertNonError(t, err)
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "base.img")
+	middle := filepath.Join(dir, "middle.qcow2")
+	top := filepath.Join(dir, "top.qcow2")
+	writeImage(t, base, 0, "")
+	writeQcow2(t, middle, base, "raw")
+	writeQcow2(t, top, "middle.qcow2", "")
+
+	AssertNonError(t, checkDriveImage(1, &Drive{File: "/foo.img"}))
+	AssertNonError(t, checkDriveImage(1, &Drive{File: base, Format: "raw"}))
+	AssertNonError(t, checkDriveImage(1, &Drive{File: top, Format: "qcow2"}))
+	AssertNonError(t, checkDriveImage(1, &Drive{File: top, Format: "raw"}))
+
+	AssertError(t, checkDriveImage(1, &Drive{File: "/foo.img", Format: "raw"}),
+		"qemu: drive[1].file: file not found: /foo.img")
+	AssertError(t, checkDriveImage(2, &Drive{File: base, Format: "qcow2"}),
+		"qemu: drive[2].file: image format mismatch for "+base+" (expected qcow2, found raw)")
+
+	writeQcow2(t, middle, base, "vmdk")
+	AssertError(t, checkDriveImage(1, &Drive{File: top, Format: "qcow2"}),
+		"qemu: drive[1].file: image format mismatch for "+base+" (expected vmdk, found raw)")
+
+	AssertNonError(t, os.Remove(base))
+	AssertError(t, checkDriveImage(1, &Drive{File: top, Format: "qcow2"}),
+		"qemu: drive[1].file: backing file not found: "+base+" (required by "+middle+")")
+
+	writeQcow2(t, middle, "top.qcow2", "")
+	AssertError(t, checkDriveImage(1, &Drive{File: top, Format: "qcow2"}),
+		"qemu: drive[1].file: backing chain too deep for "+top)
+}
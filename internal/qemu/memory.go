@@ -0,0 +1,43 @@
+package qemu
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// used by qemu if no size is given
+	defaultRAM = "128M"
+)
+
+// ParseRAM returns the size in bytes of a RAM size, as accepted by the ram
+// option: a number of mebibytes, or of gibibytes if suffixed with G.
+func ParseRAM(size string) (int64, error) {
+	if !reRAM.MatchString(size) {
+		return -1, fmt.Errorf("qemu: invalid RAM size (%s)", size)
+	}
+
+	unit := float64(1 << 20)
+	switch size[len(size)-1] {
+	case 'G':
+		unit = 1 << 30
+		size = size[:len(size)-1]
+	case 'M':
+		size = size[:len(size)-1]
+	}
+
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil {
+		return -1, fmt.Errorf("qemu: invalid RAM size (%s)", size)
+	}
+
+	return int64(value * unit), nil
+}
+
+// RAMSize returns the size in bytes of the RAM of the virtual machine.
+func (vm *VirtualMachine) RAMSize() (int64, error) {
+	if vm.RAM == "" {
+		return ParseRAM(defaultRAM)
+	}
+	return ParseRAM(vm.RAM)
+}
@@ -0,0 +1,37 @@
+package qemu
+
+import (
+	"testing"
+
+	. "github.com/rafaelmartins/simplevirt/internal/testutils"
+)
+
+func TestParseRAM(t *testing.T) {
+	for _, tc := range []struct {
+		size     string
+		expected int64
+	}{
+		{"512", 512 << 20},
+		{"512M", 512 << 20},
+		{"2G", 2 << 30},
+		{"4.5G", 9 << 29},
+		{"0.5M", 1 << 19},
+	} {
+		val, err := ParseRAM(tc.size)
+		AssertNonError(t, err)
+		AssertEqual(t, val, tc.expected)
+	}
+
+	for _, size := range []string{"", "G", "1K", "-1", "1.G", "1GB"} {
+		_, err := ParseRAM(size)
+		AssertError(t, err, "qemu: invalid RAM size ("+size+")")
+	}
+
+	val, err := (&VirtualMachine{}).RAMSize()
+	AssertNonError(t, err)
+	AssertEqual(t, val, int64(128<<20))
+
+	val, err = (&VirtualMachine{RAM: "1G"}).RAMSize()
+	AssertNonError(t, err)
+	AssertEqual(t, val, int64(1<<30))
+}
@@ -0,0 +1,263 @@
+package qemu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// mount point of hugetlbfs in most distributions
+	defaultHugePagesPath = "/dev/hugepages"
+)
+
+var (
+	memoryBackendTypeChoices = []string{"ram", "memfd", "file"}
+	memoryPolicyChoices      = []string{"default", "preferred", "bind", "interleave"}
+)
+
+// MemoryBackend configures how the memory of the guest is allocated on the
+// host. if numa_nodes are defined, each node gets its own backend, with
+// these settings.
+type MemoryBackend struct {
+	// ram, memfd or file. defaults to ram
+	Type string `yaml:"type" json:"type"`
+
+	// backs the memory with hugepages. file backends create the memory file
+	// in path, that defaults to the hugetlbfs mount point
+	HugePages bool   `yaml:"hugepages" json:"hugepages"`
+	Path      string `yaml:"path" json:"path"`
+
+	// allocates all the memory when the virtual machine starts
+	Prealloc bool `yaml:"prealloc" json:"prealloc"`
+
+	// host numa nodes to allocate the memory from (e.g. 0-1,3), with
+	// policy, that defaults to bind
+	HostNodes string `yaml:"host_nodes" json:"host_nodes"`
+	Policy    string `yaml:"policy" json:"policy"`
+}
+
+// NUMANode is a guest numa node, with its vcpus (e.g. 0-3,8-11) and memory,
+// in the same format as ram. the memory of all the nodes must add up to
+// ram. host_nodes and policy override the ones from memory_backend.
+type NUMANode struct {
+	CPUs      string `yaml:"cpus" json:"cpus"`
+	Memory    string `yaml:"memory" json:"memory"`
+	HostNodes string `yaml:"host_nodes" json:"host_nodes"`
+	Policy    string `yaml:"policy" json:"policy"`
+}
+
+type idRange struct {
+	first int
+	last  int
+}
+
+func (r *idRange) String() string {
+	if r.first == r.last {
+		return strconv.Itoa(r.first)
+	}
+	return fmt.Sprintf("%d-%d", r.first, r.last)
+}
+
+// parseIDList parses a list of ids and ranges of ids, like 0-3,8.
+func parseIDList(list string) ([]*idRange, error) {
+	rv := []*idRange{}
+	for _, item := range strings.Split(list, ",") {
+		pieces := strings.SplitN(item, "-", 2)
+		if len(pieces) == 1 {
+			pieces = append(pieces, pieces[0])
+		}
+
+		first, err := strconv.Atoi(pieces[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid list (%s)", list)
+		}
+		last, err := strconv.Atoi(pieces[1])
+		if err != nil || last < first {
+			return nil, fmt.Errorf("invalid list (%s)", list)
+		}
+
+		rv = append(rv, &idRange{first, last})
+	}
+	return rv, nil
+}
+
+func memoryBackendParams(field string, vm *VirtualMachine, id string, size int64, hostNodes string, policy string) (params, error) {
+	b := vm.MemoryBackend
+
+	typ := b.Type
+	if typ == "" {
+		typ = "ram"
+	}
+	if _, err := appendParam("type", typ, "", memoryBackendTypeChoices, "memory_backend.type"); err != nil {
+		return nil, err
+	}
+
+	p := params{
+		&param{"driver", "memory-backend-" + typ},
+		&param{"id", id},
+		&param{"size", size},
+	}
+
+	switch typ {
+	case "ram":
+		if b.HugePages {
+			return nil, fmt.Errorf("qemu: memory_backend.hugepages: not supported by ram backend")
+		}
+	case "memfd":
+		if b.HugePages {
+			p = append(p, &param{"hugetlb", true})
+		}
+	case "file":
+		path := b.Path
+		if path == "" && b.HugePages {
+			path = defaultHugePagesPath
+		}
+		if path == "" {
+			return nil, fmt.Errorf("qemu: memory_backend.path: required by file backend")
+		}
+		p = append(p, &param{"mem-path", path})
+	}
+	if b.Path != "" {
+		if typ != "file" {
+			return nil, fmt.Errorf("qemu: memory_backend.path: not supported by %s backend", typ)
+		}
+		if !strings.HasPrefix(b.Path, "/") {
+			return nil, fmt.Errorf("qemu: memory_backend.path: path must be absolute")
+		}
+	}
+
+	if b.Prealloc {
+		p = append(p, &param{"prealloc", true})
+	}
+
+	if _, err := appendParam("policy", policy, "", memoryPolicyChoices, field+".policy"); err != nil {
+		return nil, err
+	}
+	if hostNodes == "" {
+		if policy != "" && policy != "default" {
+			return nil, fmt.Errorf("qemu: %s.policy: %s requires host_nodes", field, policy)
+		}
+		return p, nil
+	}
+
+	nodes, err := parseIDList(hostNodes)
+	if err != nil {
+		return nil, fmt.Errorf("qemu: %s.host_nodes: %s", field, err)
+	}
+	if policy == "" {
+		policy = "bind"
+	}
+	if policy == "default" {
+		return nil, fmt.Errorf("qemu: %s.policy: default doesn't support host_nodes", field)
+	}
+	for _, n := range nodes {
+		p = append(p, &param{"host-nodes", n.String()})
+	}
+	p = append(p, &param{"policy", policy})
+
+	return p, nil
+}
+
+func buildCmdNUMA(vm *VirtualMachine) ([]string, error) {
+	if len(vm.NUMANodes) == 0 && vm.MemoryBackend == (MemoryBackend{}) {
+		return []string{}, nil
+	}
+
+	ram, err := vm.RAMSize()
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []string{}
+
+	// without numa nodes, all the memory comes from a single backend
+	if len(vm.NUMANodes) == 0 {
+		p, err := memoryBackendParams("memory_backend", vm, "mem0", ram,
+			vm.MemoryBackend.HostNodes, vm.MemoryBackend.Policy)
+		if err != nil {
+			return nil, err
+		}
+		return append(rv, "-object", p.String(), "-machine", "memory-backend=mem0"), nil
+	}
+
+	_, topology, err := resolveCPUTopology(vm)
+	if err != nil {
+		return nil, err
+	}
+
+	cpuNodes := make([]int, topology.MaxCPUs)
+	total := int64(0)
+
+	for i, node := range vm.NUMANodes {
+		field := fmt.Sprintf("numa_node[%d]", i+1)
+		if node == nil {
+			return nil, fmt.Errorf("qemu: %s: not defined", field)
+		}
+
+		if node.Memory == "" {
+			return nil, fmt.Errorf("qemu: %s.memory: required", field)
+		}
+		if !reRAM.MatchString(node.Memory) {
+			return nil, fmt.Errorf("qemu: %s.memory: invalid RAM size (%s)", field, node.Memory)
+		}
+		size, err := ParseRAM(node.Memory)
+		if err != nil {
+			return nil, err
+		}
+		total += size
+
+		hostNodes := node.HostNodes
+		policy := node.Policy
+		if hostNodes == "" && policy == "" {
+			hostNodes = vm.MemoryBackend.HostNodes
+			policy = vm.MemoryBackend.Policy
+		}
+
+		id := fmt.Sprintf("mem%d", i)
+		p, err := memoryBackendParams(field, vm, id, size, hostNodes, policy)
+		if err != nil {
+			return nil, err
+		}
+
+		n := params{
+			&param{"driver", "node"},
+			&param{"nodeid", i},
+		}
+		if node.CPUs != "" {
+			cpus, err := parseIDList(node.CPUs)
+			if err != nil {
+				return nil, fmt.Errorf("qemu: %s.cpus: %s", field, err)
+			}
+			for _, r := range cpus {
+				if r.last >= topology.MaxCPUs {
+					return nil, fmt.Errorf("qemu: %s.cpus: vcpu %d out of range. must be lower than maxcpus (%d)",
+						field, r.last, topology.MaxCPUs)
+				}
+				for cpu := r.first; cpu <= r.last; cpu++ {
+					if cpuNodes[cpu] != 0 {
+						return nil, fmt.Errorf("qemu: %s.cpus: vcpu %d already assigned to numa_node[%d]",
+							field, cpu, cpuNodes[cpu])
+					}
+					cpuNodes[cpu] = i + 1
+				}
+				n = append(n, &param{"cpus", r.String()})
+			}
+		}
+		n = append(n, &param{"memdev", id})
+
+		rv = append(rv, "-object", p.String(), "-numa", n.String())
+	}
+
+	if total != ram {
+		return nil, fmt.Errorf("qemu: numa_node: total memory (%dM) must be equal to ram (%dM)",
+			total>>20, ram>>20)
+	}
+
+	return rv, nil
+}
+
+func validateNUMA(vm *VirtualMachine) error {
+	_, err := buildCmdNUMA(vm)
+	return err
+}
@@ -0,0 +1,130 @@
+package qemu
+
+import (
+	"testing"
+
+	. "github.com/rafaelmartins/simplevirt/internal/testutils"
+)
+
+func TestParseIDList(t *testing.T) {
+	val, err := parseIDList("0-3,8,10-11")
+	AssertNonError(t, err)
+	AssertEqual(t, val, []*idRange{{0, 3}, {8, 8}, {10, 11}})
+
+	for _, list := range []string{"", "a", "1-", "-1", "3-1", "0,,1"} {
+		_, err := parseIDList(list)
+		AssertError(t, err, "invalid list ("+list+")")
+	}
+}
+
+func TestBuildCmdNUMA(t *testing.T) {
+	val, err := buildCmdNUMA(&VirtualMachine{RAM: "1G"})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{})
+
+	val, err = buildCmdNUMA(&VirtualMachine{
+		RAM: "1G",
+		MemoryBackend: MemoryBackend{
+			Type:      "memfd",
+			HugePages: true,
+			Prealloc:  true,
+			HostNodes: "0-1,3",
+		},
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-object", "memory-backend-memfd,id=mem0,size=1073741824,hugetlb=on,prealloc=on,host-nodes=0-1,host-nodes=3,policy=bind",
+		"-machine", "memory-backend=mem0",
+	})
+
+	val, err = buildCmdNUMA(&VirtualMachine{
+		MemoryBackend: MemoryBackend{
+			Type:      "file",
+			HugePages: true,
+		},
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-object", "memory-backend-file,id=mem0,size=134217728,mem-path=/dev/hugepages",
+		"-machine", "memory-backend=mem0",
+	})
+
+	val, err = buildCmdNUMA(&VirtualMachine{
+		CPUs: 4,
+		RAM:  "3G",
+		MemoryBackend: MemoryBackend{
+			Type:      "file",
+			Path:      "/mnt/huge",
+			HostNodes: "0",
+			Policy:    "preferred",
+		},
+		NUMANodes: []*NUMANode{
+			{CPUs: "0-1", Memory: "2G"},
+			{CPUs: "2,3", Memory: "1024", HostNodes: "1"},
+		},
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-object", "memory-backend-file,id=mem0,size=2147483648,mem-path=/mnt/huge,host-nodes=0,policy=preferred",
+		"-numa", "node,nodeid=0,cpus=0-1,memdev=mem0",
+		"-object", "memory-backend-file,id=mem1,size=1073741824,mem-path=/mnt/huge,host-nodes=1,policy=bind",
+		"-numa", "node,nodeid=1,cpus=2,cpus=3,memdev=mem1",
+	})
+
+	val, err = buildCmdNUMA(&VirtualMachine{
+		CPUs: 2,
+		RAM:  "1G",
+		NUMANodes: []*NUMANode{
+			{CPUs: "0-1", Memory: "0.5G"},
+			{Memory: "512M"},
+		},
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-object", "memory-backend-ram,id=mem0,size=536870912",
+		"-numa", "node,nodeid=0,cpus=0-1,memdev=mem0",
+		"-object", "memory-backend-ram,id=mem1,size=536870912",
+		"-numa", "node,nodeid=1,memdev=mem1",
+	})
+
+	for _, tc := range []struct {
+		vm  *VirtualMachine
+		err string
+	}{
+		{&VirtualMachine{MemoryBackend: MemoryBackend{Type: "bola"}},
+			"qemu: memory_backend.type: invalid value (bola). valid choices are: 'ram', 'memfd', 'file'"},
+		{&VirtualMachine{MemoryBackend: MemoryBackend{HugePages: true}},
+			"qemu: memory_backend.hugepages: not supported by ram backend"},
+		{&VirtualMachine{MemoryBackend: MemoryBackend{Type: "file"}},
+			"qemu: memory_backend.path: required by file backend"},
+		{&VirtualMachine{MemoryBackend: MemoryBackend{Type: "file", Path: "huge"}},
+			"qemu: memory_backend.path: path must be absolute"},
+		{&VirtualMachine{MemoryBackend: MemoryBackend{Type: "memfd", Path: "/mnt/huge"}},
+			"qemu: memory_backend.path: not supported by memfd backend"},
+		{&VirtualMachine{MemoryBackend: MemoryBackend{Policy: "interleave"}},
+			"qemu: memory_backend.policy: interleave requires host_nodes"},
+		{&VirtualMachine{MemoryBackend: MemoryBackend{HostNodes: "0", Policy: "default"}},
+			"qemu: memory_backend.policy: default doesn't support host_nodes"},
+		{&VirtualMachine{MemoryBackend: MemoryBackend{HostNodes: "0", Policy: "bola"}},
+			"qemu: memory_backend.policy: invalid value (bola). valid choices are: 'default', 'preferred', 'bind', 'interleave'"},
+		{&VirtualMachine{MemoryBackend: MemoryBackend{HostNodes: "a"}},
+			"qemu: memory_backend.host_nodes: invalid list (a)"},
+		{&VirtualMachine{NUMANodes: []*NUMANode{nil}},
+			"qemu: numa_node[1]: not defined"},
+		{&VirtualMachine{NUMANodes: []*NUMANode{{}}},
+			"qemu: numa_node[1].memory: required"},
+		{&VirtualMachine{NUMANodes: []*NUMANode{{Memory: "128M"}, {Memory: "10.5A"}}},
+			"qemu: numa_node[2].memory: invalid RAM size (10.5A)"},
+		{&VirtualMachine{NUMANodes: []*NUMANode{{Memory: "128M", Policy: "bind"}}},
+			"qemu: numa_node[1].policy: bind requires host_nodes"},
+		{&VirtualMachine{CPUs: 2, NUMANodes: []*NUMANode{{CPUs: "0-2", Memory: "128M"}}},
+			"qemu: numa_node[1].cpus: vcpu 2 out of range. must be lower than maxcpus (2)"},
+		{&VirtualMachine{CPUs: 2, NUMANodes: []*NUMANode{{CPUs: "0-1", Memory: "64M"}, {CPUs: "1", Memory: "64M"}}},
+			"qemu: numa_node[2].cpus: vcpu 1 already assigned to numa_node[1]"},
+		{&VirtualMachine{RAM: "1G", NUMANodes: []*NUMANode{{Memory: "512M"}, {Memory: "256M"}}},
+			"qemu: numa_node: total memory (768M) must be equal to ram (1024M)"},
+	} {
+		_, err := buildCmdNUMA(tc.vm)
+		AssertError(t, err, tc.err)
+	}
+}
@@ -0,0 +1,66 @@
+package qemu
+
+import (
+	"fmt"
+	"strings"
+)
+
+type param struct {
+	key   string
+	value interface{}
+}
+
+// params is an ordered list of options, that can be rendered as a command
+// line argument, or as the arguments of a QMP command. keys with dots are
+// nested objects in QMP.
+type params []*param
+
+func (p params) String() string {
+	rv := []string{}
+	for i, prm := range p {
+		value := ""
+		switch v := prm.value.(type) {
+		case bool:
+			value = onOff(v)
+		case string:
+			value = escapeParam(v)
+		default:
+			value = fmt.Sprintf("%v", v)
+		}
+
+		// devices and objects take the driver as the first, implied option
+		if i == 0 && prm.key == "driver" && p.isDevice() {
+			rv = append(rv, value)
+			continue
+		}
+		rv = append(rv, fmt.Sprintf("%s=%s", prm.key, value))
+	}
+	return strings.Join(rv, ",")
+}
+
+func (p params) isDevice() bool {
+	for _, prm := range p {
+		if prm.key == "node-name" {
+			return false
+		}
+	}
+	return true
+}
+
+func (p params) Map() map[string]interface{} {
+	rv := map[string]interface{}{}
+	for _, prm := range p {
+		keys := strings.Split(prm.key, ".")
+		m := rv
+		for _, key := range keys[:len(keys)-1] {
+			child, ok := m[key].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				m[key] = child
+			}
+			m = child
+		}
+		m[keys[len(keys)-1]] = prm.value
+	}
+	return rv
+}
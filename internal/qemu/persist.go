@@ -0,0 +1,188 @@
+package qemu
+
+import (
+	"fmt"
+	"reflect"
+
+	"gopkg.in/yaml.v2"
+)
+
+// the functions below edit the drives of a configuration file, keeping the
+// order of the keys and any other content. comments are lost, though.
+
+func loadDocument(data []byte) (yaml.MapSlice, int, []interface{}, error) {
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, -1, nil, err
+	}
+
+	for i, item := range doc {
+		if item.Key != "drives" {
+			continue
+		}
+		if item.Value == nil {
+			return doc, i, []interface{}{}, nil
+		}
+		drives, ok := item.Value.([]interface{})
+		if !ok {
+			return nil, -1, nil, fmt.Errorf("qemu: drives: invalid value")
+		}
+		return doc, i, drives, nil
+	}
+
+	return doc, -1, []interface{}{}, nil
+}
+
+func dumpDocument(doc yaml.MapSlice, key int, drives []interface{}) ([]byte, error) {
+	if key < 0 {
+		doc = append(doc, yaml.MapItem{Key: "drives", Value: drives})
+	} else {
+		doc[key].Value = drives
+	}
+
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure that we never write something that can't be read back
+	if _, err := LoadConfig(data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// pruneZero removes the keys with zero values, recursively.
+func pruneZero(doc yaml.MapSlice) yaml.MapSlice {
+	rv := yaml.MapSlice{}
+	for _, item := range doc {
+		if child, ok := item.Value.(yaml.MapSlice); ok {
+			child = pruneZero(child)
+			if len(child) == 0 {
+				continue
+			}
+			item.Value = child
+		} else if item.Value == nil || reflect.ValueOf(item.Value).IsZero() {
+			continue
+		}
+		rv = append(rv, item)
+	}
+	return rv
+}
+
+func driveDocument(drv *Drive) (yaml.MapSlice, error) {
+	data, err := yaml.Marshal(drv)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &rv); err != nil {
+		return nil, err
+	}
+
+	rv = pruneZero(rv)
+
+	// zero is a valid boot index
+	if drv.BootIndex != nil && *drv.BootIndex == 0 {
+		rv = append(rv, yaml.MapItem{Key: "bootindex", Value: 0})
+	}
+
+	return rv, nil
+}
+
+// SetConfigDriveKey sets a key of drive number idx. an empty value removes
+// the key.
+func SetConfigDriveKey(data []byte, idx int, key string, value string) ([]byte, error) {
+	doc, docKey, drives, err := loadDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if idx < 1 || idx > len(drives) {
+		return nil, fmt.Errorf("qemu: drive[%d]: not defined", idx)
+	}
+
+	drive, ok := drives[idx-1].(yaml.MapSlice)
+	if !ok {
+		return nil, fmt.Errorf("qemu: drive[%d]: invalid value", idx)
+	}
+
+	rv := yaml.MapSlice{}
+	found := false
+	for _, item := range drive {
+		if item.Key == key {
+			found = true
+			if value == "" {
+				continue
+			}
+			item.Value = value
+		}
+		rv = append(rv, item)
+	}
+	if !found && value != "" {
+		// file is the first key, as people usually write it
+		if key == "file" {
+			rv = append(yaml.MapSlice{{Key: key, Value: value}}, rv...)
+		} else {
+			rv = append(rv, yaml.MapItem{Key: key, Value: value})
+		}
+	}
+	drives[idx-1] = rv
+
+	return dumpDocument(doc, docKey, drives)
+}
+
+// SetConfigDriveFile sets the file of drive number idx. an empty file
+// removes it, e.g. for ejected cdroms.
+func SetConfigDriveFile(data []byte, idx int, file string) ([]byte, error) {
+	return SetConfigDriveKey(data, idx, "file", file)
+}
+
+func AppendConfigDrive(data []byte, drv *Drive) ([]byte, error) {
+	doc, key, drives, err := loadDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	drive, err := driveDocument(drv)
+	if err != nil {
+		return nil, err
+	}
+
+	return dumpDocument(doc, key, append(drives, drive))
+}
+
+// RemoveConfigDrive removes drive number idx. the drives after it without an
+// id get their current name as id, otherwise it would change when they move.
+func RemoveConfigDrive(data []byte, idx int) ([]byte, error) {
+	doc, key, drives, err := loadDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if idx < 1 || idx > len(drives) {
+		return nil, fmt.Errorf("qemu: drive[%d]: not defined", idx)
+	}
+
+	for j := idx; j < len(drives); j++ {
+		drive, ok := drives[j].(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("qemu: drive[%d]: invalid value", j+1)
+		}
+
+		found := false
+		for _, item := range drive {
+			if item.Key == "id" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			drives[j] = append(drive, yaml.MapItem{Key: "id", Value: fmt.Sprintf("drive%d", j+1)})
+		}
+	}
+
+	return dumpDocument(doc, key, append(drives[:idx-1], drives[idx:]...))
+}
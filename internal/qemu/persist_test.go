@@ -0,0 +1,123 @@
+package qemu
+
+import (
+	"testing"
+
+	. "github.com/rafaelmartins/simplevirt/internal/testutils"
+)
+
+var persistConfig = []byte(`# comment
+ram: 1G
+drives:
+  - file: /foo.img
+    format: raw
+  - media: cdrom
+    device: scsi-hd
+    format: raw
+nics:
+  - bridge: br0
+`)
+
+func TestSetConfigDriveFile(t *testing.T) {
+	val, err := SetConfigDriveFile(persistConfig, 2, "/foo.iso")
+	AssertNonError(t, err)
+	AssertEqual(t, string(val), `ram: 1G
+drives:
+- file: /foo.img
+  format: raw
+- file: /foo.iso
+  media: cdrom
+  device: scsi-hd
+  format: raw
+nics:
+- bridge: br0
+`)
+
+	val, err = SetConfigDriveFile(val, 2, "/bar.iso")
+	AssertNonError(t, err)
+	val, err = SetConfigDriveFile(val, 2, "")
+	AssertNonError(t, err)
+	AssertEqual(t, string(val), `ram: 1G
+drives:
+- file: /foo.img
+  format: raw
+- media: cdrom
+  device: scsi-hd
+  format: raw
+nics:
+- bridge: br0
+`)
+
+	val, err = SetConfigDriveKey(persistConfig, 1, "format", "qcow2")
+	AssertNonError(t, err)
+	val, err = SetConfigDriveKey(val, 1, "cache", "writeback")
+	AssertNonError(t, err)
+	AssertEqual(t, string(val), `ram: 1G
+drives:
+- file: /foo.img
+  format: qcow2
+  cache: writeback
+- media: cdrom
+  device: scsi-hd
+  format: raw
+nics:
+- bridge: br0
+`)
+
+	val, err = SetConfigDriveFile(persistConfig, 3, "/foo.iso")
+	AssertError(t, err, "qemu: drive[3]: not defined")
+	AssertEqual(t, val, []byte(nil))
+}
+
+func TestAppendRemoveConfigDrive(t *testing.T) {
+	zero := 0
+	val, err := AppendConfigDrive(persistConfig, &Drive{
+		File:      "/bar.img",
+		ID:        "bar",
+		Device:    "virtio-blk-pci",
+		Format:    "qcow2",
+		BootIndex: &zero,
+		Throttle:  DriveThrottle{IOPS: 100},
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, string(val), `ram: 1G
+drives:
+- file: /foo.img
+  format: raw
+- media: cdrom
+  device: scsi-hd
+  format: raw
+- file: /bar.img
+  format: qcow2
+  id: bar
+  device: virtio-blk-pci
+  throttle:
+    iops: 100
+  bootindex: 0
+nics:
+- bridge: br0
+`)
+
+	val, err = RemoveConfigDrive(val, 1)
+	AssertNonError(t, err)
+	AssertEqual(t, string(val), `ram: 1G
+drives:
+- media: cdrom
+  device: scsi-hd
+  format: raw
+  id: drive2
+- file: /bar.img
+  format: qcow2
+  id: bar
+  device: virtio-blk-pci
+  throttle:
+    iops: 100
+  bootindex: 0
+nics:
+- bridge: br0
+`)
+
+	val, err = RemoveConfigDrive(persistConfig, 0)
+	AssertError(t, err, "qemu: drive[0]: not defined")
+	AssertEqual(t, val, []byte(nil))
+}
@@ -13,18 +13,21 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-func ParseConfig(configDir string, name string) (*VirtualMachine, error) {
-	var cfg string
+func ConfigFile(configDir string, name string) (string, error) {
 	for _, value := range []string{name + ".yml", name + ".yaml"} {
 		value := filepath.Join(configDir, value)
 		if _, err := os.Stat(value); err == nil {
-			cfg = value
-			break
+			return value, nil
 		}
 	}
 
-	if cfg == "" {
-		return nil, fmt.Errorf("qemu: config: failed to find configuration file for virtual machine: %s", name)
+	return "", fmt.Errorf("qemu: config: failed to find configuration file for virtual machine: %s", name)
+}
+
+func ParseConfig(configDir string, name string) (*VirtualMachine, error) {
+	cfg, err := ConfigFile(configDir, name)
+	if err != nil {
+		return nil, err
 	}
 
 	data, err := ioutil.ReadFile(cfg)
@@ -32,18 +35,76 @@ func ParseConfig(configDir string, name string) (*VirtualMachine, error) {
 		return nil, err
 	}
 
-	config := VirtualMachine{
+	return LoadConfig(data)
+}
+
+// LoadConfig parses a virtual machine configuration, filling the defaults.
+func LoadConfig(data []byte) (*VirtualMachine, error) {
+	config := defaultConfig()
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func defaultConfig() *VirtualMachine {
+	return &VirtualMachine{
 		SystemTarget:    "x86_64",
 		EnableKVM:       true,
 		ShutdownTimeout: 60,
 		MaximumRetries:  5,
 		RunAs:           "nobody",
+		RestartPolicy:   RestartAlways,
+		RestartBackoff: RestartBackoff{
+			InitialDelay:  1,
+			Multiplier:    2,
+			MaximumDelay:  300,
+			SuccessWindow: 600,
+		},
 	}
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, err
+}
+
+func CheckName(name string) error {
+	if !reName.MatchString(name) {
+		return fmt.Errorf("qemu: invalid virtual machine name: %q", name)
+	}
+	return nil
+}
+
+// CheckConfig validates a virtual machine configuration by building its
+// command line, with placeholders for the values only known at runtime.
+func CheckConfig(name string, config *VirtualMachine) error {
+	if err := CheckName(name); err != nil {
+		return err
 	}
 
-	return &config, nil
+	if config == nil {
+		_, err := buildCmdVirtualMachine(nil)
+		return err
+	}
+
+	vm := *config
+	vm.SetName(name)
+	vm.SetQMP(name + ".sock")
+	vm.SetPIDFile(name + ".pid")
+	vm.SetConsole(name + ".console")
+
+	vm.NICs = []*NIC{}
+	for i, nic := range config.NICs {
+		if nic == nil {
+			vm.NICs = append(vm.NICs, nil)
+			continue
+		}
+		n := *nic
+		if n.Bridge != "" {
+			n.SetDevice(fmt.Sprintf("qtap%d", i))
+		}
+		vm.NICs = append(vm.NICs, &n)
+	}
+
+	_, err := buildCmdVirtualMachine(&vm)
+	return err
 }
 
 func ListConfigs(configDir string) ([]string, error) {
@@ -98,13 +159,28 @@ func findBinary(config *VirtualMachine) string {
 	return fmt.Sprintf("qemu-system-%s", config.SystemTarget)
 }
 
-func Run(config *VirtualMachine) error {
+// CommandLine returns the command line (binary and arguments) used to run
+// the virtual machine.
+func CommandLine(config *VirtualMachine) ([]string, error) {
 	args, err := buildCmdVirtualMachine(config)
 	if err != nil {
+		return nil, err
+	}
+
+	return append([]string{findBinary(config)}, args...), nil
+}
+
+func Run(config *VirtualMachine) error {
+	cmdline, err := CommandLine(config)
+	if err != nil {
+		return err
+	}
+
+	if err := CheckImages(config); err != nil {
 		return err
 	}
 
-	bin := findBinary(config)
+	bin, args := cmdline[0], cmdline[1:]
 
 	logutils.Notice.Printf("qemu: %s: calling %q with arguments: %q", config.name, bin, args)
 
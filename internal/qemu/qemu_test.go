@@ -0,0 +1,56 @@
+package qemu
+
+import (
+	"testing"
+
+	. "github.com/rafaelmartins/simplevirt/internal/testutils"
+)
+
+func TestCheckName(t *testing.T) {
+	AssertNonError(t, CheckName("bola"))
+	AssertNonError(t, CheckName("bola-1.example_com"))
+	AssertError(t, CheckName(""), "qemu: invalid virtual machine name: \"\"")
+	AssertError(t, CheckName(".bola"), "qemu: invalid virtual machine name: \".bola\"")
+	AssertError(t, CheckName("../bola"), "qemu: invalid virtual machine name: \"../bola\"")
+	AssertError(t, CheckName("bo la"), "qemu: invalid virtual machine name: \"bo la\"")
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfig([]byte("cpus: 2\nrestart_policy: never\n"))
+	AssertNonError(t, err)
+	AssertEqual(t, config.CPUs, 2)
+	AssertEqual(t, config.RestartPolicy, RestartNever)
+	AssertEqual(t, config.SystemTarget, "x86_64")
+	AssertEqual(t, config.RestartBackoff.MaximumDelay, 300)
+
+	_, err = LoadConfig([]byte("cpus: [\n"))
+	AssertNotEqual(t, err, nil)
+}
+
+func TestCheckConfig(t *testing.T) {
+	AssertError(t, CheckConfig("../bola", &VirtualMachine{}), "qemu: invalid virtual machine name: \"../bola\"")
+	AssertError(t, CheckConfig("bola", nil), "qemu: virtualmachine: not defined")
+	AssertError(t, CheckConfig("bola", &VirtualMachine{}), "qemu: drive: at least one drive must be defined")
+
+	config := &VirtualMachine{
+		Drives: []*Drive{
+			&Drive{File: "/foo.img"},
+		},
+		NICs: []*NIC{
+			&NIC{MACAddr: "52:54:00:fc:70:3b", Bridge: "br0"},
+		},
+		SerialConsole: true,
+	}
+	AssertNonError(t, CheckConfig("bola", config))
+
+	// placeholders must not leak into the configuration
+	AssertEqual(t, config.name, "")
+	AssertEqual(t, config.console, "")
+	AssertEqual(t, config.NICs[0].device, "")
+
+	config.NICs = append(config.NICs, nil)
+	AssertError(t, CheckConfig("bola", config), "qemu: nic[2]: not defined")
+
+	config.NICs = []*NIC{&NIC{MACAddr: "bola"}}
+	AssertError(t, CheckConfig("bola", config), "qemu: nic[1].mac_address: invalid value (address bola: invalid MAC address)")
+}
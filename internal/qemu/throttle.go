@@ -0,0 +1,130 @@
+package qemu
+
+import (
+	"fmt"
+)
+
+// DriveThrottle configures the I/O limits of a drive. zero means unlimited.
+// bps limits are in bytes per second, and the *_max values are the burst
+// limits, allowed for burst_length seconds.
+type DriveThrottle struct {
+	IOPS      int64 `yaml:"iops" json:"iops"`
+	IOPSRead  int64 `yaml:"iops_rd" json:"iops_rd"`
+	IOPSWrite int64 `yaml:"iops_wr" json:"iops_wr"`
+	BPS       int64 `yaml:"bps" json:"bps"`
+	BPSRead   int64 `yaml:"bps_rd" json:"bps_rd"`
+	BPSWrite  int64 `yaml:"bps_wr" json:"bps_wr"`
+
+	IOPSMax      int64 `yaml:"iops_max" json:"iops_max"`
+	IOPSReadMax  int64 `yaml:"iops_rd_max" json:"iops_rd_max"`
+	IOPSWriteMax int64 `yaml:"iops_wr_max" json:"iops_wr_max"`
+	BPSMax       int64 `yaml:"bps_max" json:"bps_max"`
+	BPSReadMax   int64 `yaml:"bps_rd_max" json:"bps_rd_max"`
+	BPSWriteMax  int64 `yaml:"bps_wr_max" json:"bps_wr_max"`
+
+	BurstLength int64 `yaml:"burst_length" json:"burst_length"`
+}
+
+type throttleLimit struct {
+	name   string
+	legacy string
+	value  int64
+	max    int64
+}
+
+func (t *DriveThrottle) limits() []*throttleLimit {
+	return []*throttleLimit{
+		{"iops", "iops-total", t.IOPS, t.IOPSMax},
+		{"iops_rd", "iops-read", t.IOPSRead, t.IOPSReadMax},
+		{"iops_wr", "iops-write", t.IOPSWrite, t.IOPSWriteMax},
+		{"bps", "bps-total", t.BPS, t.BPSMax},
+		{"bps_rd", "bps-read", t.BPSRead, t.BPSReadMax},
+		{"bps_wr", "bps-write", t.BPSWrite, t.BPSWriteMax},
+	}
+}
+
+// Enabled tells if any limit is set.
+func (t *DriveThrottle) Enabled() bool {
+	for _, l := range t.limits() {
+		if l.value != 0 || l.max != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// validateThrottle applies the same rules as qemu, so that errors are
+// reported before starting the virtual machine.
+func validateThrottle(prefix string, t *DriveThrottle) error {
+	for _, l := range t.limits() {
+		if l.value < 0 {
+			return fmt.Errorf("qemu: %s.%s: invalid value (%d)", prefix, l.name, l.value)
+		}
+		if l.max < 0 {
+			return fmt.Errorf("qemu: %s.%s_max: invalid value (%d)", prefix, l.name, l.max)
+		}
+		if l.max != 0 && l.value == 0 {
+			return fmt.Errorf("qemu: %s.%s_max: requires %s", prefix, l.name, l.name)
+		}
+		if l.max != 0 && l.max < l.value {
+			return fmt.Errorf("qemu: %s.%s_max: must not be smaller than %s", prefix, l.name, l.name)
+		}
+	}
+
+	if t.IOPS != 0 && (t.IOPSRead != 0 || t.IOPSWrite != 0) {
+		return fmt.Errorf("qemu: %s.iops: can't be used with iops_rd or iops_wr", prefix)
+	}
+	if t.BPS != 0 && (t.BPSRead != 0 || t.BPSWrite != 0) {
+		return fmt.Errorf("qemu: %s.bps: can't be used with bps_rd or bps_wr", prefix)
+	}
+
+	if t.BurstLength < 0 {
+		return fmt.Errorf("qemu: %s.burst_length: invalid value (%d)", prefix, t.BurstLength)
+	}
+
+	return nil
+}
+
+// Check validates the limits, e.g. before applying them to a running
+// virtual machine.
+func (t *DriveThrottle) Check() error {
+	return validateThrottle("throttle", t)
+}
+
+// throttleGroupParams returns the throttle-group object with the limits of a
+// -blockdev drive, used by its throttle filter node.
+func throttleGroupParams(id string, t *DriveThrottle) params {
+	rv := params{
+		{"driver", "throttle-group"},
+		{"id", id},
+	}
+	for _, l := range t.limits() {
+		if l.value != 0 {
+			rv = append(rv, &param{"x-" + l.legacy, l.value})
+		}
+		if l.max != 0 {
+			rv = append(rv, &param{"x-" + l.legacy + "-max", l.max})
+			if t.BurstLength != 0 {
+				rv = append(rv, &param{"x-" + l.legacy + "-max-length", t.BurstLength})
+			}
+		}
+	}
+	return rv
+}
+
+// throttleParams returns the -drive throttling options.
+func throttleParams(t *DriveThrottle) string {
+	rv := ""
+	for _, l := range t.limits() {
+		if l.value != 0 {
+			rv += fmt.Sprintf(",throttling.%s=%d", l.legacy, l.value)
+		}
+		if l.max != 0 {
+			rv += fmt.Sprintf(",throttling.%s-max=%d", l.legacy, l.max)
+			if t.BurstLength != 0 {
+				rv += fmt.Sprintf(",throttling.%s-max-length=%d", l.legacy, t.BurstLength)
+			}
+		}
+	}
+	return rv
+}
@@ -0,0 +1,91 @@
+package qemu
+
+import (
+	"testing"
+
+	. "github.com/rafaelmartins/simplevirt/internal/testutils"
+)
+
+func TestValidateThrottle(t *testing.T) {
+	AssertNonError(t, validateThrottle("throttle", &DriveThrottle{}))
+	AssertNonError(t, validateThrottle("throttle", &DriveThrottle{IOPS: 100, IOPSMax: 200, BPSRead: 10, BurstLength: 5}))
+
+	err := validateThrottle("throttle", &DriveThrottle{IOPS: -1})
+	AssertError(t, err, "qemu: throttle.iops: invalid value (-1)")
+
+	err = validateThrottle("throttle", &DriveThrottle{BPSWrite: 1, BPSWriteMax: -1})
+	AssertError(t, err, "qemu: throttle.bps_wr_max: invalid value (-1)")
+
+	err = validateThrottle("throttle", &DriveThrottle{IOPSReadMax: 10})
+	AssertError(t, err, "qemu: throttle.iops_rd_max: requires iops_rd")
+
+	err = validateThrottle("throttle", &DriveThrottle{BPS: 10, BPSMax: 5})
+	AssertError(t, err, "qemu: throttle.bps_max: must not be smaller than bps")
+
+	err = validateThrottle("throttle", &DriveThrottle{BPS: 10, BPSWrite: 5})
+	AssertError(t, err, "qemu: throttle.bps: can't be used with bps_rd or bps_wr")
+
+	err = validateThrottle("throttle", &DriveThrottle{BurstLength: -1})
+	AssertError(t, err, "qemu: throttle.burst_length: invalid value (-1)")
+}
+
+func TestBuildCmdDriveThrottle(t *testing.T) {
+	val, err := buildCmdDrive(1, &Drive{
+		File: "/foo.img",
+		Throttle: DriveThrottle{
+			IOPSRead:    100,
+			IOPSReadMax: 200,
+			BPS:         1000,
+			BurstLength: 10,
+		},
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-drive", "file=/foo.img,if=virtio,media=disk,cache=none" +
+			",throttling.iops-read=100,throttling.iops-read-max=200,throttling.iops-read-max-length=10" +
+			",throttling.bps-total=1000",
+	})
+
+	val, err = buildCmdDrive(2, &Drive{
+		File:     "/foo.img",
+		Throttle: DriveThrottle{IOPSMax: 200},
+	})
+	AssertError(t, err, "qemu: drive[2].throttle.iops_max: requires iops")
+	AssertEqual(t, val, n)
+
+	// blockdev drives get a throttle filter node on top of the image
+	val, err = buildCmdDrive(1, &Drive{
+		File:     "/foo.img",
+		Device:   "ide-hd",
+		Format:   "raw",
+		Throttle: DriveThrottle{IOPS: 100, BPSWrite: 1000, BPSWriteMax: 2000, BurstLength: 10},
+	})
+	AssertNonError(t, err)
+	AssertEqual(t, val, []string{
+		"-object", "throttle-group,id=drive1-throttle-group,x-iops-total=100" +
+			",x-bps-write=1000,x-bps-write-max=2000,x-bps-write-max-length=10",
+		"-blockdev", "driver=file,node-name=drive1-file,filename=/foo.img,cache.direct=on,cache.no-flush=off",
+		"-blockdev", "driver=raw,node-name=drive1-format,file=drive1-file,cache.direct=on,cache.no-flush=off",
+		"-blockdev", "driver=throttle,node-name=drive1-throttle,throttle-group=drive1-throttle-group,file=drive1-format",
+		"-device", "ide-hd,id=drive1,drive=drive1-throttle,write-cache=on",
+	})
+
+	val, err = buildCmdDrive(1, &Drive{
+		File:     "/foo.img",
+		Device:   "ide-hd",
+		Format:   "raw",
+		Throttle: DriveThrottle{IOPS: 100, IOPSRead: 10},
+	})
+	AssertError(t, err, "qemu: drive[1].throttle.iops: can't be used with iops_rd or iops_wr")
+	AssertEqual(t, val, n)
+
+	val, err = buildCmdDrive(1, &Drive{
+		File:     "/foo.iso",
+		Device:   "ide-hd",
+		Format:   "raw",
+		Media:    "cdrom",
+		Throttle: DriveThrottle{IOPS: 100},
+	})
+	AssertError(t, err, "qemu: drive[1].throttle: not supported by cdrom drives with device")
+	AssertEqual(t, val, n)
+}
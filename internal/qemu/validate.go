@@ -0,0 +1,227 @@
+package qemu
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+var (
+	reYAMLError   = regexp.MustCompile(`^(?:yaml: )?line ([0-9]+): (.*)$`)
+	reYAMLUnknown = regexp.MustCompile(`^field (.+) not found in type .*$`)
+	reErrorField  = regexp.MustCompile(`^qemu: ([a-z_]+(?:\[[0-9]+\])?(?:\.[a-z_]+(?:\[[0-9]+\])?)*): (.*)$`)
+	reFieldParent = regexp.MustCompile(`(\.[^\.\[]+|\[[0-9]+\])$`)
+)
+
+type ConfigError struct {
+	Line    int
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("qemu: line %d: %s", e.Line, e.Message)
+	}
+	return fmt.Sprintf("qemu: %s", e.Message)
+}
+
+// ConfigErrors is returned by ValidateConfig, with all the errors found in
+// a configuration.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	errs := []string{}
+	for _, err := range e {
+		errs = append(errs, err.Error())
+	}
+	return strings.Join(errs, "\n")
+}
+
+// yamlLines maps the paths of the keys and list items found in a YAML
+// document (e.g. "drives[1].file") to their line numbers.
+func yamlLines(data []byte) map[string]int {
+	rv := map[string]int{}
+
+	doc := yaml3.Node{}
+	if err := yaml3.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+		return rv
+	}
+
+	var walk func(node *yaml3.Node, path string)
+	walk = func(node *yaml3.Node, path string) {
+		switch node.Kind {
+		case yaml3.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := node.Content[i]
+				if key.Kind != yaml3.ScalarNode {
+					continue
+				}
+				p := key.Value
+				if path != "" {
+					p = path + "." + p
+				}
+				if _, ok := rv[p]; ok {
+					continue
+				}
+				rv[p] = key.Line
+				walk(node.Content[i+1], p)
+			}
+		case yaml3.SequenceNode:
+			for i, item := range node.Content {
+				p := fmt.Sprintf("%s[%d]", path, i+1)
+				rv[p] = item.Line
+				walk(item, p)
+			}
+		}
+	}
+	walk(doc.Content[0], "")
+
+	return rv
+}
+
+// fieldLine returns the line where field is defined, or the line of its
+// closest defined parent.
+func fieldLine(lines map[string]int, field string) int {
+	for field != "" {
+		if line, ok := lines[field]; ok {
+			return line
+		}
+		parent := reFieldParent.ReplaceAllString(field, "")
+		if parent == field {
+			break
+		}
+		field = parent
+	}
+	return 0
+}
+
+// errors are named after the singular form of the list fields
+func fieldPath(field string) string {
+	for _, name := range []string{"drive", "nic", "numa_node"} {
+		if field == name || strings.HasPrefix(field, name+"[") {
+			return name + "s" + strings.TrimPrefix(field, name)
+		}
+	}
+	return field
+}
+
+func yamlErrors(err error) ConfigErrors {
+	msgs := []string{err.Error()}
+	if terr, ok := err.(*yaml.TypeError); ok {
+		msgs = terr.Errors
+	}
+
+	rv := ConfigErrors{}
+	for _, msg := range msgs {
+		cerr := &ConfigError{Message: msg}
+		if m := reYAMLError.FindStringSubmatch(msg); m != nil {
+			cerr.Line, _ = strconv.Atoi(m[1])
+			cerr.Message = m[2]
+			if m := reYAMLUnknown.FindStringSubmatch(m[2]); m != nil {
+				cerr.Message = fmt.Sprintf("unknown key: %s", m[1])
+			}
+		}
+		rv = append(rv, cerr)
+	}
+	return rv
+}
+
+// ValidateConfig parses and validates a virtual machine configuration,
+// rejecting unknown keys. instead of stopping at the first error, like
+// ParseConfig and CommandLine do, it returns all the errors found, as
+// ConfigErrors. only the configuration itself is checked: the images of the
+// drives may not exist yet, and are checked when starting, by CheckImages.
+func ValidateConfig(name string, data []byte) (*VirtualMachine, error) {
+	rv := ConfigErrors{}
+
+	if err := CheckName(name); err != nil {
+		rv = append(rv, &ConfigError{Message: strings.TrimPrefix(err.Error(), "qemu: ")})
+	}
+
+	config := defaultConfig()
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		rv = append(rv, yamlErrors(err)...)
+
+		// type errors are collected while decoding the whole document, but
+		// syntax errors leave us with nothing else to validate
+		if _, ok := err.(*yaml.TypeError); !ok {
+			return nil, rv
+		}
+	}
+
+	lines := yamlLines(data)
+
+	add := func(field string, err error) {
+		if err == nil {
+			return
+		}
+		msg := strings.TrimPrefix(err.Error(), "qemu: ")
+		if field == "" {
+			if m := reErrorField.FindStringSubmatch(err.Error()); m != nil {
+				field = fieldPath(m[1])
+			}
+		}
+		rv = append(rv, &ConfigError{Line: fieldLine(lines, field), Message: msg})
+	}
+
+	add("", validateRestart(config))
+	add("backup_dir", validateBackupDir(config))
+
+	// numa nodes depend on valid vcpus and ram, pinning on valid vcpus
+	topologyErr := validateCPUTopology(config)
+	add("", topologyErr)
+
+	if config.RAM != "" && !reRAM.MatchString(config.RAM) {
+		add("ram", fmt.Errorf("qemu: ram: invalid RAM size (%s)", config.RAM))
+	} else if topologyErr == nil {
+		add("", validateNUMA(config))
+	}
+	if topologyErr == nil {
+		add("", validateCPUPinning(config))
+	}
+	add("", validateCgroup(config))
+
+	if len(config.Drives) == 0 {
+		add("drives", fmt.Errorf("qemu: drive: at least one drive must be defined"))
+	}
+	for i, drv := range config.Drives {
+		if drv == nil {
+			add(fmt.Sprintf("drives[%d]", i+1), fmt.Errorf("qemu: drive[%d]: not defined", i+1))
+			continue
+		}
+		_, err := buildCmdDrive(i+1, drv)
+		add("", err)
+	}
+
+	if len(config.NICs) == 0 {
+		add("nics", fmt.Errorf("qemu: nic: at least one NIC must be defined"))
+	}
+	for i, nc := range config.NICs {
+		if nc == nil {
+			add(fmt.Sprintf("nics[%d]", i+1), fmt.Errorf("qemu: nic[%d]: not defined", i+1))
+			continue
+		}
+		n := *nc
+		if n.Bridge != "" {
+			n.SetDevice(fmt.Sprintf("qtap%d", i))
+		}
+		_, err := buildCmdNIC(i+1, &n)
+		add("", err)
+	}
+
+	// the checks above are meant to find as many errors as possible, but
+	// the configuration is only valid if the command line can be built
+	if len(rv) == 0 && CheckName(name) == nil {
+		add("", CheckConfig(name, config))
+	}
+
+	if len(rv) > 0 {
+		return nil, rv
+	}
+
+	return config, nil
+}
@@ -0,0 +1,139 @@
+package qemu
+
+import (
+	"testing"
+
+	. "github.com/rafaelmartins/simplevirt/internal/testutils"
+)
+
+func TestYAMLLines(t *testing.T) {
+	lines := yamlLines([]byte(`# comment
+auto_start: true
+drives:
+  - file: /foo.img
+    interface: ide
+
+  - file: /bar.img
+nics:
+- mac_address: 52:54:00:fc:70:3b
+  net_user_args:
+    "hostfwd": tcp::2222-:22
+- bridge: br0
+restart_backoff:
+  initial_delay: 5
+additional_args:
+  - -foo
+  - bar
+`))
+
+	AssertEqual(t, lines, map[string]int{
+		"auto_start":                    2,
+		"drives":                        3,
+		"drives[1]":                     4,
+		"drives[1].file":                4,
+		"drives[1].interface":           5,
+		"drives[2]":                     7,
+		"drives[2].file":                7,
+		"nics":                          8,
+		"nics[1]":                       9,
+		"nics[1].mac_address":           9,
+		"nics[1].net_user_args":         10,
+		"nics[1].net_user_args.hostfwd": 11,
+		"nics[2]":                       12,
+		"nics[2].bridge":                12,
+		"restart_backoff":               13,
+		"restart_backoff.initial_delay": 14,
+		"additional_args":               15,
+		"additional_args[1]":            16,
+		"additional_args[2]":            17,
+	})
+
+	AssertEqual(t, fieldLine(lines, "drives[2].cache"), 7)
+	AssertEqual(t, fieldLine(lines, "drives[3].file"), 3)
+	AssertEqual(t, fieldLine(lines, "ram"), 0)
+
+	lines = yamlLines([]byte(`drives: [{file: /foo.img}, {file: /bar.img,
+  cache: none}]
+`))
+	AssertEqual(t, lines, map[string]int{
+		"drives":          1,
+		"drives[1]":       1,
+		"drives[1].file":  1,
+		"drives[2]":       1,
+		"drives[2].file":  1,
+		"drives[2].cache": 2,
+	})
+
+	AssertEqual(t, yamlLines([]byte("drives: [\n")), map[string]int{})
+}
+
+func TestValidateConfig(t *testing.T) {
+	config, err := ValidateConfig("bola", []byte(`drives:
+  - file: /foo.img
+  - file: /bar.qcow2
+    format: qcow2
+nics:
+  - mac_address: 52:54:00:fc:70:3b
+    bridge: br0
+serial_console: true
+`))
+	AssertNonError(t, err)
+	AssertEqual(t, config.Drives[0].File, "/foo.img")
+	AssertEqual(t, config.Drives[1].Format, "qcow2")
+	AssertEqual(t, config.NICs[0].device, "")
+
+	config, err = ValidateConfig("bola", []byte("drives: [\n"))
+	AssertEqual(t, config, (*VirtualMachine)(nil))
+	AssertError(t, err, "qemu: line 1: did not find expected node content")
+
+	config, err = ValidateConfig(".bola", []byte(`foo: bar
+cpus: lala
+ram: 10.5A
+drives:
+  - file: foo.img
+  - file: /bar.img
+    cache: bola
+nics:
+  - mac_address: 52:54:00:fc:70:3b
+  - mac_address: bola
+restart_policy: sometimes
+restart_backoff:
+  multiplier: 0.5
+`))
+	AssertEqual(t, config, (*VirtualMachine)(nil))
+	AssertError(t, err, `qemu: invalid virtual machine name: ".bola"
+qemu: line 1: unknown key: foo
+qemu: line 2: cannot unmarshal !!str `+"`lala`"+` into int
+qemu: line 11: restart_policy: invalid value (sometimes). valid choices are: 'always', 'on-failure', 'on-crash', 'never'
+qemu: line 3: ram: invalid RAM size (10.5A)
+qemu: line 5: drive[1].file: path must be absolute
+qemu: line 7: drive[2].cache: invalid value (bola). valid choices are: 'none', 'writeback', 'unsafe', 'directsync', 'writethrough'
+qemu: line 10: nic[2].mac_address: invalid value (address bola: invalid MAC address)`)
+
+	_, err = ValidateConfig("bola", []byte(`ram: 1G
+numa_nodes:
+  - memory: 512M
+  - memory: 256M
+    policy: bind
+drives:
+  - file: /foo.img
+nics:
+  - mac_address: 52:54:00:fc:70:3b
+`))
+	AssertError(t, err, "qemu: line 5: numa_node[2].policy: bind requires host_nodes")
+
+	_, err = ValidateConfig("bola", []byte(`cgroup:
+  io_max:
+    - device: 8:0
+    - device: sda
+drives:
+  - file: /foo.img
+nics:
+  - mac_address: 52:54:00:fc:70:3b
+`))
+	AssertError(t, err, "qemu: line 4: cgroup.io_max[2].device: invalid value (sda). must be an absolute path or MAJOR:MINOR")
+
+	_, err = ValidateConfig("bola", []byte("cpus: 1\n"))
+	AssertError(t, err, `qemu: drive: at least one drive must be defined
+qemu: nic: at least one NIC must be defined`)
+}
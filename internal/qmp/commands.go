@@ -0,0 +1,499 @@
+package qmp
+
+import (
+	"context"
+)
+
+type QueryStatusResponse struct {
+	Status  string `json:"status"`
+	Running bool   `json:"running"`
+}
+
+type ImageInfo struct {
+	Filename        string     `json:"filename"`
+	Format          string     `json:"format"`
+	VirtualSize     int64      `json:"virtual-size"`
+	ActualSize      int64      `json:"actual-size,omitempty"`
+	DirtyFlag       bool       `json:"dirty-flag,omitempty"`
+	BackingFilename string     `json:"backing-filename,omitempty"`
+	BackingImage    *ImageInfo `json:"backing-image,omitempty"`
+}
+
+type BlockDeviceInfo struct {
+	File             string     `json:"file"`
+	NodeName         string     `json:"node-name,omitempty"`
+	ReadOnly         bool       `json:"ro"`
+	Driver           string     `json:"drv"`
+	BackingFile      string     `json:"backing_file,omitempty"`
+	BackingFileDepth int        `json:"backing_file_depth"`
+	Encrypted        bool       `json:"encrypted"`
+	DetectZeroes     string     `json:"detect_zeroes"`
+	Cache            BlockCache `json:"cache"`
+	Image            *ImageInfo `json:"image,omitempty"`
+	BPS              int64      `json:"bps"`
+	BPSRead          int64      `json:"bps_rd"`
+	BPSWrite         int64      `json:"bps_wr"`
+	IOPS             int64      `json:"iops"`
+	IOPSRead         int64      `json:"iops_rd"`
+	IOPSWrite        int64      `json:"iops_wr"`
+}
+
+type BlockCache struct {
+	Writeback bool `json:"writeback"`
+	Direct    bool `json:"direct"`
+	NoFlush   bool `json:"no-flush"`
+}
+
+type BlockInfo struct {
+	Device    string           `json:"device"`
+	QDev      string           `json:"qdev,omitempty"`
+	Type      string           `json:"type"`
+	Removable bool             `json:"removable"`
+	Locked    bool             `json:"locked"`
+	TrayOpen  bool             `json:"tray_open,omitempty"`
+	IOStatus  string           `json:"io-status,omitempty"`
+	Inserted  *BlockDeviceInfo `json:"inserted,omitempty"`
+}
+
+// BlockStats are the I/O counters of a block device, since qemu started.
+// blockdev devices only have QDev set.
+type BlockStats struct {
+	Device string           `json:"device"`
+	QDev   string           `json:"qdev,omitempty"`
+	Stats  BlockDeviceStats `json:"stats"`
+}
+
+type BlockDeviceStats struct {
+	ReadBytes       int64 `json:"rd_bytes"`
+	WriteBytes      int64 `json:"wr_bytes"`
+	ReadOperations  int64 `json:"rd_operations"`
+	WriteOperations int64 `json:"wr_operations"`
+}
+
+type CPUInstanceProperties struct {
+	NodeID   *int `json:"node-id,omitempty"`
+	SocketID *int `json:"socket-id,omitempty"`
+	DieID    *int `json:"die-id,omitempty"`
+	CoreID   *int `json:"core-id,omitempty"`
+	ThreadID *int `json:"thread-id,omitempty"`
+}
+
+type CPUInfoFast struct {
+	CPUIndex int                   `json:"cpu-index"`
+	QOMPath  string                `json:"qom-path"`
+	ThreadID int                   `json:"thread-id"`
+	Target   string                `json:"target"`
+	Props    CPUInstanceProperties `json:"props"`
+}
+
+// HotpluggableCPU is a vcpu slot. QOMPath is only set for the slots with a
+// vcpu plugged.
+type HotpluggableCPU struct {
+	Type       string                `json:"type"`
+	VCPUsCount int                   `json:"vcpus-count"`
+	Props      CPUInstanceProperties `json:"props"`
+	QOMPath    string                `json:"qom-path,omitempty"`
+}
+
+type BalloonInfo struct {
+	Actual int64 `json:"actual"`
+}
+
+type VersionTriple struct {
+	Major int `json:"major"`
+	Minor int `json:"minor"`
+	Micro int `json:"micro"`
+}
+
+type VersionInfo struct {
+	QEMU    VersionTriple `json:"qemu"`
+	Package string        `json:"package"`
+}
+
+type VNCClientInfo struct {
+	Host    string `json:"host"`
+	Service string `json:"service"`
+	Family  string `json:"family"`
+}
+
+type VNCInfo struct {
+	Enabled bool             `json:"enabled"`
+	Host    string           `json:"host,omitempty"`
+	Service string           `json:"service,omitempty"`
+	Family  string           `json:"family,omitempty"`
+	Auth    string           `json:"auth,omitempty"`
+	Clients []*VNCClientInfo `json:"clients,omitempty"`
+}
+
+type ChardevInfo struct {
+	Label        string `json:"label"`
+	Filename     string `json:"filename"`
+	FrontendOpen bool   `json:"frontend-open"`
+}
+
+func (s *Session) Powerdown(ctx context.Context) error {
+	return s.Execute(ctx, "system_powerdown", nil, nil)
+}
+
+func (s *Session) Reset(ctx context.Context) error {
+	return s.Execute(ctx, "system_reset", nil, nil)
+}
+
+func (s *Session) Stop(ctx context.Context) error {
+	return s.Execute(ctx, "stop", nil, nil)
+}
+
+func (s *Session) Cont(ctx context.Context) error {
+	return s.Execute(ctx, "cont", nil, nil)
+}
+
+func (s *Session) QueryStatus(ctx context.Context) (*QueryStatusResponse, error) {
+	rv := &QueryStatusResponse{}
+	if err := s.Execute(ctx, "query-status", nil, rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (s *Session) QueryBlock(ctx context.Context) ([]*BlockInfo, error) {
+	rv := []*BlockInfo{}
+	if err := s.Execute(ctx, "query-block", nil, &rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// QueryNamedBlockNodes lists all the block nodes, including the ones below
+// the top node of each drive.
+func (s *Session) QueryNamedBlockNodes(ctx context.Context) ([]*BlockDeviceInfo, error) {
+	rv := []*BlockDeviceInfo{}
+	if err := s.Execute(ctx, "query-named-block-nodes", nil, &rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (s *Session) QueryBlockStats(ctx context.Context) ([]*BlockStats, error) {
+	rv := []*BlockStats{}
+	if err := s.Execute(ctx, "query-blockstats", nil, &rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (s *Session) QueryCPUsFast(ctx context.Context) ([]*CPUInfoFast, error) {
+	rv := []*CPUInfoFast{}
+	if err := s.Execute(ctx, "query-cpus-fast", nil, &rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (s *Session) QueryHotpluggableCPUs(ctx context.Context) ([]*HotpluggableCPU, error) {
+	rv := []*HotpluggableCPU{}
+	if err := s.Execute(ctx, "query-hotpluggable-cpus", nil, &rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (s *Session) QueryBalloon(ctx context.Context) (*BalloonInfo, error) {
+	rv := &BalloonInfo{}
+	if err := s.Execute(ctx, "query-balloon", nil, rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// Balloon asks the guest to change its memory to value bytes.
+func (s *Session) Balloon(ctx context.Context, value int64) error {
+	return s.Execute(ctx, "balloon", map[string]int64{"value": value}, nil)
+}
+
+func (s *Session) QueryVersion(ctx context.Context) (*VersionInfo, error) {
+	rv := &VersionInfo{}
+	if err := s.Execute(ctx, "query-version", nil, rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (s *Session) QueryVNC(ctx context.Context) (*VNCInfo, error) {
+	rv := &VNCInfo{}
+	if err := s.Execute(ctx, "query-vnc", nil, rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (s *Session) QueryChardev(ctx context.Context) ([]*ChardevInfo, error) {
+	rv := []*ChardevInfo{}
+	if err := s.Execute(ctx, "query-chardev", nil, &rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// BlockIOThrottle is the argument of block_set_io_throttle. the drive is
+// selected by either Device (the legacy drive name) or ID (the qdev id).
+type BlockIOThrottle struct {
+	Device             string `json:"device,omitempty"`
+	ID                 string `json:"id,omitempty"`
+	BPS                int64  `json:"bps"`
+	BPSRead            int64  `json:"bps_rd"`
+	BPSWrite           int64  `json:"bps_wr"`
+	IOPS               int64  `json:"iops"`
+	IOPSRead           int64  `json:"iops_rd"`
+	IOPSWrite          int64  `json:"iops_wr"`
+	BPSMax             int64  `json:"bps_max,omitempty"`
+	BPSReadMax         int64  `json:"bps_rd_max,omitempty"`
+	BPSWriteMax        int64  `json:"bps_wr_max,omitempty"`
+	IOPSMax            int64  `json:"iops_max,omitempty"`
+	IOPSReadMax        int64  `json:"iops_rd_max,omitempty"`
+	IOPSWriteMax       int64  `json:"iops_wr_max,omitempty"`
+	BPSMaxLength       int64  `json:"bps_max_length,omitempty"`
+	BPSReadMaxLength   int64  `json:"bps_rd_max_length,omitempty"`
+	BPSWriteMaxLength  int64  `json:"bps_wr_max_length,omitempty"`
+	IOPSMaxLength      int64  `json:"iops_max_length,omitempty"`
+	IOPSReadMaxLength  int64  `json:"iops_rd_max_length,omitempty"`
+	IOPSWriteMaxLength int64  `json:"iops_wr_max_length,omitempty"`
+}
+
+func (s *Session) BlockSetIOThrottle(ctx context.Context, throttle *BlockIOThrottle) error {
+	return s.Execute(ctx, "block_set_io_throttle", throttle, nil)
+}
+
+// ThrottleLimits is the limits property of a throttle-group object. qemu
+// only changes the limits that are set, so all of them are sent.
+type ThrottleLimits struct {
+	IOPSTotal          int64 `json:"iops-total"`
+	IOPSTotalMax       int64 `json:"iops-total-max"`
+	IOPSTotalMaxLength int64 `json:"iops-total-max-length"`
+	IOPSRead           int64 `json:"iops-read"`
+	IOPSReadMax        int64 `json:"iops-read-max"`
+	IOPSReadMaxLength  int64 `json:"iops-read-max-length"`
+	IOPSWrite          int64 `json:"iops-write"`
+	IOPSWriteMax       int64 `json:"iops-write-max"`
+	IOPSWriteMaxLength int64 `json:"iops-write-max-length"`
+	BPSTotal           int64 `json:"bps-total"`
+	BPSTotalMax        int64 `json:"bps-total-max"`
+	BPSTotalMaxLength  int64 `json:"bps-total-max-length"`
+	BPSRead            int64 `json:"bps-read"`
+	BPSReadMax         int64 `json:"bps-read-max"`
+	BPSReadMaxLength   int64 `json:"bps-read-max-length"`
+	BPSWrite           int64 `json:"bps-write"`
+	BPSWriteMax        int64 `json:"bps-write-max"`
+	BPSWriteMaxLength  int64 `json:"bps-write-max-length"`
+}
+
+// BlockdevChangeMedium changes the media of a removable drive, selected by
+// either device (the legacy drive name) or id (the qdev id).
+func (s *Session) BlockdevChangeMedium(ctx context.Context, device string, id string, filename string, format string) error {
+	args := map[string]interface{}{"filename": filename}
+	if device != "" {
+		args["device"] = device
+	}
+	if id != "" {
+		args["id"] = id
+	}
+	if format != "" {
+		args["format"] = format
+	}
+	return s.Execute(ctx, "blockdev-change-medium", args, nil)
+}
+
+// Eject ejects the media of a removable drive, selected by either device or
+// id, like BlockdevChangeMedium.
+func (s *Session) Eject(ctx context.Context, device string, id string, force bool) error {
+	args := map[string]interface{}{"force": force}
+	if device != "" {
+		args["device"] = device
+	}
+	if id != "" {
+		args["id"] = id
+	}
+	return s.Execute(ctx, "eject", args, nil)
+}
+
+func (s *Session) BlockdevAdd(ctx context.Context, options map[string]interface{}) error {
+	return s.Execute(ctx, "blockdev-add", options, nil)
+}
+
+func (s *Session) BlockdevDel(ctx context.Context, nodeName string) error {
+	return s.Execute(ctx, "blockdev-del", map[string]string{"node-name": nodeName}, nil)
+}
+
+// DeviceAdd adds a device. options must include the driver and the id.
+func (s *Session) DeviceAdd(ctx context.Context, options map[string]interface{}) error {
+	return s.Execute(ctx, "device_add", options, nil)
+}
+
+// DeviceDel requests the removal of a device. the removal is only complete
+// when the guest acknowledges it, and the DEVICE_DELETED event is emitted.
+func (s *Session) DeviceDel(ctx context.Context, id string) error {
+	return s.Execute(ctx, "device_del", map[string]string{"id": id}, nil)
+}
+
+func (s *Session) ObjectAdd(ctx context.Context, qomType string, id string) error {
+	return s.Execute(ctx, "object-add", map[string]string{"qom-type": qomType, "id": id}, nil)
+}
+
+// ObjectAddOptions adds an object with properties. options must include the
+// qom-type and the id.
+func (s *Session) ObjectAddOptions(ctx context.Context, options map[string]interface{}) error {
+	return s.Execute(ctx, "object-add", options, nil)
+}
+
+func (s *Session) ObjectDel(ctx context.Context, id string) error {
+	return s.Execute(ctx, "object-del", map[string]string{"id": id}, nil)
+}
+
+// QOMSet sets a property of a QOM object. objects created with object-add
+// are children of /objects.
+func (s *Session) QOMSet(ctx context.Context, path string, property string, value interface{}) error {
+	args := map[string]interface{}{"path": path, "property": property, "value": value}
+	return s.Execute(ctx, "qom-set", args, nil)
+}
+
+// BlockdevSnapshotSync is the argument of blockdev-snapshot-sync, that
+// creates an external snapshot: a new image, backed by the current one, that
+// becomes the active layer of the drive.
+type BlockdevSnapshotSync struct {
+	Device           string `json:"device,omitempty"`
+	NodeName         string `json:"node-name,omitempty"`
+	SnapshotFile     string `json:"snapshot-file"`
+	SnapshotNodeName string `json:"snapshot-node-name,omitempty"`
+	Format           string `json:"format,omitempty"`
+	Mode             string `json:"mode,omitempty"`
+}
+
+type TransactionAction struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// Transaction executes actions atomically: either all of them succeed, or
+// none is applied.
+func (s *Session) Transaction(ctx context.Context, actions []*TransactionAction) error {
+	return s.Execute(ctx, "transaction", map[string]interface{}{"actions": actions}, nil)
+}
+
+// BlockCommit is the argument of block-commit. Top and Base are the file
+// names of the images, as opened by qemu. committing the active layer
+// (without Top) requires job-complete when the job is ready.
+type BlockCommit struct {
+	JobID       string `json:"job-id,omitempty"`
+	Device      string `json:"device"`
+	Top         string `json:"top,omitempty"`
+	Base        string `json:"base,omitempty"`
+	AutoDismiss *bool  `json:"auto-dismiss,omitempty"`
+}
+
+func (s *Session) BlockCommit(ctx context.Context, args *BlockCommit) error {
+	return s.Execute(ctx, "block-commit", args, nil)
+}
+
+type JobInfo struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	Status          string `json:"status"`
+	CurrentProgress int64  `json:"current-progress"`
+	TotalProgress   int64  `json:"total-progress"`
+	Error           string `json:"error,omitempty"`
+}
+
+func (s *Session) QueryJobs(ctx context.Context) ([]*JobInfo, error) {
+	rv := []*JobInfo{}
+	if err := s.Execute(ctx, "query-jobs", nil, &rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (s *Session) JobComplete(ctx context.Context, id string) error {
+	return s.Execute(ctx, "job-complete", map[string]string{"id": id}, nil)
+}
+
+func (s *Session) JobCancel(ctx context.Context, id string) error {
+	return s.Execute(ctx, "job-cancel", map[string]string{"id": id}, nil)
+}
+
+// JobDismiss removes a concluded job, created with auto-dismiss disabled.
+func (s *Session) JobDismiss(ctx context.Context, id string) error {
+	return s.Execute(ctx, "job-dismiss", map[string]string{"id": id}, nil)
+}
+
+// BlockDirtyBitmap is the argument of block-dirty-bitmap-add. only bitmaps
+// of qcow2 images can be persistent.
+type BlockDirtyBitmap struct {
+	Node       string `json:"node"`
+	Name       string `json:"name"`
+	Persistent bool   `json:"persistent,omitempty"`
+}
+
+func (s *Session) BlockDirtyBitmapAdd(ctx context.Context, bitmap *BlockDirtyBitmap) error {
+	return s.Execute(ctx, "block-dirty-bitmap-add", bitmap, nil)
+}
+
+func (s *Session) BlockDirtyBitmapRemove(ctx context.Context, node string, name string) error {
+	return s.Execute(ctx, "block-dirty-bitmap-remove", &BlockDirtyBitmap{Node: node, Name: name}, nil)
+}
+
+// DriveBackup is the argument of drive-backup. incremental backups (Sync
+// "incremental") copy the clusters marked in Bitmap, and clear it on
+// success.
+type DriveBackup struct {
+	JobID       string `json:"job-id,omitempty"`
+	Device      string `json:"device"`
+	Target      string `json:"target"`
+	Format      string `json:"format,omitempty"`
+	Sync        string `json:"sync"`
+	Mode        string `json:"mode,omitempty"`
+	Bitmap      string `json:"bitmap,omitempty"`
+	AutoDismiss *bool  `json:"auto-dismiss,omitempty"`
+}
+
+func (s *Session) DriveBackup(ctx context.Context, backup *DriveBackup) error {
+	return s.Execute(ctx, "drive-backup", backup, nil)
+}
+
+func (s *Session) Quit(ctx context.Context) error {
+	return s.Execute(ctx, "quit", nil, nil)
+}
+
+func (s *Session) Migrate(ctx context.Context, uri string) error {
+	return s.Execute(ctx, "migrate", map[string]string{"uri": uri}, nil)
+}
+
+func (s *Session) MigrateCancel(ctx context.Context) error {
+	return s.Execute(ctx, "migrate_cancel", nil, nil)
+}
+
+type MigrationStats struct {
+	Transferred int64 `json:"transferred"`
+	Remaining   int64 `json:"remaining"`
+	Total       int64 `json:"total"`
+}
+
+// SocketAddress is an address qemu listens on. only inet addresses are
+// supported.
+type SocketAddress struct {
+	Type string `json:"type"`
+	Host string `json:"host"`
+	Port string `json:"port"`
+}
+
+type MigrationInfo struct {
+	Status        string           `json:"status"`
+	RAM           *MigrationStats  `json:"ram,omitempty"`
+	ErrorDesc     string           `json:"error-desc,omitempty"`
+	SocketAddress []*SocketAddress `json:"socket-address,omitempty"`
+}
+
+func (s *Session) QueryMigrate(ctx context.Context) (*MigrationInfo, error) {
+	rv := &MigrationInfo{}
+	if err := s.Execute(ctx, "query-migrate", nil, rv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
@@ -2,122 +2,383 @@ package qmp
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/logutils"
 )
 
-type QMP struct {
-	Socket string
-}
+var (
+	ErrClosed       = errors.New("qmp: session closed")
+	ErrDisconnected = errors.New("qmp: disconnected")
+
+	DefaultTimeout    = 30 * time.Second
+	ReconnectInterval = 100 * time.Millisecond
+	EventsBufferSize  = 64
+)
 
 type qmpError struct {
 	Class string `json:"class"`
 	Desc  string `json:"desc"`
 }
 
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+	ID        string      `json:"id,omitempty"`
+}
+
 type qmpResponse struct {
 	Return *json.RawMessage `json:"return"`
 	Error  *qmpError        `json:"error"`
 	Hello  *interface{}     `json:"QMP"`
+	ID     *string          `json:"id"`
+	Event  string           `json:"event"`
 }
 
-type QueryStatusResponse struct {
-	Status  string `json:"status"`
-	Running bool   `json:"running"`
+type EventTimestamp struct {
+	Seconds      int64 `json:"seconds"`
+	Microseconds int64 `json:"microseconds"`
 }
 
-func qmpCall(r *bufio.Reader, w *bufio.Writer, command string) (*json.RawMessage, error) {
-	cmd, err := json.Marshal(map[string]string{"execute": command})
-	if err != nil {
-		return nil, err
+type Event struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp EventTimestamp  `json:"timestamp"`
+}
+
+// Session is a long-lived QMP connection. It correlates command replies by
+// id, forwards asynchronous events to the Events channel, and transparently
+// reconnects whenever the socket goes away and comes back (e.g. after the
+// virtual machine is restarted).
+type Session struct {
+	Socket string
+
+	events     chan *Event
+	mutex      sync.Mutex
+	writeMutex sync.Mutex
+	conn       net.Conn
+	ready      chan struct{}
+	lost       chan struct{}
+	pending    map[string]chan *qmpResponse
+	lastID     uint64
+	closed     bool
+	done       chan struct{}
+}
+
+func NewSession(socket string) (*Session, error) {
+	if socket == "" {
+		return nil, fmt.Errorf("qmp: empty QMP socket is not valid")
 	}
 
-	if _, err := w.Write(append(cmd, '\n')); err != nil {
-		return nil, err
+	s := &Session{
+		Socket:  socket,
+		events:  make(chan *Event, EventsBufferSize),
+		ready:   make(chan struct{}),
+		lost:    make(chan struct{}),
+		pending: make(map[string]chan *qmpResponse),
+		done:    make(chan struct{}),
 	}
+	close(s.lost)
 
-	if err := w.Flush(); err != nil {
-		return nil, err
+	go s.run()
+
+	return s, nil
+}
+
+// Events returns the channel where asynchronous QMP events are delivered.
+// It is closed when the session is closed.
+func (s *Session) Events() <-chan *Event {
+	return s.events
+}
+
+func (s *Session) Connected() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.conn != nil
+}
+
+// Disconnected returns a channel that is closed when the current connection
+// is lost, after the events read from it are delivered. It is already closed
+// if the session is not connected.
+func (s *Session) Disconnected() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.lost
+}
+
+func (s *Session) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
 	}
+	s.closed = true
+	close(s.done)
 
-	res, err := r.ReadBytes('\n')
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+
+	return nil
+}
+
+func (s *Session) nextID() string {
+	s.lastID++
+	return strconv.FormatUint(s.lastID, 10)
+}
+
+func readResponse(r *bufio.Reader) (*qmpResponse, error) {
+	line, err := r.ReadBytes('\n')
 	if err != nil {
 		return nil, err
 	}
 
 	resp := &qmpResponse{}
-	if err := json.Unmarshal(res, &resp); err != nil {
+	if err := json.Unmarshal(line, &resp); err != nil {
 		return nil, err
 	}
 
-	if resp.Error != nil {
-		return nil, fmt.Errorf("qmp: %s: %s", resp.Error.Class, resp.Error.Desc)
+	return resp, nil
+}
+
+func (s *Session) handshake(conn net.Conn, r *bufio.Reader) error {
+	resp, err := readResponse(r)
+	if err != nil {
+		return err
 	}
 
-	return resp.Return, nil
-}
+	if resp.Hello == nil {
+		return fmt.Errorf("qmp: invalid handshake")
+	}
 
-func (q *QMP) sendCommand(command string) (*json.RawMessage, error) {
-	if q.Socket == "" {
-		return nil, fmt.Errorf("qmp: empty QMP socket is not valid")
+	cmd, err := json.Marshal(&qmpCommand{Execute: "qmp_capabilities"})
+	if err != nil {
+		return err
 	}
 
-	conn, err := net.Dial("unix", q.Socket)
+	if _, err := conn.Write(append(cmd, '\n')); err != nil {
+		return err
+	}
+
+	// events are only emitted after capabilities negotiation, so the next
+	// message is our reply.
+	resp, err = readResponse(r)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer conn.Close()
 
-	r := bufio.NewReader(conn)
-	w := bufio.NewWriter(conn)
+	if resp.Error != nil {
+		return fmt.Errorf("qmp: %s: %s", resp.Error.Class, resp.Error.Desc)
+	}
+
+	return nil
+}
 
-	hello, err := r.ReadBytes('\n')
+func (s *Session) connect() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.Dial("unix", s.Socket)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	resp := &qmpResponse{}
-	if err := json.Unmarshal(hello, &resp); err != nil {
-		return nil, err
+	r := bufio.NewReader(conn)
+
+	if err := s.handshake(conn, r); err != nil {
+		conn.Close()
+		return nil, nil, err
 	}
 
-	if resp.Hello == nil {
-		return nil, fmt.Errorf("qmp: invalid handshake")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		conn.Close()
+		return nil, nil, ErrClosed
 	}
 
-	if _, err := qmpCall(r, w, "qmp_capabilities"); err != nil {
-		return nil, err
+	s.conn = conn
+	s.lost = make(chan struct{})
+	close(s.ready)
+
+	return conn, r, nil
+}
+
+func (s *Session) disconnect(conn net.Conn) {
+	conn.Close()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.conn = nil
+	s.ready = make(chan struct{})
+	close(s.lost)
+
+	for id, ch := range s.pending {
+		close(ch)
+		delete(s.pending, id)
 	}
+}
 
-	rv, err := qmpCall(r, w, command)
-	if err != nil {
-		return nil, err
+func (s *Session) dispatch(resp *qmpResponse, line []byte) {
+	if resp.Event != "" {
+		ev := &Event{}
+		if err := json.Unmarshal(line, ev); err != nil {
+			logutils.LogError(err)
+			return
+		}
+
+		select {
+		case s.events <- ev:
+		default:
+			logutils.Warning.Printf("qmp: %s: events buffer full, dropping %s", s.Socket, ev.Event)
+		}
+		return
 	}
 
-	return rv, nil
+	if resp.ID == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	ch, ok := s.pending[*resp.ID]
+	delete(s.pending, *resp.ID)
+	s.mutex.Unlock()
+
+	if ok {
+		ch <- resp
+	}
+}
+
+func (s *Session) readLoop(r *bufio.Reader) {
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		resp := &qmpResponse{}
+		if err := json.Unmarshal(line, &resp); err != nil {
+			logutils.LogError(err)
+			continue
+		}
+
+		s.dispatch(resp, line)
+	}
 }
 
-func (q *QMP) Powerdown() error {
-	_, err := q.sendCommand("system_powerdown")
-	return err
+func (s *Session) run() {
+	defer close(s.events)
+
+	for {
+		conn, r, err := s.connect()
+		if err == nil {
+			s.readLoop(r)
+			s.disconnect(conn)
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(ReconnectInterval):
+		}
+	}
 }
 
-func (q *QMP) Reset() error {
-	_, err := q.sendCommand("system_reset")
-	return err
+func (s *Session) waitReady(ctx context.Context) (net.Conn, error) {
+	for {
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			return nil, ErrClosed
+		}
+		conn := s.conn
+		ready := s.ready
+		s.mutex.Unlock()
+
+		if conn != nil {
+			return conn, nil
+		}
+
+		select {
+		case <-ready:
+		case <-s.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 }
 
-func (q *QMP) QueryStatus() (*QueryStatusResponse, error) {
-	cmd, err := q.sendCommand("query-status")
+func (s *Session) execute(ctx context.Context, command string, args interface{}) (*json.RawMessage, error) {
+	conn, err := s.waitReady(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *qmpResponse, 1)
+
+	s.mutex.Lock()
+	id := s.nextID()
+	s.pending[id] = ch
+	s.mutex.Unlock()
+
+	cancel := func() {
+		s.mutex.Lock()
+		delete(s.pending, id)
+		s.mutex.Unlock()
+	}
+
+	cmd, err := json.Marshal(&qmpCommand{Execute: command, Arguments: args, ID: id})
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
-	rv := &QueryStatusResponse{}
-	if err := json.Unmarshal(*cmd, &rv); err != nil {
+	s.writeMutex.Lock()
+	_, err = conn.Write(append(cmd, '\n'))
+	s.writeMutex.Unlock()
+	if err != nil {
+		cancel()
 		return nil, err
 	}
 
-	return rv, nil
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, ErrDisconnected
+		}
+		if resp.Error != nil {
+			return nil, fmt.Errorf("qmp: %s: %s", resp.Error.Class, resp.Error.Desc)
+		}
+		return resp.Return, nil
+
+	case <-ctx.Done():
+		cancel()
+		return nil, ctx.Err()
+	}
+}
+
+// Execute runs a QMP command with the given arguments (any value that
+// marshals to a JSON object, or nil) and unmarshals its return value into
+// result, if not nil.
+func (s *Session) Execute(ctx context.Context, command string, args interface{}, result interface{}) error {
+	rv, err := s.execute(ctx, command, args)
+	if err != nil {
+		return err
+	}
+
+	if result == nil || rv == nil {
+		return nil
+	}
+
+	return json.Unmarshal(*rv, result)
 }
@@ -0,0 +1,270 @@
+package qmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/rafaelmartins/simplevirt/internal/testutils"
+)
+
+type fakeCommand struct {
+	Execute   string          `json:"execute"`
+	Arguments json.RawMessage `json:"arguments"`
+	ID        string          `json:"id"`
+}
+
+// fakeServer emulates a QEMU QMP server. handler receives each command and
+// returns the lines (without id) to be written back. the reply line, if any,
+// must be the last one.
+type fakeServer struct {
+	listener net.Listener
+	handler  func(cmd *fakeCommand) []map[string]interface{}
+	conns    []net.Conn
+	mutex    sync.Mutex
+}
+
+func newFakeServer(t *testing.T, socket string, handler func(cmd *fakeCommand) []map[string]interface{}) *fakeServer {
+	t.Helper()
+
+	l, err := net.Listen("unix", socket)
+	AssertNonError(t, err)
+
+	srv := &fakeServer{listener: l, handler: handler}
+	go srv.serve()
+	return srv
+}
+
+func (f *fakeServer) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mutex.Lock()
+		f.conns = append(f.conns, conn)
+		f.mutex.Unlock()
+		go f.serveConn(conn)
+	}
+}
+
+func (f *fakeServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	enc := json.NewEncoder(conn)
+	enc.Encode(map[string]interface{}{"QMP": map[string]interface{}{}})
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := &fakeCommand{}
+		if err := json.Unmarshal(line, cmd); err != nil {
+			return
+		}
+
+		if cmd.Execute == "qmp_capabilities" {
+			enc.Encode(map[string]interface{}{"return": map[string]interface{}{}})
+			continue
+		}
+
+		msgs := f.handler(cmd)
+		for j, msg := range msgs {
+			if j == len(msgs)-1 {
+				if _, ok := msg["event"]; !ok {
+					msg["id"] = cmd.ID
+				}
+			}
+			enc.Encode(msg)
+		}
+	}
+}
+
+func (f *fakeServer) Close() {
+	f.listener.Close()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func tempSocket(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "qmp")
+	AssertNonError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return filepath.Join(dir, "qmp.sock")
+}
+
+func statusHandler(cmd *fakeCommand) []map[string]interface{} {
+	switch cmd.Execute {
+	case "query-status":
+		return []map[string]interface{}{
+			{"event": "STOP", "timestamp": map[string]int{"seconds": 1, "microseconds": 2}},
+			{"return": map[string]interface{}{"status": "paused", "running": false}},
+		}
+	}
+	return []map[string]interface{}{
+		{"error": map[string]string{"class": "CommandNotFound", "desc": "not found"}},
+	}
+}
+
+func TestSessionEmptySocket(t *testing.T) {
+	s, err := NewSession("")
+	AssertError(t, err, "qmp: empty QMP socket is not valid")
+	AssertEqual(t, s == nil, true)
+}
+
+func TestSessionEvents(t *testing.T) {
+	socket := tempSocket(t)
+	srv := newFakeServer(t, socket, statusHandler)
+	defer srv.Close()
+
+	s, err := NewSession(socket)
+	AssertNonError(t, err)
+	defer s.Close()
+
+	status, err := s.QueryStatus(context.Background())
+	AssertNonError(t, err)
+	AssertEqual(t, status, &QueryStatusResponse{Status: "paused", Running: false})
+
+	select {
+	case ev := <-s.Events():
+		AssertEqual(t, ev.Event, "STOP")
+		AssertEqual(t, ev.Timestamp, EventTimestamp{Seconds: 1, Microseconds: 2})
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for event")
+	}
+
+	err = s.Reset(context.Background())
+	AssertError(t, err, "qmp: CommandNotFound: not found")
+}
+
+func TestSessionReconnect(t *testing.T) {
+	socket := tempSocket(t)
+	srv := newFakeServer(t, socket, statusHandler)
+
+	s, err := NewSession(socket)
+	AssertNonError(t, err)
+	defer s.Close()
+
+	_, err = s.QueryStatus(context.Background())
+	AssertNonError(t, err)
+
+	lost := s.Disconnected()
+	srv.Close()
+
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for disconnection")
+	}
+	AssertEqual(t, s.Connected(), false)
+
+	srv = newFakeServer(t, socket, statusHandler)
+	defer srv.Close()
+
+	_, err = s.QueryStatus(context.Background())
+	AssertNonError(t, err)
+
+	select {
+	case <-s.Disconnected():
+		t.Fatalf("disconnected after reconnection")
+	default:
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	s, err := NewSession(tempSocket(t))
+	AssertNonError(t, err)
+
+	AssertNonError(t, s.Close())
+	AssertNonError(t, s.Close())
+
+	_, err = s.QueryStatus(context.Background())
+	AssertEqual(t, err, ErrClosed)
+
+	_, ok := <-s.Events()
+	AssertEqual(t, ok, false)
+}
+
+func TestSessionExecute(t *testing.T) {
+	socket := tempSocket(t)
+	srv := newFakeServer(t, socket, func(cmd *fakeCommand) []map[string]interface{} {
+		switch cmd.Execute {
+		case "human-monitor-command":
+			return []map[string]interface{}{
+				{"return": string(cmd.Arguments)},
+			}
+		case "query-version":
+			return []map[string]interface{}{
+				{"return": map[string]interface{}{
+					"qemu":    map[string]int{"major": 5, "minor": 1, "micro": 0},
+					"package": "",
+				}},
+			}
+		case "query-cpus-fast":
+			return []map[string]interface{}{
+				{"return": []map[string]interface{}{
+					{"cpu-index": 0, "qom-path": "/machine/unattached/device[0]", "thread-id": 1234, "target": "x86_64",
+						"props": map[string]int{"core-id": 0, "thread-id": 0, "socket-id": 0}},
+					{"cpu-index": 1, "qom-path": "/machine/unattached/device[2]", "thread-id": 1235, "target": "x86_64",
+						"props": map[string]int{"core-id": 1, "thread-id": 0, "socket-id": 0}},
+				}},
+			}
+		}
+		return nil
+	})
+	defer srv.Close()
+
+	s, err := NewSession(socket)
+	AssertNonError(t, err)
+	defer s.Close()
+
+	var args string
+	err = s.Execute(context.Background(), "human-monitor-command", map[string]string{"command-line": "info"}, &args)
+	AssertNonError(t, err)
+	AssertEqual(t, args, `{"command-line":"info"}`)
+
+	err = s.Execute(context.Background(), "human-monitor-command", nil, &args)
+	AssertNonError(t, err)
+	AssertEqual(t, args, "")
+
+	version, err := s.QueryVersion(context.Background())
+	AssertNonError(t, err)
+	AssertEqual(t, version.QEMU, VersionTriple{Major: 5, Minor: 1, Micro: 0})
+
+	cpus, err := s.QueryCPUsFast(context.Background())
+	AssertNonError(t, err)
+	AssertEqual(t, len(cpus), 2)
+	AssertEqual(t, cpus[1].CPUIndex, 1)
+	AssertEqual(t, cpus[1].ThreadID, 1235)
+	AssertEqual(t, *cpus[1].Props.CoreID, 1)
+	AssertEqual(t, cpus[1].Props.DieID == nil, true)
+}
+
+func TestSessionExecuteTimeout(t *testing.T) {
+	s, err := NewSession(tempSocket(t))
+	AssertNonError(t, err)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = s.Execute(ctx, "query-status", nil, nil)
+	AssertEqual(t, err, context.DeadlineExceeded)
+}
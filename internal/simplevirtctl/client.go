@@ -2,7 +2,9 @@ package simplevirtctl
 
 import (
 	"fmt"
+	"net"
 	"net/rpc"
+	"strings"
 
 	"github.com/rafaelmartins/simplevirt/internal/ipc"
 )
@@ -12,8 +14,15 @@ type Client struct {
 	Handler   *ipc.ClientHandler
 }
 
+// NewClient connects to a daemon by its Unix socket, or by a TCP address
+// (HOST:PORT) forwarded to it.
 func NewClient(path string) (*Client, error) {
-	c, err := rpc.Dial("unix", path)
+	network := "unix"
+	if _, _, err := net.SplitHostPort(path); err == nil && !strings.Contains(path, "/") {
+		network = "tcp"
+	}
+
+	c, err := rpc.Dial(network, path)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,130 @@
+package simplevirtctl
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// ctrl-]
+	consoleEscape = 0x1d
+)
+
+func ioctlTermios(fd uintptr, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// makeRaw puts the terminal in raw mode, like cfmakeraw(3), and returns a
+// function that restores the previous state.
+func makeRaw(fd uintptr) (func() error, error) {
+	var old syscall.Termios
+	if err := ioctlTermios(fd, syscall.TCGETS, &old); err != nil {
+		return nil, err
+	}
+
+	t := old
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+
+	if err := ioctlTermios(fd, syscall.TCSETS, &t); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return ioctlTermios(fd, syscall.TCSETS, &old)
+	}, nil
+}
+
+func isTerminal(fd uintptr) bool {
+	var t syscall.Termios
+	return ioctlTermios(fd, syscall.TCGETS, &t) == nil
+}
+
+func attachConsole(name string) error {
+	id, err := client.Handler.OpenConsole(name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Connected to %s (escape character is ^])\n", name)
+
+	if isTerminal(os.Stdin.Fd()) {
+		restore, err := makeRaw(os.Stdin.Fd())
+		if err != nil {
+			client.Handler.CloseConsole(id)
+			return err
+		}
+		defer restore()
+	}
+
+	errChan := make(chan error, 2)
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				errChan <- nil
+				return
+			}
+
+			data := buf[:n]
+			idx := bytes.IndexByte(data, consoleEscape)
+			if idx >= 0 {
+				data = data[:idx]
+			}
+
+			if len(data) > 0 {
+				if _, err := client.Handler.WriteConsole(id, data); err != nil {
+					errChan <- err
+					return
+				}
+			}
+
+			if idx >= 0 {
+				errChan <- nil
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			res, err := client.Handler.ReadConsole(id)
+			if err != nil {
+				errChan <- err
+				return
+			}
+
+			if len(res.Data) > 0 {
+				os.Stdout.Write(res.Data)
+			}
+
+			if res.Closed {
+				errChan <- fmt.Errorf("console closed by virtual machine")
+				return
+			}
+		}
+	}()
+
+	err = <-errChan
+
+	// the session is gone already if the virtual machine closed it
+	client.Handler.CloseConsole(id)
+
+	fmt.Fprint(os.Stderr, "\r\n")
+
+	return err
+}
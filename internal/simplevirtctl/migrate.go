@@ -0,0 +1,91 @@
+package simplevirtctl
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationHost returns the host the migration stream is sent to: the one
+// of the target daemon address, or the local host for Unix sockets.
+func migrationHost(to string) string {
+	if !strings.Contains(to, "/") {
+		if host, _, err := net.SplitHostPort(to); err == nil && host != "" {
+			return host
+		}
+	}
+	return "localhost"
+}
+
+func migrate(name string, to string, address string) error {
+	target, err := NewClient(to)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	info, err := client.Handler.GetVMInfo(name)
+	if err != nil {
+		return err
+	}
+	paused := info.Status == "paused"
+
+	config, err := client.Handler.GetRunningConfig(name)
+	if err != nil {
+		return err
+	}
+
+	if address == "" {
+		address = migrationHost(to)
+	}
+
+	port, err := target.Handler.PrepareMigration(name, config, address)
+	if err != nil {
+		return err
+	}
+
+	uri := "tcp:" + net.JoinHostPort(address, strconv.Itoa(port))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Handler.MigrateVM(name, uri)
+		done <- err
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				if _, err2 := target.Handler.AbortMigration(name); err2 != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s\n", err2)
+				}
+				return err
+			}
+
+			rv, err := target.Handler.FinishMigration(name, paused)
+			if err != nil {
+				return err
+			}
+			if rv != 0 {
+				os.Exit(rv)
+			}
+
+			fmt.Printf("%s: migration completed\n", name)
+			return nil
+
+		case <-ticker.C:
+			status, err := client.Handler.GetMigrationStatus(name)
+			if err != nil || status.Total == 0 {
+				continue
+			}
+			fmt.Printf("%s: %s: %d%% (%d MiB remaining)\n", name, status.Status,
+				100*status.Transferred/status.Total, status.Remaining>>20)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package simplevirtctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	outputFormatChoices = []string{"table", "json", "yaml"}
+)
+
+type vmStatus struct {
+	Name   string `json:"name" yaml:"name"`
+	Status string `json:"status" yaml:"status"`
+}
+
+type vmValidation struct {
+	Name   string   `json:"name" yaml:"name"`
+	Valid  bool     `json:"valid" yaml:"valid"`
+	Errors []string `json:"errors" yaml:"errors"`
+}
+
+func validateOutputFormat() error {
+	for _, choice := range outputFormatChoices {
+		if outputFormat == choice {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid output format (%s). valid choices are: '%s'", outputFormat,
+		strings.Join(outputFormatChoices, "', '"))
+}
+
+// printOutput prints data as JSON or YAML, if requested by the user, or
+// calls table to print it in a human-friendly format.
+func printOutput(data interface{}, table func()) error {
+	switch outputFormat {
+	case "json":
+		out, err := json.MarshalIndent(data, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+
+	case "yaml":
+		out, err := yaml.Marshal(data)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+
+	default:
+		table()
+	}
+
+	return nil
+}
+
+func printTable(rows [][2]string) {
+	size := 0
+	for _, row := range rows {
+		if len(row[0]) > size {
+			size = len(row[0])
+		}
+	}
+
+	for _, row := range rows {
+		fmt.Printf("%-*s: %s\n", size, row[0], row[1])
+	}
+}
+
+// shellQuote quotes the arguments that need it, so that the result can be
+// pasted to a shell.
+func shellQuote(args []string) string {
+	rv := []string{}
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\\'\"$`!*?&;|<>()[]{}#~") {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		rv = append(rv, arg)
+	}
+	return strings.Join(rv, " ")
+}
@@ -2,21 +2,78 @@ package simplevirtctl
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
 	"github.com/rafaelmartins/simplevirt/internal/version"
 )
 
 var (
-	socket string
+	socket       string
+	outputFormat string
+	defineFile   string
+	throttle     qemu.DriveThrottle
+	attachDrive  qemu.Drive
+	persist      bool
+	force        bool
+	fullBackup   bool
+	incrBackup   bool
+	migrateTo    string
+	migrateAddr  string
 
 	client *Client
 )
 
 func init() {
 	rootCmd.PersistentFlags().StringVarP(&socket, "socket", "s", "/run/simplevirtd.sock", "Unix socket to connect")
+	defineCmd.Flags().StringVarP(&defineFile, "file", "f", "", "YAML file with the virtual machine configuration (\"-\" for stdin)")
+	defineCmd.MarkFlagRequired("file")
+
+	throttleCmd.Flags().Int64Var(&throttle.IOPS, "iops", 0, "Total I/O operations per second")
+	throttleCmd.Flags().Int64Var(&throttle.IOPSRead, "iops-rd", 0, "Read I/O operations per second")
+	throttleCmd.Flags().Int64Var(&throttle.IOPSWrite, "iops-wr", 0, "Write I/O operations per second")
+	throttleCmd.Flags().Int64Var(&throttle.BPS, "bps", 0, "Total bytes per second")
+	throttleCmd.Flags().Int64Var(&throttle.BPSRead, "bps-rd", 0, "Read bytes per second")
+	throttleCmd.Flags().Int64Var(&throttle.BPSWrite, "bps-wr", 0, "Write bytes per second")
+	throttleCmd.Flags().Int64Var(&throttle.IOPSMax, "iops-max", 0, "Burst of total I/O operations per second")
+	throttleCmd.Flags().Int64Var(&throttle.IOPSReadMax, "iops-rd-max", 0, "Burst of read I/O operations per second")
+	throttleCmd.Flags().Int64Var(&throttle.IOPSWriteMax, "iops-wr-max", 0, "Burst of write I/O operations per second")
+	throttleCmd.Flags().Int64Var(&throttle.BPSMax, "bps-max", 0, "Burst of total bytes per second")
+	throttleCmd.Flags().Int64Var(&throttle.BPSReadMax, "bps-rd-max", 0, "Burst of read bytes per second")
+	throttleCmd.Flags().Int64Var(&throttle.BPSWriteMax, "bps-wr-max", 0, "Burst of write bytes per second")
+	throttleCmd.Flags().Int64Var(&throttle.BurstLength, "burst-length", 0, "Maximum length of bursts, in seconds")
+
+	mediaCmd.PersistentFlags().BoolVar(&persist, "persist", false, "Save the change to the virtual machine configuration")
+	mediaEjectCmd.Flags().BoolVar(&force, "force", false, "Eject even if the guest locked the tray")
+
+	diskCmd.PersistentFlags().BoolVar(&persist, "persist", false, "Save the change to the virtual machine configuration")
+	diskAttachCmd.Flags().StringVar(&attachDrive.ID, "id", "", "Drive id (default driveN, N being the position of the drive)")
+	diskAttachCmd.Flags().StringVar(&attachDrive.Device, "device", "virtio-blk-pci", "Device model (virtio-blk-pci, scsi-hd, nvme)")
+	diskAttachCmd.Flags().StringVar(&attachDrive.Format, "format", "", "Image format")
+	diskAttachCmd.Flags().StringVar(&attachDrive.Cache, "cache", "", "Cache mode")
+	diskAttachCmd.Flags().StringVar(&attachDrive.Serial, "serial", "", "Serial number reported to the guest")
+	diskAttachCmd.Flags().BoolVar(&attachDrive.IOThread, "iothread", false, "Run the I/O in a dedicated thread")
+	diskAttachCmd.MarkFlagRequired("format")
+
+	backupCmd.Flags().BoolVar(&fullBackup, "full", false, "Create a full backup, starting a new chain")
+	backupCmd.Flags().BoolVar(&incrBackup, "incremental", false, "Create an incremental backup, with the changes since the previous one")
+
+	migrateCmd.Flags().StringVar(&migrateTo, "to", "", "Unix socket or TCP address (HOST:PORT) of the target daemon")
+	migrateCmd.Flags().StringVar(&migrateAddr, "address", "", "Address the target host listens on for the migration stream (default: host of --to, or localhost)")
+	migrateCmd.MarkFlagRequired("to")
+
+	mediaCmd.AddCommand(mediaInsertCmd, mediaEjectCmd)
+	snapshotCmd.AddCommand(snapshotCreateCmd, snapshotListCmd, snapshotDeleteCmd, snapshotRevertCmd)
+	diskCmd.AddCommand(diskAttachCmd, diskDetachCmd)
+
+	rootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", "table", "Output format for commands that return data (table, json, yaml)")
 }
 
 var rootCmd = &cobra.Command{
@@ -30,6 +87,15 @@ var rootCmd = &cobra.Command{
 			return fmt.Errorf("empty socket file name is invalid")
 		}
 
+		if err := validateOutputFormat(); err != nil {
+			return err
+		}
+
+		// local files are validated without the daemon
+		if cmd == validateCmd && len(args) == 1 && isConfigFile(args[0]) {
+			return nil
+		}
+
 		var err error
 		client, err = NewClient(socket)
 		if err != nil {
@@ -49,7 +115,7 @@ var rootCmd = &cobra.Command{
 var startCmd = &cobra.Command{
 	Use:   "start NAME",
 	Short: "Starts a virtual machine",
-	Long:  "This command starts a virtual machine, if not running.",
+	Long:  "This command starts a virtual machine, if not running. Virtual machines saved by the save command are restored.",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		rv, err := client.Handler.StartVM(args[0])
@@ -122,6 +188,560 @@ var resetCmd = &cobra.Command{
 	},
 }
 
+var pauseCmd = &cobra.Command{
+	Use:   "pause NAME",
+	Short: "Pauses a virtual machine",
+	Long:  "This command pauses the execution of a virtual machine, if running.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rv, err := client.Handler.PauseVM(args[0])
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var resumeCmd = &cobra.Command{
+	Use:   "resume NAME",
+	Short: "Resumes a paused virtual machine",
+	Long:  "This command resumes the execution of a paused virtual machine.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rv, err := client.Handler.ResumeVM(args[0])
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var saveCmd = &cobra.Command{
+	Use:   "save NAME",
+	Short: "Saves the state of a virtual machine to disk",
+	Long:  "This command saves the memory state of a running virtual machine to the daemon state directory, and stops it. Starting the virtual machine again restores it.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rv, err := client.Handler.SaveVM(args[0])
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore NAME",
+	Short: "Restores a saved virtual machine",
+	Long:  "This command starts a virtual machine from the state saved by the save command.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rv, err := client.Handler.RestoreVM(args[0])
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var discardCmd = &cobra.Command{
+	Use:   "discard NAME",
+	Short: "Discards the saved state of a virtual machine",
+	Long:  "This command removes the state saved by the save command, so that the virtual machine boots from scratch when started again. The virtual machine must not be running.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rv, err := client.Handler.DiscardSavedVM(args[0])
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var memoryCmd = &cobra.Command{
+	Use:   "memory NAME SIZE",
+	Short: "Changes the memory of a running virtual machine",
+	Long:  "This command asks the guest of a running virtual machine to change its memory to SIZE (e.g. 512M, 2G), using the balloon device. SIZE can't be larger than the ram of the virtual machine. The change is lost when the virtual machine restarts.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rv, err := client.Handler.SetMemory(args[0], args[1])
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var vcpusCmd = &cobra.Command{
+	Use:   "vcpus NAME COUNT",
+	Short: "Adds vcpus to a running virtual machine",
+	Long:  "This command hotplugs vcpus into a running virtual machine, until it has COUNT vcpus. COUNT can't be greater than the maxcpus of its cpu_topology, and vcpus can't be removed. Machines that hotplug vcpus in groups, like whole cores, can only reach the counts those groups add up to. The change is lost when the virtual machine is stopped.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		count, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid number of vcpus: %s", args[1])
+		}
+
+		rv, err := client.Handler.SetVCPUs(args[0], count)
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate NAME --to SOCKET-OR-ADDR",
+	Short: "Migrates a running virtual machine to another daemon",
+	Long:  "This command moves a running virtual machine to another simplevirtd, without stopping it. Both hosts must share the storage of the virtual machine, and have the bridges it uses. The target daemon can be given by its Unix socket, or by a TCP address forwarded to it (e.g. with ssh). The configuration file is not copied.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migrate(args[0], migrateTo, migrateAddr)
+	},
+}
+
+var defineCmd = &cobra.Command{
+	Use:   "define NAME -f FILE",
+	Short: "Defines a virtual machine",
+	Long:  "This command validates a virtual machine configuration and installs it in the daemon configuration directory, replacing any existing one.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var (
+			data []byte
+			err  error
+		)
+		if defineFile == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(defineFile)
+		}
+		if err != nil {
+			return err
+		}
+
+		rv, err := client.Handler.DefineVM(args[0], data)
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var undefineCmd = &cobra.Command{
+	Use:   "undefine NAME",
+	Short: "Removes a virtual machine definition",
+	Long:  "This command removes the configuration of a virtual machine from the daemon configuration directory. The virtual machine must not be running.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rv, err := client.Handler.UndefineVM(args[0])
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate [NAME|FILE]",
+	Short: "Validates virtual machine configurations",
+	Long:  "This command validates the configuration of a virtual machine, of all the available virtual machines, or of a local YAML file, listing all the errors found.",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		results := []*vmValidation{}
+
+		if len(args) == 1 && isConfigFile(args[0]) {
+			result, err := validateFile(args[0])
+			if err != nil {
+				return err
+			}
+			results = append(results, result)
+		} else {
+			vms := args
+			if len(vms) == 0 {
+				var err error
+				vms, err = client.Handler.ListVMs()
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, vm := range vms {
+				errs, err := client.Handler.ValidateVM(vm)
+				if err != nil {
+					return err
+				}
+				if errs == nil {
+					errs = []string{}
+				}
+				results = append(results, &vmValidation{Name: vm, Valid: len(errs) == 0, Errors: errs})
+			}
+		}
+
+		if err := printOutput(results, func() {
+			for _, result := range results {
+				if result.Valid {
+					fmt.Printf("%s: valid\n", result.Name)
+					continue
+				}
+				fmt.Printf("%s: invalid\n", result.Name)
+				for _, e := range result.Errors {
+					fmt.Printf("    %s\n", e)
+				}
+			}
+		}); err != nil {
+			return err
+		}
+
+		for _, result := range results {
+			if !result.Valid {
+				os.Exit(1)
+			}
+		}
+
+		return nil
+	},
+}
+
+var cmdlineCmd = &cobra.Command{
+	Use:   "cmdline NAME",
+	Short: "Shows the QEMU command line of a virtual machine",
+	Long:  "This command shows the QEMU command line that would be executed to start a virtual machine. Tap device names are only known when starting, and are shown as placeholders.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmdline, err := client.Handler.GetVMCommandLine(args[0])
+		if err != nil {
+			return err
+		}
+
+		return printOutput(cmdline, func() {
+			fmt.Println(shellQuote(cmdline))
+		})
+	},
+}
+
+var throttleCmd = &cobra.Command{
+	Use:   "throttle NAME DRIVE",
+	Short: "Sets the I/O limits of a drive",
+	Long:  "This command replaces the I/O limits of a drive of a running virtual machine. Limits not given are removed. Drives are named by their id, or drive1, drive2, ... in configuration order. The changes are lost when the virtual machine restarts.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rv, err := client.Handler.SetDriveThrottle(args[0], args[1], &throttle)
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var mediaCmd = &cobra.Command{
+	Use:   "media",
+	Short: "Changes the media of cdrom drives",
+	Long:  "These commands change the media of cdrom drives of running virtual machines. Drives are named by their id, or drive1, drive2, ... in configuration order.",
+}
+
+var mediaInsertCmd = &cobra.Command{
+	Use:   "insert NAME DRIVE FILE",
+	Short: "Inserts media into a cdrom drive",
+	Long:  "This command inserts an image into a cdrom drive of a running virtual machine, replacing the current media, if any.",
+	Args:  cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// the daemon does not share our working directory
+		file, err := filepath.Abs(args[2])
+		if err != nil {
+			return err
+		}
+
+		rv, err := client.Handler.ChangeMedia(args[0], args[1], file, persist)
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var mediaEjectCmd = &cobra.Command{
+	Use:   "eject NAME DRIVE",
+	Short: "Ejects the media of a cdrom drive",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rv, err := client.Handler.EjectMedia(args[0], args[1], force, persist)
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var diskCmd = &cobra.Command{
+	Use:   "disk",
+	Short: "Attaches and detaches disks",
+	Long:  "These commands attach and detach disks of running virtual machines. Only drives with a device can be attached or detached.",
+}
+
+var diskAttachCmd = &cobra.Command{
+	Use:   "attach NAME FILE",
+	Short: "Attaches a disk to a virtual machine",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := filepath.Abs(args[1])
+		if err != nil {
+			return err
+		}
+		attachDrive.File = file
+
+		rv, err := client.Handler.AttachDisk(args[0], &attachDrive, persist)
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var diskDetachCmd = &cobra.Command{
+	Use:   "detach NAME DRIVE",
+	Short: "Detaches a disk from a virtual machine",
+	Long:  "This command detaches a disk from a running virtual machine. The guest must release the device, which may take a few seconds.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rv, err := client.Handler.DetachDisk(args[0], args[1], persist)
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manages snapshots of virtual machines",
+	Long:  "These commands manage external snapshots of the drives of virtual machines. Creating a snapshot switches the drives to new qcow2 images, backed by the current ones, which are kept unchanged. Cdrom drives are not included.",
+}
+
+var snapshotCreateCmd = &cobra.Command{
+	Use:   "create NAME [SNAPSHOT]",
+	Short: "Creates a snapshot",
+	Long:  "This command creates a snapshot of a virtual machine, running or not. Snapshots are named after the current time by default.",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		snapshot := time.Now().Format("20060102-150405")
+		if len(args) == 2 {
+			snapshot = args[1]
+		}
+
+		rv, err := client.Handler.CreateSnapshot(args[0], snapshot)
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list NAME",
+	Short: "Lists the snapshots of a virtual machine",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		snapshots, err := client.Handler.ListSnapshots(args[0])
+		if err != nil {
+			return err
+		}
+
+		return printOutput(snapshots, func() {
+			rows := [][2]string{}
+			for _, snap := range snapshots {
+				drives := []string{}
+				for _, sd := range snap.Drives {
+					drives = append(drives, sd.Drive)
+				}
+				rows = append(rows, [2]string{
+					snap.Name,
+					fmt.Sprintf("%s (%s)", snap.Created.Format(time.RFC3339), strings.Join(drives, ", ")),
+				})
+			}
+			printTable(rows)
+		})
+	},
+}
+
+var snapshotDeleteCmd = &cobra.Command{
+	Use:   "delete NAME SNAPSHOT",
+	Short: "Deletes a snapshot",
+	Long:  "This command deletes a snapshot of a running virtual machine, merging the changes made after it into its images. This may take a while.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rv, err := client.Handler.DeleteSnapshot(args[0], args[1])
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var snapshotRevertCmd = &cobra.Command{
+	Use:   "revert NAME SNAPSHOT",
+	Short: "Reverts a virtual machine to a snapshot",
+	Long:  "This command discards all the changes made to the drives of a virtual machine after a snapshot, including the snapshots created after it. The virtual machine must not be running.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		rv, err := client.Handler.RevertSnapshot(args[0], args[1])
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var backupCmd = &cobra.Command{
+	Use:   "backup NAME --full|--incremental",
+	Short: "Backs up the drives of a virtual machine",
+	Long:  "This command backs up the drives of a running virtual machine, as qcow2 images in the backup_dir of the virtual machine. Incremental backups are backed by the previous backup. The command waits for the backup to finish.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if fullBackup == incrBackup {
+			return fmt.Errorf("exactly one of --full or --incremental is required")
+		}
+
+		rv, err := client.Handler.BackupVM(args[0], incrBackup)
+		if err != nil {
+			return err
+		}
+
+		if rv != 0 {
+			os.Exit(rv)
+		}
+
+		return nil
+	},
+}
+
+var backupsCmd = &cobra.Command{
+	Use:   "backups NAME",
+	Short: "Lists the backups of a virtual machine",
+	Long:  "This command lists the backups of a virtual machine, in creation order. Each full backup starts a chain, followed by its incremental backups.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		backups, err := client.Handler.ListBackups(args[0])
+		if err != nil {
+			return err
+		}
+
+		return printOutput(backups, func() {
+			rows := [][2]string{}
+			for _, backup := range backups {
+				kind := "full"
+				if backup.Incremental {
+					kind = "incremental"
+				}
+				drives := []string{}
+				for _, bd := range backup.Drives {
+					drives = append(drives, bd.Drive)
+				}
+				rows = append(rows, [2]string{
+					backup.Name,
+					fmt.Sprintf("%s (%s)", kind, strings.Join(drives, ", ")),
+				})
+			}
+			printTable(rows)
+		})
+	},
+}
+
+var consoleCmd = &cobra.Command{
+	Use:   "console NAME",
+	Short: "Attaches to the serial console of a virtual machine",
+	Long:  "This command attaches the terminal to the serial console of a running virtual machine. Press Ctrl-] to detach.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return attachConsole(args[0])
+	},
+}
+
 var statusCmd = &cobra.Command{
 	Use:   "status [NAME] ...",
 	Short: "List status of virtual machines",
@@ -137,22 +757,92 @@ var statusCmd = &cobra.Command{
 			vvms = args
 		}
 
-		size := 0
-		for _, vm := range vvms {
-			if len(vm) > size {
-				size = len(vm)
-			}
-		}
-
+		statuses := []*vmStatus{}
 		for _, vm := range vvms {
 			status, err := client.Handler.GetVMStatus(vm)
 			if err != nil {
 				return err
 			}
-			fmt.Printf("%-*s: %s\n", size, vm, status)
+			statuses = append(statuses, &vmStatus{Name: vm, Status: status})
 		}
 
-		return nil
+		return printOutput(statuses, func() {
+			rows := [][2]string{}
+			for _, status := range statuses {
+				rows = append(rows, [2]string{status.Name, status.Status})
+			}
+			printTable(rows)
+		})
+	},
+}
+
+var infoCmd = &cobra.Command{
+	Use:   "info NAME",
+	Short: "Show detailed information about a virtual machine",
+	Long:  "This command shows detailed information about a virtual machine, including runtime details, if running.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		info, err := client.Handler.GetVMInfo(args[0])
+		if err != nil {
+			return err
+		}
+
+		return printOutput(info, func() {
+			nics := []string{}
+			for _, nic := range info.NICs {
+				nics = append(nics, fmt.Sprintf("%s (%s)", nic.Device, nic.Bridge))
+			}
+
+			pinning := []string{}
+			for _, p := range info.Pinning {
+				pinning = append(pinning, fmt.Sprintf("%s: %s", p.Thread, p.CPUs))
+			}
+
+			rows := [][2]string{
+				{"Name", info.Name},
+				{"Status", info.Status},
+				{"Config file", info.ConfigFile},
+			}
+			if info.PID > 0 {
+				rows = append(rows, [][2]string{
+					{"PID", fmt.Sprintf("%d", info.PID)},
+					{"Uptime", (time.Duration(info.Uptime) * time.Second).String()},
+					{"Retries", fmt.Sprintf("%d", info.Retries)},
+					{"NICs", strings.Join(nics, ", ")},
+					{"VNC", info.VNC},
+					{"vCPUs", fmt.Sprintf("%d", info.VCPUs)},
+					{"Memory", fmt.Sprintf("%d MiB", info.Memory>>20)},
+					{"CPU pinning", strings.Join(pinning, ", ")},
+				}...)
+				if info.Cgroup != nil {
+					rows = append(rows, [][2]string{
+						{"Cgroup CPU time", (time.Duration(info.Cgroup.CPUTime) * time.Microsecond).String()},
+						{"Cgroup memory", fmt.Sprintf("%d MiB", info.Cgroup.Memory>>20)},
+						{"Cgroup tasks", fmt.Sprintf("%d", info.Cgroup.PIDs)},
+						{"Cgroup IO", fmt.Sprintf("%d MiB read, %d MiB written", info.Cgroup.ReadBytes>>20, info.Cgroup.WriteBytes>>20)},
+					}...)
+				}
+				rows = append(rows, [2]string{"Command line", strings.Join(info.CommandLine, " ")})
+			}
+			printTable(rows)
+		})
+	},
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats NAME",
+	Short: "Show resource usage of a running virtual machine",
+	Long:  "This command shows the cpu, memory, network and disk usage of a running virtual machine, averaged over the last few minutes. The json and yaml outputs include all the samples collected by the daemon.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		stats, err := client.Handler.GetVMStats(args[0])
+		if err != nil {
+			return err
+		}
+
+		return printOutput(stats, func() {
+			printTable(statsRows(stats))
+		})
 	},
 }
 
@@ -162,7 +852,28 @@ func Execute() {
 		restartCmd,
 		shutdownCmd,
 		resetCmd,
+		pauseCmd,
+		resumeCmd,
+		saveCmd,
+		restoreCmd,
+		discardCmd,
+		migrateCmd,
+		memoryCmd,
+		vcpusCmd,
+		throttleCmd,
+		mediaCmd,
+		diskCmd,
+		snapshotCmd,
+		backupCmd,
+		backupsCmd,
+		consoleCmd,
+		defineCmd,
+		undefineCmd,
+		validateCmd,
+		cmdlineCmd,
 		statusCmd,
+		infoCmd,
+		statsCmd,
 	)
 	rootCmd.Execute()
 }
@@ -0,0 +1,62 @@
+package simplevirtctl
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rafaelmartins/simplevirt/internal/monitor"
+)
+
+// statsRows returns the table rows of the last sample, with the rates
+// averaged since the first one.
+func statsRows(stats []*monitor.Stats) [][2]string {
+	if len(stats) == 0 {
+		return [][2]string{}
+	}
+
+	first, last := stats[0], stats[len(stats)-1]
+	elapsed := last.Time.Sub(first.Time).Seconds()
+
+	rate := func(from int64, to int64) float64 {
+		if elapsed <= 0 {
+			return 0
+		}
+		return float64(to-from) / elapsed
+	}
+
+	rows := [][2]string{
+		{"Time", last.Time.Format(time.RFC3339)},
+		{"Interval", (time.Duration(elapsed) * time.Second).String()},
+		{"CPU", fmt.Sprintf("%.1f%% (%s total)", rate(first.CPUTime, last.CPUTime)/10000,
+			time.Duration(last.CPUTime)*time.Microsecond)},
+		{"RSS", fmt.Sprintf("%d MiB", last.RSS>>20)},
+	}
+
+	for _, nic := range last.NICs {
+		prev := &monitor.NICStats{}
+		for _, n := range first.NICs {
+			if n.Device == nic.Device {
+				prev = n
+			}
+		}
+		rows = append(rows, [2]string{"NIC " + nic.Device, fmt.Sprintf(
+			"rx %d MiB (%.1f KiB/s), tx %d MiB (%.1f KiB/s)",
+			nic.RxBytes>>20, rate(prev.RxBytes, nic.RxBytes)/1024,
+			nic.TxBytes>>20, rate(prev.TxBytes, nic.TxBytes)/1024)})
+	}
+
+	for _, drv := range last.Drives {
+		prev := &monitor.DriveStats{}
+		for _, d := range first.Drives {
+			if d.Device == drv.Device {
+				prev = d
+			}
+		}
+		rows = append(rows, [2]string{"Drive " + drv.Device, fmt.Sprintf(
+			"read %d MiB (%.1f KiB/s, %.1f ops/s), write %d MiB (%.1f KiB/s, %.1f ops/s)",
+			drv.ReadBytes>>20, rate(prev.ReadBytes, drv.ReadBytes)/1024, rate(prev.ReadOps, drv.ReadOps),
+			drv.WriteBytes>>20, rate(prev.WriteBytes, drv.WriteBytes)/1024, rate(prev.WriteOps, drv.WriteOps))})
+	}
+
+	return rows
+}
@@ -0,0 +1,46 @@
+package simplevirtctl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rafaelmartins/simplevirt/internal/qemu"
+)
+
+// isConfigFile tells if arg refers to a local file, instead of the name of a
+// virtual machine known by the daemon.
+func isConfigFile(arg string) bool {
+	if !strings.ContainsRune(arg, os.PathSeparator) && !strings.HasSuffix(arg, ".yml") &&
+		!strings.HasSuffix(arg, ".yaml") {
+		return false
+	}
+
+	info, err := os.Stat(arg)
+	return err == nil && !info.IsDir()
+}
+
+func validateFile(file string) (*vmValidation, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+
+	rv := &vmValidation{Name: name, Valid: true, Errors: []string{}}
+
+	if _, err := qemu.ValidateConfig(name, data); err != nil {
+		errs, ok := err.(qemu.ConfigErrors)
+		if !ok {
+			return nil, err
+		}
+		rv.Valid = false
+		for _, e := range errs {
+			rv.Errors = append(rv.Errors, e.Error())
+		}
+	}
+
+	return rv, nil
+}
@@ -38,7 +38,7 @@ func listenAndServe() error {
 		return err
 	}
 
-	mon, err := ipc.RegisterHandlers(configDir, runtimeDir)
+	mon, err := ipc.RegisterHandlers(configDir, runtimeDir, stateDir, cgroupParent, saveOnExit)
 	if err != nil {
 		return err
 	}
@@ -51,8 +51,16 @@ func listenAndServe() error {
 	go func(l net.Listener, c chan os.Signal) {
 		sig := <-c
 
-		logutils.Error.Printf("caught signal %q: shutting down virtual machines.\n", sig)
-		mon.Cleanup()
+		if keepRunning {
+			logutils.Error.Printf("caught signal %q: detaching from virtual machines.\n", sig)
+			mon.Detach()
+		} else if saveOnExit {
+			logutils.Error.Printf("caught signal %q: saving virtual machines.\n", sig)
+			mon.Cleanup()
+		} else {
+			logutils.Error.Printf("caught signal %q: shutting down virtual machines.\n", sig)
+			mon.Cleanup()
+		}
 
 		exiting = true
 		l.Close()
@@ -72,7 +80,4 @@ func listenAndServe() error {
 		}
 		go rpc.ServeConn(conn)
 	}
-
-	mon.Cleanup()
-	return nil
 }
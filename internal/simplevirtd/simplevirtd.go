@@ -13,19 +13,27 @@ import (
 )
 
 var (
-	configDir  string
-	runtimeDir string
-	socket     string
-	syslogF    bool
-	logLevel   string
+	configDir    string
+	runtimeDir   string
+	stateDir     string
+	socket       string
+	syslogF      bool
+	logLevel     string
+	keepRunning  bool
+	saveOnExit   bool
+	cgroupParent string
 )
 
 func init() {
 	cmd.Flags().StringVarP(&configDir, "configdir", "c", "/etc/simplevirt", "Directory with configuration files")
 	cmd.Flags().StringVarP(&runtimeDir, "runtimedir", "m", "/run/simplevirt", "Directory to store QEMU runtime files")
+	cmd.Flags().StringVar(&stateDir, "statedir", "/var/lib/simplevirt", "Directory to store the saved state of virtual machines")
 	cmd.Flags().StringVarP(&socket, "socket", "s", "/run/simplevirtd.sock", "Unix socket to listen")
 	cmd.Flags().BoolVar(&syslogF, "syslog", false, "Use syslog for logging instead of standard error output")
 	cmd.Flags().StringVarP(&logLevel, "loglevel", "l", "WARNING", "Log level for non-syslog logging (CRITICAL, ERROR, WARNING, NOTICE)")
+	cmd.Flags().BoolVar(&keepRunning, "keep-running", false, "Leave virtual machines running on exit, to be adopted when the daemon starts again")
+	cmd.Flags().BoolVar(&saveOnExit, "save-on-exit", false, "Save the state of virtual machines to disk on exit, to be restored when they are started again")
+	cmd.Flags().StringVar(&cgroupParent, "cgroup-parent", "", "Cgroup v2 directory to create the cgroups of virtual machines in, to apply their resource limits (e.g. /sys/fs/cgroup/simplevirt). must not be the cgroup of the daemon")
 }
 
 var cmd = &cobra.Command{
@@ -71,6 +79,14 @@ var cmd = &cobra.Command{
 		if runtimeDir == "" {
 			logutils.Error.Fatal("empty runtime directory is invalid")
 		}
+		if stateDir == "" {
+			logutils.Error.Fatal("empty state directory is invalid")
+		}
+
+		if keepRunning && saveOnExit {
+			logutils.Error.Fatal("--keep-running and --save-on-exit can't be used together")
+		}
+
 		if _, err := os.Stat(runtimeDir); err != nil {
 			if os.IsNotExist(err) {
 				if err := os.MkdirAll(runtimeDir, 0777); err != nil {